@@ -0,0 +1,891 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/command"
+	"github.com/usrbinsam/go-away/internal/gmail"
+	"github.com/usrbinsam/go-away/internal/imap"
+	"github.com/usrbinsam/go-away/internal/jmap"
+	"github.com/usrbinsam/go-away/internal/maildir"
+	"github.com/usrbinsam/go-away/internal/mbox"
+	"github.com/usrbinsam/go-away/internal/rules"
+	"github.com/usrbinsam/go-away/internal/scanner"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// providerKeys are the inbox types that can be added.
+var providerKeys = []string{gmail.GmailInboxKey, imap.IMAPInboxKey, jmap.JMAPInboxKey, maildir.MaildirInboxKey, mbox.MboxInboxKey}
+
+// app holds the state shared by the subcommands.
+type app struct {
+	cli      *command.CLI
+	st       *store.SQLStore
+	prompter *prompter
+
+	decisions map[int]map[string]string // review decisions by inbox ID and list key
+
+	// flags of the scan, unsubscribe, safe-senders and blocklist commands
+	inbox   string
+	timeout time.Duration
+	confirm bool
+	apply   bool
+	rescan  bool
+	output  string
+}
+
+func (a *app) commands() []*command.Command {
+	scanFlags := func(fs *flag.FlagSet) {
+		fs.StringVar(&a.inbox, "inbox", "", "only scan this inbox (address or ID)")
+		fs.DurationVar(&a.timeout, "timeout", 0, "stop the run after this long, e.g. 10m (0 for no limit)")
+		fs.BoolVar(&a.rescan, "rescan", false, "also scan messages seen by earlier runs")
+	}
+	scanOutputFlags := func(fs *flag.FlagSet) {
+		scanFlags(fs)
+		fs.StringVar(&a.output, "output", "table", "output format: table, json, ndjson or csv")
+	}
+	unsubscribeFlags := func(fs *flag.FlagSet) {
+		scanFlags(fs)
+		fs.BoolVar(&a.apply, "apply", false, "unsubscribe for real, without it nothing is changed")
+		fs.BoolVar(&a.confirm, "confirm", false, "ask before each unsubscribe, except for blocklisted senders")
+	}
+	inboxFlag := func(fs *flag.FlagSet) {
+		fs.StringVar(&a.inbox, "inbox", "", "apply to this inbox only (address or ID) instead of every inbox")
+	}
+
+	return []*command.Command{
+		{
+			Name:    "inbox",
+			Summary: "manage inboxes",
+			Subcommands: []*command.Command{
+				{Name: "add", Args: "[<provider> [<address>]]", Summary: "set up and add an inbox (provider is one of gmail, imap, jmap, maildir, mbox)", Run: a.inboxAdd},
+				{Name: "list", Summary: "list inboxes", Run: a.inboxList},
+				{Name: "remove", Args: "<inbox>", Summary: "remove an inbox and its config", Run: a.inboxRemove},
+				{Name: "reauth", Args: "<inbox>", Summary: "set up an inbox's credentials again", Run: a.inboxReauth},
+			},
+		},
+		{Name: "scan", Summary: "list mailing lists that can be unsubscribed from", Flags: scanOutputFlags, Run: a.scan},
+		{Name: "unsubscribe", Summary: "scan and unsubscribe from every list found (with -apply)", Flags: unsubscribeFlags, Run: a.unsubscribe},
+		{Name: "review", Summary: "decide list by list what to keep or unsubscribe from", Flags: scanFlags, Run: a.review},
+		{Name: "scanners", Summary: "list scanners and the inboxes they are enabled for", Run: a.scannersList},
+		{Name: "history", Summary: "list past unsubscribe attempts", Run: a.history},
+		{
+			Name:    "safe-senders",
+			Summary: "manage senders that are never unsubscribed from",
+			Subcommands: []*command.Command{
+				{Name: "list", Summary: "list safe sender rules", Run: a.rulesList(safeSenderRules)},
+				{Name: "add", Args: "<rule>...", Summary: "add rules: alerts@bank.com, bank.com, *.bank.com, list:<list-id> or /regex/", Flags: inboxFlag, Run: a.rulesAdd(safeSenderRules)},
+				{Name: "remove", Args: "<rule>", Summary: "remove a rule", Flags: inboxFlag, Run: a.rulesRemove(safeSenderRules)},
+				{Name: "import", Args: "<file>", Summary: "add the rules in a file, one per line (- for stdin)", Flags: inboxFlag, Run: a.rulesImport(safeSenderRules)},
+			},
+		},
+		{
+			Name:    "blocklist",
+			Summary: "manage senders that are always unsubscribed from",
+			Subcommands: []*command.Command{
+				{Name: "list", Summary: "list blocklist rules", Run: a.rulesList(blocklistRules)},
+				{Name: "add", Args: "<rule>...", Summary: "add rules: news@shop.com, shop.com, *.shop.com, list:<list-id> or /regex/", Flags: inboxFlag, Run: a.rulesAdd(blocklistRules)},
+				{Name: "remove", Args: "<rule>", Summary: "remove a rule", Flags: inboxFlag, Run: a.rulesRemove(blocklistRules)},
+				{Name: "import", Args: "<file>", Summary: "add the rules in a file, one per line (- for stdin)", Flags: inboxFlag, Run: a.rulesImport(blocklistRules)},
+			},
+		},
+		{
+			Name:    "config",
+			Summary: "read and change inbox config",
+			Subcommands: []*command.Command{
+				{Name: "get", Args: "<inbox> <key>", Summary: "print a config value", Run: a.configGet},
+				{Name: "set", Args: "<inbox> <key> <value>", Summary: "change a config value", Run: a.configSet},
+				{Name: "unset", Args: "<inbox> <key>", Summary: "remove a config value", Run: a.configUnset},
+			},
+		},
+	}
+}
+
+// store opens the database on first use and applies --verbose.
+func (a *app) store() (*store.SQLStore, error) {
+	if a.st != nil {
+		return a.st, nil
+	}
+
+	if !a.cli.Global.Verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	st := &store.SQLStore{}
+	if err := st.Open(a.cli.Global.DB); err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	a.st = st
+	return st, nil
+}
+
+func (a *app) close() {
+	if a.st != nil {
+		a.st.Close()
+		a.st = nil
+	}
+}
+
+func (a *app) stdout() io.Writer {
+	return a.cli.Stdout
+}
+
+// prompt returns the prompter reading answers from stdin.
+func (a *app) prompt() *prompter {
+	if a.prompter == nil {
+		a.prompter = newPrompter(os.Stdin, a.stdout())
+	}
+	return a.prompter
+}
+
+// findInbox returns the inbox whose ID or address is ref.
+func (a *app) findInbox(ctx context.Context, ref string) (store.Inbox, error) {
+	st, err := a.store()
+	if err != nil {
+		return store.Inbox{}, err
+	}
+
+	inboxes, err := st.ListInboxes(ctx)
+	if err != nil {
+		return store.Inbox{}, err
+	}
+
+	id, _ := strconv.Atoi(ref)
+	matches := make([]store.Inbox, 0, 1)
+	for _, inbox := range inboxes {
+		if inbox.ID == id || inbox.Addr == ref {
+			matches = append(matches, inbox)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return store.Inbox{}, fmt.Errorf("no inbox %q, see 'inbox list'", ref)
+	case 1:
+		return matches[0], nil
+	}
+	return store.Inbox{}, fmt.Errorf("%q matches %d inboxes, use the inbox ID instead", ref, len(matches))
+}
+
+// inboxAdd sets up a new inbox, asking for whatever was not given as an
+// argument. The inbox is only saved once a test fetch succeeds.
+func (a *app) inboxAdd(ctx context.Context, args []string) error {
+	if len(args) > 2 {
+		return command.ErrUsage
+	}
+
+	st, err := a.store()
+	if err != nil {
+		return err
+	}
+
+	p := a.prompt()
+	var providerKey, addr string
+	if len(args) > 0 {
+		providerKey = args[0]
+	} else if providerKey, err = p.choose("Provider", providerKeys, ""); err != nil {
+		return err
+	}
+	if !slices.Contains(providerKeys, providerKey) {
+		return fmt.Errorf("unknown provider %q, expected one of %v", providerKey, providerKeys)
+	}
+	if len(args) > 1 {
+		addr = args[1]
+	} else if addr, err = p.ask("Email address", ""); err != nil {
+		return err
+	}
+
+	inboxes, err := st.ListInboxes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, inbox := range inboxes {
+		if inbox.Provider == providerKey && strings.EqualFold(inbox.Addr, addr) {
+			return fmt.Errorf("%s inbox %s already exists, use 'inbox reauth %d' to renew its credentials", providerKey, addr, inbox.ID)
+		}
+	}
+
+	if a.cli.Global.DryRun {
+		fmt.Fprintf(a.stdout(), "would add %s inbox %s\n", providerKey, addr)
+		return nil
+	}
+
+	inboxConfig := store.NewPendingInboxConfig(nil)
+	if err := a.setupInbox(ctx, providerKey, addr, inboxConfig); err != nil {
+		return err
+	}
+	if err := a.checkInbox(ctx, providerKey, inboxConfig); err != nil {
+		return err
+	}
+
+	inbox, err := st.AddInbox(ctx, addr, providerKey, inboxConfig)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout(), "added %s inbox %s with ID %d\n", inbox.Provider, inbox.Addr, inbox.ID)
+	return nil
+}
+
+func (a *app) inboxList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return command.ErrUsage
+	}
+
+	st, err := a.store()
+	if err != nil {
+		return err
+	}
+
+	inboxes, err := st.ListInboxes(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(a.stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROVIDER\tADDRESS")
+	for _, inbox := range inboxes {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", inbox.ID, inbox.Provider, inbox.Addr)
+	}
+	return w.Flush()
+}
+
+func (a *app) inboxRemove(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return command.ErrUsage
+	}
+
+	inbox, err := a.findInbox(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if a.cli.Global.DryRun {
+		fmt.Fprintf(a.stdout(), "would remove inbox %s\n", inbox.Addr)
+		return nil
+	}
+
+	if err := a.st.RemoveInbox(ctx, inbox.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout(), "removed inbox %s\n", inbox.Addr)
+	return nil
+}
+
+// inboxReauth runs the same credential setup and test fetch as inboxAdd
+// against a copy of an inbox's config, replacing the stored config only once
+// the check succeeds.
+func (a *app) inboxReauth(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return command.ErrUsage
+	}
+
+	inbox, err := a.findInbox(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if a.cli.Global.DryRun {
+		fmt.Fprintf(a.stdout(), "would re-authorize inbox %s\n", inbox.Addr)
+		return nil
+	}
+
+	values, err := a.st.ConfigAll(ctx, inbox.ID)
+	if err != nil {
+		return err
+	}
+	inboxConfig := store.NewPendingInboxConfig(values)
+	if err := a.setupInbox(ctx, inbox.Provider, inbox.Addr, inboxConfig); err != nil {
+		return err
+	}
+	if err := a.checkInbox(ctx, inbox.Provider, inboxConfig); err != nil {
+		return err
+	}
+
+	if err := a.st.ReplaceInboxConfig(ctx, inbox.ID, inboxConfig); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout(), "re-authorized inbox %s\n", inbox.Addr)
+	return nil
+}
+
+// unsubscriber creates the providers of every inbox, or only of --inbox.
+// Inboxes whose provider fails to start are skipped.
+func (a *app) unsubscriber(ctx context.Context) (*Unsubscriber, error) {
+	st, err := a.store()
+	if err != nil {
+		return nil, err
+	}
+
+	var inboxes []store.Inbox
+	if a.inbox != "" {
+		inbox, err := a.findInbox(ctx, a.inbox)
+		if err != nil {
+			return nil, err
+		}
+		inboxes = []store.Inbox{inbox}
+	} else if inboxes, err = st.ListInboxes(ctx); err != nil {
+		return nil, err
+	}
+	if len(inboxes) == 0 {
+		return nil, errors.New("no inboxes found, add one with 'inbox add'")
+	}
+
+	safeSenders, err := st.ListSafeSenders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocklist, err := st.ListBlocklist(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	unsubscriber := &Unsubscriber{
+		providers:   make([]inboxProvider, 0, len(inboxes)),
+		scanners:    make(map[int]scanner.Scanner, len(inboxes)),
+		safeSenders: safeSenders,
+		blocklist:   blocklist,
+		seen:        st,
+		rescan:      a.rescan,
+	}
+	for _, inbox := range inboxes {
+		if !a.cli.Global.DryRun {
+			if err := a.pruneSeen(ctx, inbox); err != nil {
+				warnf("inbox %s: %s", inbox.Addr, err)
+			}
+		}
+
+		p, err := newProvider(ctx, st, inbox)
+		if err != nil {
+			warnf("inbox %s: skipping: %s", inbox.Addr, err)
+			continue
+		}
+		s, err := newScanner(ctx, store.NewInboxConfig(inbox.ID, st), p)
+		if err != nil {
+			warnf("inbox %s: skipping: %s", inbox.Addr, err)
+			continue
+		}
+		unsubscriber.providers = append(unsubscriber.providers, inboxProvider{inbox, p})
+		unsubscriber.scanners[inbox.ID] = s
+	}
+	return unsubscriber, nil
+}
+
+// pruneSeen forgets the messages of inbox seen longer ago than its retention.
+func (a *app) pruneSeen(ctx context.Context, inbox store.Inbox) error {
+	retention, err := store.SeenRetention(ctx, store.NewInboxConfig(inbox.ID, a.st))
+	if err != nil || retention <= 0 {
+		return err
+	}
+
+	pruned, err := a.st.PruneSeen(ctx, inbox.ID, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	log.Printf("inbox %s: forgot %d messages seen more than %s ago", inbox.Addr, pruned, retention)
+	return nil
+}
+
+// runContext applies --timeout to ctx.
+func (a *app) runContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.timeout > 0 {
+		return context.WithTimeout(ctx, a.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (a *app) scan(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return command.ErrUsage
+	}
+
+	if !slices.Contains(outputFormats, a.output) {
+		return fmt.Errorf("unknown output format %q, expected one of %v", a.output, outputFormats)
+	}
+
+	ctx, cancel := a.runContext(ctx)
+	defer cancel()
+
+	unsubscriber, err := a.unsubscriber(ctx)
+	if err != nil {
+		return err
+	}
+
+	records := make([]scanRecord, 0)
+	for _, hit := range goAway(ctx, unsubscriber) {
+		decision, err := a.decision(ctx, hit)
+		if err != nil {
+			return err
+		}
+
+		action, reason := "unsubscribe", ""
+		switch {
+		case hit.safe != nil:
+			action, reason = "skip", fmt.Sprintf("safe sender rule %s", hit.safe)
+		case hit.blocked != nil:
+			reason = fmt.Sprintf("blocklist rule %s: %s", hit.blocked, hit.Result.Reason)
+		case decision == store.DecisionKeep:
+			action, reason = "skip", "kept in review"
+		default:
+			reason = hit.Result.Reason
+		}
+		records = append(records, newScanRecord(hit, action, reason))
+	}
+
+	if a.output != "table" {
+		return writeRecords(a.stdout(), a.output, records)
+	}
+
+	w := tabwriter.NewWriter(a.stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INBOX\tLIST\tMESSAGES\tLAST\tACTION\tREASON\tSUBJECT")
+	for _, r := range records {
+		last := "-"
+		if !r.Last.IsZero() {
+			last = r.Last.Local().Format(time.DateOnly)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", r.Inbox, cmp.Or(r.ListID, r.Sender), r.Messages, last, r.Action, r.Reason, r.Subject)
+	}
+	return w.Flush()
+}
+
+func (a *app) unsubscribe(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return command.ErrUsage
+	}
+
+	ctx, cancel := a.runContext(ctx)
+	defer cancel()
+
+	unsubscriber, err := a.unsubscriber(ctx)
+	if err != nil {
+		return err
+	}
+
+	return a.unsubscribeAll(ctx, unsubscriber)
+}
+
+// unsubscribeAll scans the inboxes of unsubscriber and unsubscribes from
+// every list found that is not a safe sender, already unsubscribed from or
+// kept in review. Without -apply it only prints what it would do.
+func (a *app) unsubscribeAll(ctx context.Context, unsubscriber *Unsubscriber) error {
+	dryRun := a.cli.Global.DryRun || !a.apply
+	unsubscriber.markSeen = !dryRun
+
+	// messages of failed attempts are not marked seen so that the next run tries again
+	failed := 0
+	for _, hit := range goAway(ctx, unsubscriber) {
+		if ctx.Err() != nil {
+			break
+		}
+		if hit.safe != nil {
+			continue
+		}
+
+		done, err := a.st.Unsubscribed(ctx, hit.Key, hit.inbox.Addr)
+		if err != nil {
+			return err
+		}
+		if done {
+			log.Printf("inbox %s: already unsubscribed from %s", hit.inbox.Addr, hit.Key)
+			unsubscriber.rememberAll(ctx, hit)
+			continue
+		}
+		decision, err := a.decision(ctx, hit)
+		if err != nil {
+			return err
+		}
+		if decision == store.DecisionKeep && hit.blocked == nil {
+			log.Printf("inbox %s: keeping %s as decided in review", hit.inbox.Addr, hit.Key)
+			unsubscriber.rememberAll(ctx, hit)
+			continue
+		}
+
+		if dryRun {
+			fmt.Fprintf(a.stdout(), "would unsubscribe %s from %s (%d messages) via %s %s\n", hit.inbox.Addr, hit.Key, hit.Count, hit.Result.Method, hit.Result.Target)
+			continue
+		}
+
+		// blocklisted senders are unsubscribed from without asking
+		if a.confirm && hit.blocked == nil {
+			ok, err := a.prompt().confirm(fmt.Sprintf("unsubscribe %s from %s (%d messages, %s)?", hit.inbox.Addr, hit.Key, hit.Count, hit.Result.Reason), false)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				unsubscriber.rememberAll(ctx, hit)
+				continue
+			}
+		}
+
+		ok, err := a.unsubscribeList(ctx, unsubscriber, hit)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed++
+		}
+	}
+
+	if dryRun && !a.cli.Global.DryRun {
+		fmt.Fprintln(a.stdout(), "nothing was changed, run with -apply to unsubscribe")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d unsubscribes failed", failed)
+	}
+	return ctx.Err()
+}
+
+// unsubscribeList unsubscribes the inbox of hit from its list and records the
+// attempt. It reports whether the attempt succeeded; errors are only returned
+// when the run was interrupted or the attempt could not be recorded.
+func (a *app) unsubscribeList(ctx context.Context, unsubscriber *Unsubscriber, hit hit) (bool, error) {
+	attempt := store.Unsubscribe{
+		MessageID: hit.Message.GetHeader("Message-ID"),
+		ListID:    hit.Key,
+		Recipient: hit.inbox.Addr,
+		Method:    hit.Result.Method,
+		Target:    hit.Result.Target,
+		Status:    store.StatusOK,
+	}
+	unsubscribeErr := hit.Result.Unsubscribe(ctx)
+	if unsubscribeErr != nil {
+		if ctx.Err() != nil {
+			// interrupted, not failed: leave the list to be tried again next run
+			return false, ctx.Err()
+		}
+		attempt.Status, attempt.Error = store.StatusFailed, unsubscribeErr.Error()
+	}
+	if err := a.st.RecordAttempt(ctx, attempt); err != nil {
+		return false, err
+	}
+
+	if unsubscribeErr != nil {
+		warnf("inbox %s: error unsubscribing from %s: %s", hit.inbox.Addr, hit.Key, unsubscribeErr)
+		return false, nil
+	}
+	unsubscriber.rememberAll(ctx, hit)
+	fmt.Fprintf(a.stdout(), "unsubscribed %s from %s\n", hit.inbox.Addr, hit.Key)
+	return true, nil
+}
+
+// decision returns the decision saved in review for the list of hit, if any.
+func (a *app) decision(ctx context.Context, hit hit) (string, error) {
+	if a.decisions == nil {
+		a.decisions = make(map[int]map[string]string)
+	}
+
+	decisions, ok := a.decisions[hit.inbox.ID]
+	if !ok {
+		var err error
+		if decisions, err = a.st.Decisions(ctx, hit.inbox.ID); err != nil {
+			return "", err
+		}
+		a.decisions[hit.inbox.ID] = decisions
+	}
+	return decisions[hit.Key], nil
+}
+
+// scannersList shows which scanners run for each inbox. Scanners are enabled
+// or disabled with 'config set <inbox> scanner::<name> true|false'.
+func (a *app) scannersList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return command.ErrUsage
+	}
+
+	st, err := a.store()
+	if err != nil {
+		return err
+	}
+	inboxes, err := st.ListInboxes(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(a.stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCANNER\tINBOX\tENABLED")
+	for _, name := range scanner.Names() {
+		for _, inbox := range inboxes {
+			enabled, err := store.NewInboxConfig(inbox.ID, st).GetBool(ctx, "scanner::"+name, scanner.EnabledByDefault(name))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\n", name, inbox.Addr, enabled)
+		}
+	}
+	return w.Flush()
+}
+
+func (a *app) history(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return command.ErrUsage
+	}
+
+	st, err := a.store()
+	if err != nil {
+		return err
+	}
+
+	unsubscribes, err := st.ListUnsubscribes(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(a.stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tINBOX\tLIST\tSTATUS\tMETHOD\tTARGET\tERROR")
+	for _, u := range unsubscribes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", u.Time.Local().Format(time.DateTime), u.Recipient, u.ListID, u.Status, u.Method, u.Target, u.Error)
+	}
+	return w.Flush()
+}
+
+// ruleTable is the store methods of one kind of sender rules, the safe
+// senders or the blocklist.
+type ruleTable struct {
+	add    func(*store.SQLStore, context.Context, rules.Rule) (bool, error)
+	remove func(*store.SQLStore, context.Context, rules.Rule) (bool, error)
+	list   func(*store.SQLStore, context.Context) (rules.Set, error)
+}
+
+var (
+	safeSenderRules = ruleTable{(*store.SQLStore).AddSafeSender, (*store.SQLStore).RemoveSafeSender, (*store.SQLStore).ListSafeSenders}
+	blocklistRules  = ruleTable{(*store.SQLStore).AddBlocklistRule, (*store.SQLStore).RemoveBlocklistRule, (*store.SQLStore).ListBlocklist}
+)
+
+func (a *app) rulesList(table ruleTable) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 0 {
+			return command.ErrUsage
+		}
+
+		st, err := a.store()
+		if err != nil {
+			return err
+		}
+
+		set, err := table.list(st, ctx)
+		if err != nil {
+			return err
+		}
+		inboxes, err := st.ListInboxes(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(a.stdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "INBOX\tKIND\tRULE")
+		for _, rule := range set {
+			scope := "*"
+			for _, inbox := range inboxes {
+				if inbox.ID == rule.InboxID {
+					scope = inbox.Addr
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", scope, rule.Kind, rule)
+		}
+		return w.Flush()
+	}
+}
+
+// ruleInbox returns the inbox ID --inbox refers to, or rules.GlobalInbox.
+func (a *app) ruleInbox(ctx context.Context) (int, error) {
+	if a.inbox == "" {
+		return rules.GlobalInbox, nil
+	}
+	inbox, err := a.findInbox(ctx, a.inbox)
+	return inbox.ID, err
+}
+
+// addRules parses and saves patterns, reporting each one.
+func (a *app) addRules(ctx context.Context, table ruleTable, patterns []string) error {
+	st, err := a.store()
+	if err != nil {
+		return err
+	}
+	inboxID, err := a.ruleInbox(ctx)
+	if err != nil {
+		return err
+	}
+
+	parsed := make([]rules.Rule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule, err := rules.Parse(pattern)
+		if err != nil {
+			return err
+		}
+		rule.InboxID = inboxID
+		parsed = append(parsed, rule)
+	}
+
+	for _, rule := range parsed {
+		if a.cli.Global.DryRun {
+			fmt.Fprintf(a.stdout(), "would add %s rule %s\n", rule.Kind, rule)
+			continue
+		}
+
+		added, err := table.add(st, ctx, rule)
+		if err != nil {
+			return err
+		}
+		if added {
+			fmt.Fprintf(a.stdout(), "added %s rule %s\n", rule.Kind, rule)
+		} else {
+			fmt.Fprintf(a.stdout(), "%s rule %s already exists\n", rule.Kind, rule)
+		}
+	}
+	return nil
+}
+
+func (a *app) rulesAdd(table ruleTable) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) == 0 {
+			return command.ErrUsage
+		}
+		return a.addRules(ctx, table, args)
+	}
+}
+
+// rulesImport adds every rule of a plain text file. Blank lines and lines
+// starting with # are ignored.
+func (a *app) rulesImport(table ruleTable) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return command.ErrUsage
+		}
+
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		patterns := make([]string, 0)
+		lines := bufio.NewScanner(r)
+		for lines.Scan() {
+			line := strings.TrimSpace(lines.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			patterns = append(patterns, line)
+		}
+		if err := lines.Err(); err != nil {
+			return fmt.Errorf("error reading %s: %w", args[0], err)
+		}
+
+		return a.addRules(ctx, table, patterns)
+	}
+}
+
+func (a *app) rulesRemove(table ruleTable) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return command.ErrUsage
+		}
+
+		st, err := a.store()
+		if err != nil {
+			return err
+		}
+		inboxID, err := a.ruleInbox(ctx)
+		if err != nil {
+			return err
+		}
+
+		rule, err := rules.Parse(args[0])
+		if err != nil {
+			return err
+		}
+		rule.InboxID = inboxID
+
+		if a.cli.Global.DryRun {
+			fmt.Fprintf(a.stdout(), "would remove %s rule %s\n", rule.Kind, rule)
+			return nil
+		}
+
+		removed, err := table.remove(st, ctx, rule)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("no %s rule %s", rule.Kind, rule)
+		}
+		fmt.Fprintf(a.stdout(), "removed %s rule %s\n", rule.Kind, rule)
+		return nil
+	}
+}
+
+func (a *app) configGet(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return command.ErrUsage
+	}
+
+	inbox, err := a.findInbox(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	inboxConfig := store.NewInboxConfig(inbox.ID, a.st)
+	isSet, err := inboxConfig.IsSet(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	if !isSet {
+		return fmt.Errorf("%s is not set for inbox %s", args[1], inbox.Addr)
+	}
+
+	value, err := inboxConfig.GetString(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(a.stdout(), value)
+	return nil
+}
+
+func (a *app) configSet(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return command.ErrUsage
+	}
+
+	inbox, err := a.findInbox(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if a.cli.Global.DryRun {
+		fmt.Fprintf(a.stdout(), "would set %s for inbox %s\n", args[1], inbox.Addr)
+		return nil
+	}
+	return store.NewInboxConfig(inbox.ID, a.st).Set(ctx, args[1], args[2])
+}
+
+func (a *app) configUnset(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return command.ErrUsage
+	}
+
+	inbox, err := a.findInbox(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if a.cli.Global.DryRun {
+		fmt.Fprintf(a.stdout(), "would unset %s for inbox %s\n", args[1], inbox.Addr)
+		return nil
+	}
+	return store.NewInboxConfig(inbox.ID, a.st).Unset(ctx, args[1])
+}
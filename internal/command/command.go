@@ -1,7 +1,139 @@
+// Package command implements a small subcommand dispatcher on top of the flag package.
 package command
 
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrUsage is returned by a command's Run when it was invoked with the wrong
+// arguments. The CLI prints the command's usage in response.
+var ErrUsage = errors.New("invalid usage")
+
+// DefaultDB is the database path used when --db is not given.
+const DefaultDB = "go-away.sqlite3"
+
 type CLI struct {
 	Global struct {
+		DB      string
 		Verbose bool
+		DryRun  bool
+	}
+
+	Name     string
+	Stdout   io.Writer
+	Stderr   io.Writer
+	Commands []*Command
+}
+
+// A Command is either a leaf with Run or a group of Subcommands.
+type Command struct {
+	Name        string
+	Args        string // synopsis of the positional arguments, e.g. "<inbox> <key>"
+	Summary     string
+	Flags       func(fs *flag.FlagSet)
+	Run         func(ctx context.Context, args []string) error
+	Subcommands []*Command
+}
+
+func New(name string, commands ...*Command) *CLI {
+	return &CLI{Name: name, Stdout: os.Stdout, Stderr: os.Stderr, Commands: commands}
+}
+
+// globalFlags registers the global flags on fs. They are accepted both before
+// and after the subcommand name.
+func (cli *CLI) globalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cli.Global.DB, "db", cli.Global.DB, "path to the SQLite database")
+	fs.BoolVar(&cli.Global.Verbose, "verbose", cli.Global.Verbose, "log provider activity to stderr")
+	fs.BoolVar(&cli.Global.DryRun, "dry-run", cli.Global.DryRun, "report what would change without changing anything")
+}
+
+// Run parses args (without the program name) and runs the selected command.
+func (cli *CLI) Run(ctx context.Context, args []string) error {
+	if cli.Global.DB == "" {
+		cli.Global.DB = DefaultDB
+	}
+
+	fs := cli.flagSet(cli.Name, "<command> [arguments]", cli.Commands)
+	cli.globalFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return cli.dispatch(ctx, cli.Name, cli.Commands, fs.Args())
+}
+
+func (cli *CLI) dispatch(ctx context.Context, path string, commands []*Command, args []string) error {
+	if len(args) == 0 {
+		cli.usage(path, "<command> [arguments]", commands, nil)
+		return ErrUsage
+	}
+
+	var cmd *Command
+	for _, c := range commands {
+		if c.Name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(cli.Stderr, "%s: unknown command %q\n", path, args[0])
+		cli.usage(path, "<command> [arguments]", commands, nil)
+		return ErrUsage
+	}
+	path += " " + cmd.Name
+
+	if len(cmd.Subcommands) > 0 {
+		return cli.dispatch(ctx, path, cmd.Subcommands, args[1:])
+	}
+
+	fs := cli.flagSet(path, cmd.Args, nil)
+	cli.globalFlags(fs)
+	if cmd.Flags != nil {
+		cmd.Flags(fs)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	err := cmd.Run(ctx, fs.Args())
+	if errors.Is(err, ErrUsage) {
+		fs.Usage()
+	}
+	return err
+}
+
+func (cli *CLI) flagSet(path, synopsis string, commands []*Command) *flag.FlagSet {
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	fs.SetOutput(cli.Stderr)
+	fs.Usage = func() { cli.usage(path, synopsis, commands, fs) }
+	return fs
+}
+
+func (cli *CLI) usage(path, synopsis string, commands []*Command, fs *flag.FlagSet) {
+	fmt.Fprintf(cli.Stderr, "usage: %s [flags] %s\n", path, synopsis)
+
+	if len(commands) > 0 {
+		fmt.Fprintf(cli.Stderr, "\ncommands:\n")
+		for _, cmd := range commands {
+			name := cmd.Name
+			if len(cmd.Subcommands) > 0 {
+				names := make([]string, 0, len(cmd.Subcommands))
+				for _, sub := range cmd.Subcommands {
+					names = append(names, sub.Name)
+				}
+				name += " " + strings.Join(names, "|")
+			}
+			fmt.Fprintf(cli.Stderr, "  %-30s %s\n", name, cmd.Summary)
+		}
+	}
+
+	if fs != nil {
+		fmt.Fprintf(cli.Stderr, "\nflags:\n")
+		fs.PrintDefaults()
 	}
 }
@@ -0,0 +1,93 @@
+package command_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/command"
+)
+
+func TestCLI_Run(t *testing.T) {
+	var (
+		ran   string
+		args  []string
+		limit int
+	)
+	record := func(name string) func(context.Context, []string) error {
+		return func(ctx context.Context, a []string) error {
+			ran, args = name, a
+			if name == "get" && len(a) != 1 {
+				return command.ErrUsage
+			}
+			return nil
+		}
+	}
+
+	newCLI := func() (*command.CLI, *bytes.Buffer) {
+		ran, args, limit = "", nil, 0
+		stderr := &bytes.Buffer{}
+		cli := command.New("go-away",
+			&command.Command{
+				Name:  "scan",
+				Flags: func(fs *flag.FlagSet) { fs.IntVar(&limit, "limit", 0, "") },
+				Run:   record("scan"),
+			},
+			&command.Command{
+				Name: "config",
+				Subcommands: []*command.Command{
+					{Name: "get", Args: "<key>", Run: record("get")},
+				},
+			},
+		)
+		cli.Stderr = stderr
+		return cli, stderr
+	}
+
+	testCases := []struct {
+		name         string
+		args         []string
+		ran          string
+		expectedArgs []string
+		db           string
+		dryRun       bool
+		limit        int
+		expected     error
+	}{
+		{name: "leaf", args: []string{"scan"}, ran: "scan", db: command.DefaultDB},
+		{name: "global flags first", args: []string{"--db", "x.db", "--dry-run", "scan"}, ran: "scan", db: "x.db", dryRun: true},
+		{name: "global flags after command", args: []string{"scan", "--dry-run", "-limit", "3"}, ran: "scan", db: command.DefaultDB, dryRun: true, limit: 3},
+		{name: "nested", args: []string{"config", "get", "smtp::host"}, ran: "get", expectedArgs: []string{"smtp::host"}, db: command.DefaultDB},
+		{name: "no command", args: []string{}, expected: command.ErrUsage, db: command.DefaultDB},
+		{name: "unknown command", args: []string{"frobnicate"}, expected: command.ErrUsage, db: command.DefaultDB},
+		{name: "missing subcommand", args: []string{"config"}, expected: command.ErrUsage, db: command.DefaultDB},
+		{name: "wrong arguments", args: []string{"config", "get"}, ran: "get", expected: command.ErrUsage, db: command.DefaultDB},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cli, stderr := newCLI()
+
+			err := cli.Run(context.Background(), tc.args)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected error %v, got: %v", tc.expected, err)
+			}
+			if ran != tc.ran {
+				t.Errorf("expected %q to run, got %q", tc.ran, ran)
+			}
+			if tc.expectedArgs != nil && !slices.Equal(args, tc.expectedArgs) {
+				t.Errorf("expected arguments %q, got %q", tc.expectedArgs, args)
+			}
+			if cli.Global.DB != tc.db || cli.Global.DryRun != tc.dryRun || limit != tc.limit {
+				t.Errorf("unexpected flags: db=%q dry-run=%v limit=%d", cli.Global.DB, cli.Global.DryRun, limit)
+			}
+			if tc.expected != nil && !strings.Contains(stderr.String(), "usage: go-away") {
+				t.Errorf("expected usage to be printed, got: %q", stderr)
+			}
+		})
+	}
+}
@@ -1,163 +1,836 @@
 package gmail
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/usrbinsam/go-away/internal/iter"
 	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
 	"github.com/usrbinsam/go-away/internal/store"
 )
 
+const (
+	apiURL = "https://gmail.googleapis.com/gmail/v1/users/me"
+
+	// maxPageSize is the largest maxResults accepted by users.messages.list.
+	maxPageSize = 500
+
+	// defaultConcurrency is the number of messages fetched in parallel. Each
+	// messages.get costs 5 of the 250 quota units a user may spend per second.
+	defaultConcurrency = 10
+
+	// maxRetries is the number of times a rate limited or failed request is retried.
+	maxRetries = 5
+)
+
+// metadataHeaders are the only headers requested for each message.
+var metadataHeaders = []string{"Date", "From", "List-Id", "List-Unsubscribe", "List-Unsubscribe-Post", "Message-ID", "Subject"}
+
+var reRelativeDate = regexp.MustCompile(`^[0-9]+[dmy]$`)
+
 type GmailProvider struct {
 	inboxConfig *store.InboxConfig
 	httpClient  *http.Client
 	oauthClient *oauthClient
-	refreshing  bool
+	apiURL      string
+	refreshMu   sync.Mutex
+	settings    settings
+}
+
+// settings are the per-inbox options read from the inbox config when the provider is created.
+type settings struct {
+	send             bool
+	query            url.Values
+	labelIDs         []string
+	includeSpamTrash bool
+	maxMessages      int
+	concurrency      int
+	timeout          time.Duration
+}
+
+// New creates a Gmail provider for an inbox that has already been authorized
+// with Setup. Missing or insufficient credentials are reported as
+// provider.ErrAuthExpired.
+func New(ctx context.Context, store store.Store, inboxConfig *store.InboxConfig) (*GmailProvider, error) {
+	gmail, err := newProvider(ctx, inboxConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := gmail.Init(ctx); err != nil {
+		return nil, err
+	}
+	return gmail, nil
 }
 
-func New(store store.Store, inboxConfig *store.InboxConfig) *GmailProvider {
+// Setup runs the OAuth consent flow for inboxConfig, replacing any stored
+// credentials, and returns the authorized provider.
+func Setup(ctx context.Context, inboxConfig *store.InboxConfig) (*GmailProvider, error) {
+	gmail, err := newProvider(ctx, inboxConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := gmail.Authorize(ctx); err != nil {
+		return nil, err
+	}
+	return gmail, nil
+}
+
+func newProvider(ctx context.Context, inboxConfig *store.InboxConfig) (*GmailProvider, error) {
 	var (
 		clientID     = os.Getenv("GO_AWAY_GMAIL_CLIENT_ID")
 		clientSecret = os.Getenv("GO_AWAY_GMAIL_CLIENT_SECRET")
 	)
 
 	if clientID == "" || clientSecret == "" {
-		log.Fatalf("missing gmail oauth client credentials. ensure 'GO_AWAY_GMAIL_CLIENT_ID' and 'GO_AWAY_GMAIL_CLIENT_SECRET' are set")
+		return nil, errors.New("missing gmail oauth client credentials. ensure 'GO_AWAY_GMAIL_CLIENT_ID' and 'GO_AWAY_GMAIL_CLIENT_SECRET' are set")
 	}
 
 	provider := &GmailProvider{
 		inboxConfig: inboxConfig,
-		httpClient:  &http.Client{},
-		oauthClient: &oauthClient{
-			clientID, clientSecret,
-		},
+		apiURL:      apiURL,
 	}
 
-	provider.Init()
-	return provider
+	if err := provider.loadSettings(ctx); err != nil {
+		return nil, err
+	}
+	provider.httpClient = &http.Client{Timeout: provider.settings.timeout}
+	provider.oauthClient = &oauthClient{
+		cilentID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   provider.httpClient,
+		tokenURL:     tokenURL,
+	}
+	return provider, nil
 }
 
-func (gmail *GmailProvider) Init() {
-	if gmail.inboxConfig.IsSet("credentials::accessToken") && gmail.inboxConfig.IsSet("credentials::refreshToken") {
-		log.Printf("gmail: using existing credentials")
-		return
+// Init checks that the inbox has credentials covering the scopes it needs.
+func (gmail *GmailProvider) Init(ctx context.Context) error {
+	hasAccessToken, err := gmail.inboxConfig.IsSet(ctx, "credentials::accessToken")
+	if err != nil {
+		return err
+	}
+	hasRefreshToken, err := gmail.inboxConfig.IsSet(ctx, "credentials::refreshToken")
+	if err != nil {
+		return err
+	}
+
+	if !hasAccessToken || !hasRefreshToken {
+		return fmt.Errorf("gmail: inbox has not been authorized: %w", provider.ErrAuthExpired)
 	}
 
-	tokens := gmail.oauthClient.getCredentials()
-	gmail.saveCredentials(tokens)
+	hasSendScope, err := gmail.hasScope(ctx, scopeSend)
+	if err != nil {
+		return err
+	}
+	if gmail.settings.send && !hasSendScope {
+		return fmt.Errorf("gmail: sending is enabled but the credentials lack the gmail.send scope: %w", provider.ErrAuthExpired)
+	}
+
+	log.Printf("gmail: using existing credentials")
+	return nil
+}
+
+// Authorize asks the user for consent in their browser and saves the granted credentials.
+func (gmail *GmailProvider) Authorize(ctx context.Context) error {
+	tokens, err := gmail.oauthClient.getCredentials(ctx, gmail.scopes())
+	if err != nil {
+		return err
+	}
+	return gmail.saveCredentials(ctx, tokens)
 }
 
-func (gmail *GmailProvider) saveCredentials(tokens *OAuthCredentials) {
-	log.Printf("saving gmail access token: %s", tokens.AccessToken)
-	gmail.inboxConfig.Set("credentials::accessToken", tokens.AccessToken)
+// loadSettings reads the provider options from the inbox config:
+//
+//	gmail::send             "true" to allow sending mail (requests the gmail.send scope)
+//	gmail::query            Gmail search query (q=), e.g. "category:promotions"
+//	gmail::newerThan        only messages newer than a relative date, e.g. "90d"
+//	gmail::olderThan        only messages older than a relative date, e.g. "1y"
+//	gmail::labelIds         comma-separated label IDs, e.g. "INBOX,CATEGORY_PROMOTIONS"
+//	gmail::includeSpamTrash "true" to include SPAM and TRASH
+//	gmail::maxMessages      cap on the number of messages listed per run, 0 for no cap
+//	gmail::concurrency      number of messages fetched in parallel
+//	timeout::request        per-request timeout, defaults to provider.DefaultRequestTimeout
+func (gmail *GmailProvider) loadSettings(ctx context.Context) error {
+	var err error
+	get := func(key string) string {
+		if err != nil {
+			return ""
+		}
+		var value string
+		value, err = gmail.inboxConfig.GetString(ctx, key)
+		return value
+	}
+
+	s := settings{
+		send:             get("gmail::send") == "true",
+		includeSpamTrash: get("gmail::includeSpamTrash") == "true",
+		query:            url.Values{},
+		concurrency:      defaultConcurrency,
+	}
+
+	terms := make([]string, 0)
+	if q := get("gmail::query"); q != "" {
+		terms = append(terms, q)
+	}
+	for _, window := range []struct{ key, operator string }{
+		{"gmail::newerThan", "newer_than"},
+		{"gmail::olderThan", "older_than"},
+	} {
+		value := get(window.key)
+		if value == "" {
+			continue
+		}
+		if !reRelativeDate.MatchString(value) {
+			return fmt.Errorf("gmail: invalid %s %q, expected a number followed by d, m or y (e.g. 90d)", window.key, value)
+		}
+		terms = append(terms, window.operator+":"+value)
+	}
+	if len(terms) > 0 {
+		s.query.Set("q", strings.Join(terms, " "))
+	}
+
+	for _, labelID := range strings.Split(get("gmail::labelIds"), ",") {
+		if labelID = strings.TrimSpace(labelID); labelID != "" {
+			s.labelIDs = append(s.labelIDs, labelID)
+			s.query.Add("labelIds", labelID)
+		}
+	}
+
+	if s.includeSpamTrash {
+		s.query.Set("includeSpamTrash", "true")
+	}
+
+	if value := get("gmail::maxMessages"); value != "" {
+		n, convErr := strconv.Atoi(value)
+		if convErr != nil || n < 0 {
+			return fmt.Errorf("gmail: invalid gmail::maxMessages %q", value)
+		}
+		s.maxMessages = n
+	}
+
+	if value := get("gmail::concurrency"); value != "" {
+		n, convErr := strconv.Atoi(value)
+		if convErr != nil || n < 1 {
+			return fmt.Errorf("gmail: invalid gmail::concurrency %q", value)
+		}
+		s.concurrency = n
+	}
+
+	if err != nil {
+		return err
+	}
+	if s.timeout, err = provider.RequestTimeout(ctx, gmail.inboxConfig); err != nil {
+		return err
+	}
+	gmail.settings = s
+	return nil
+}
+
+// scopes returns the OAuth scopes to request during consent.
+func (gmail *GmailProvider) scopes() []string {
+	scopes := []string{scopeReadonly}
+	if gmail.settings.send {
+		scopes = append(scopes, scopeSend)
+	}
+	return scopes
+}
+
+// hasScope reports whether the stored credentials were granted scope.
+func (gmail *GmailProvider) hasScope(ctx context.Context, scope string) (bool, error) {
+	granted, err := gmail.inboxConfig.GetString(ctx, "credentials::scope")
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(strings.Fields(granted), scope), nil
+}
+
+func (gmail *GmailProvider) saveCredentials(ctx context.Context, tokens *OAuthCredentials) error {
+	log.Printf("saving gmail access token")
+	if err := gmail.inboxConfig.Set(ctx, "credentials::accessToken", tokens.AccessToken); err != nil {
+		return err
+	}
 	if tokens.RefreshToken != "" {
-		gmail.inboxConfig.Set("credentials::refreshToken", tokens.RefreshToken)
-		log.Printf("saving gmail refresh token: %s", tokens.RefreshToken)
+		log.Printf("saving gmail refresh token")
+		if err := gmail.inboxConfig.Set(ctx, "credentials::refreshToken", tokens.RefreshToken); err != nil {
+			return err
+		}
+	}
+	if tokens.Scope != "" {
+		if err := gmail.inboxConfig.Set(ctx, "credentials::scope", tokens.Scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMail streams the messages to scan, one page at a time. The first run
+// lists every message matching the inbox's search filters; once the stream is
+// fully consumed without gmail::maxMessages cutting the listing short, the
+// mailbox historyId is saved to gmail::historyId so later runs only fetch
+// messages added since, falling back to a full sync when Gmail no longer has
+// that history. Clearing gmail::historyId forces a full sync.
+func (gmail *GmailProvider) GetMail(ctx context.Context) iter.Seq[message.Message] {
+	return func(yield func(*message.Message, error) bool) {
+		stopped := false
+		emit := func(ids []string) error {
+			messages, err := gmail.getMessages(ctx, ids)
+			for _, gMessage := range messages {
+				if !yield(gMessage.ToMessage(), nil) {
+					stopped = true
+					return errStopped
+				}
+			}
+			return err
+		}
+
+		if err := gmail.sync(ctx, emit); err != nil && !stopped {
+			yield(nil, err)
+		}
 	}
 }
 
-func (gmail *GmailProvider) GetMail() []*message.Message {
-	req, err := http.NewRequest("GET", "https://gmail.googleapis.com/gmail/v1/users/me/messages", nil)
+// errStopped is returned by emit when the consumer of GetMail stopped early.
+var errStopped = errors.New("gmail: stopped by consumer")
+
+func (gmail *GmailProvider) sync(ctx context.Context, emit func(ids []string) error) error {
+	historyID, err := gmail.inboxConfig.GetString(ctx, "gmail::historyId")
 	if err != nil {
-		log.Fatalf("gmail: error creating request: %s", err)
+		return err
 	}
-	req.URL.RawQuery = "maxResults=3"
+
+	if historyID != "" {
+		log.Printf("gmail: loading messages added since history id %s", historyID)
+		latest, err := gmail.listHistory(ctx, historyID, emit)
+		if err == nil {
+			return gmail.inboxConfig.Set(ctx, "gmail::historyId", latest)
+		}
+		if !errors.Is(err, provider.ErrNotFound) {
+			return err
+		}
+		log.Printf("gmail: history id expired, falling back to a full sync")
+	}
+
+	// read the history id before listing so nothing added meanwhile is missed next time
+	profile, err := gmail.getProfile(ctx)
+	if err != nil {
+		return err
+	}
+	complete, err := gmail.listAll(ctx, emit)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		// the history id would skip the messages left unlisted
+		log.Printf("gmail: not saving history id, the next run lists every message again")
+		return nil
+	}
+	return gmail.inboxConfig.Set(ctx, "gmail::historyId", profile.HistoryId)
+}
+
+// listAll passes every message ID matching the inbox's search filters to emit,
+// one page at a time, following nextPageToken until the mailbox is exhausted
+// or gmail::maxMessages is reached. It reports whether every page was listed.
+func (gmail *GmailProvider) listAll(ctx context.Context, emit func(ids []string) error) (complete bool, err error) {
+	limit := gmail.settings.maxMessages
+	listed := 0
 
 	log.Println("gmail: loading messages")
+	pageToken := ""
+	for {
+		pageSize := maxPageSize
+		if limit > 0 && limit-listed < pageSize {
+			pageSize = limit - listed
+		}
+
+		page, err := gmail.listMessages(ctx, pageToken, pageSize)
+		if err != nil {
+			return false, err
+		}
+
+		ids := make([]string, 0, len(page.Messages))
+		for _, listItem := range page.Messages {
+			ids = append(ids, listItem.Id)
+		}
+		truncated := limit > 0 && listed+len(ids) > limit
+		if truncated {
+			ids = ids[:limit-listed]
+		}
+		listed += len(ids)
+		log.Printf("gmail: listed %d of ~%d messages", listed, page.ResultSizeEstimate)
+
+		if err := emit(ids); err != nil {
+			return false, err
+		}
+
+		if page.NextPageToken == "" {
+			return !truncated, nil
+		}
+		if limit > 0 && listed >= limit {
+			return false, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// listHistory passes the IDs of messages added since startHistoryID to emit,
+// one page at a time, and returns the history id to resume from. An error
+// wrapping provider.ErrNotFound means the start history id is too old and a
+// full sync is required.
+// https://developers.google.com/workspace/gmail/api/reference/rest/v1/users.history/list
+//
+// history.list does not support search queries, so only gmail::labelIds and
+// gmail::includeSpamTrash are applied to incremental results.
+func (gmail *GmailProvider) listHistory(ctx context.Context, startHistoryID string, emit func(ids []string) error) (string, error) {
+	limit := gmail.settings.maxMessages
+	seen := make(map[string]bool)
+	listed := 0
+	historyID := startHistoryID
+
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("startHistoryId", startHistoryID)
+		query.Set("historyTypes", "messageAdded")
+		query.Set("maxResults", strconv.Itoa(maxPageSize))
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var page GmailHistoryListResponse
+		if err := gmail.getJSON(ctx, "/history", query, &page); err != nil {
+			return "", fmt.Errorf("gmail: error listing history: %w", err)
+		}
+
+		ids := make([]string, 0)
+		capped := false
+	records:
+		for _, history := range page.History {
+			for _, added := range history.MessagesAdded {
+				if limit > 0 && listed+len(ids) == limit {
+					// resume from the last record listed in full, so the
+					// rest of this one is not skipped next time
+					log.Printf("gmail: reached gmail::maxMessages, stopping at history id %s", historyID)
+					capped = true
+					break records
+				}
+
+				msg := added.Message
+				if seen[msg.Id] || !hasLabels(msg.LabelIds, gmail.settings.labelIDs, gmail.settings.includeSpamTrash) {
+					continue
+				}
+				seen[msg.Id] = true
+				ids = append(ids, msg.Id)
+			}
+			historyID = history.Id
+		}
+		listed += len(ids)
+
+		if err := emit(ids); err != nil {
+			return "", err
+		}
+
+		if capped {
+			break
+		}
+		if page.NextPageToken == "" {
+			historyID = page.HistoryId
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	log.Printf("gmail: %d messages added since history id %s", listed, startHistoryID)
+	return historyID, nil
+}
+
+// hasLabels reports whether a message with labels matches the configured label
+// filters the same way users.messages.list would.
+func hasLabels(labels, required []string, includeSpamTrash bool) bool {
+	if !includeSpamTrash && (slices.Contains(labels, "SPAM") || slices.Contains(labels, "TRASH")) {
+		return false
+	}
+	for _, label := range required {
+		if !slices.Contains(labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// getProfile returns the authenticated user's profile, including the current mailbox history id.
+func (gmail *GmailProvider) getProfile(ctx context.Context) (*GmailProfile, error) {
+	var profile GmailProfile
+	if err := gmail.getJSON(ctx, "/profile", nil, &profile); err != nil {
+		return nil, fmt.Errorf("gmail: error getting profile: %w", err)
+	}
+	return &profile, nil
+}
+
+// listMessages fetches a single page of users.messages.list.
+// https://developers.google.com/workspace/gmail/api/reference/rest/v1/users.messages/list
+func (gmail *GmailProvider) listMessages(ctx context.Context, pageToken string, pageSize int) (*GmailMessageListResponse, error) {
+	query := url.Values{}
+	for key, values := range gmail.settings.query {
+		query[key] = values
+	}
+	query.Set("maxResults", strconv.Itoa(pageSize))
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+
+	var page GmailMessageListResponse
+	if err := gmail.getJSON(ctx, "/messages", query, &page); err != nil {
+		return nil, fmt.Errorf("gmail: error listing messages: %w", err)
+	}
+	return &page, nil
+}
+
+// getMessages fetches the metadata of every message in ids with a bounded
+// number of concurrent requests, preserving the order of ids. Messages that
+// were deleted in the meantime are skipped. On any other failure the messages
+// fetched before the first failed one are returned along with the error.
+func (gmail *GmailProvider) getMessages(ctx context.Context, ids []string) ([]*GmailMessage, error) {
+	messages := make([]*GmailMessage, len(ids))
+	errs := make([]error, len(ids))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(gmail.settings.concurrency, len(ids)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				messages[i], errs[i] = gmail.getMessage(ctx, ids[i])
+			}
+		}()
+	}
+
+dispatch:
+	for i := range ids {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	fetched := make([]*GmailMessage, 0, len(ids))
+	for i, msg := range messages {
+		if errors.Is(errs[i], provider.ErrNotFound) {
+			log.Printf("gmail: skipping message id %q: %s", ids[i], errs[i])
+			continue
+		}
+		if errs[i] != nil {
+			return fetched, errs[i]
+		}
+		fetched = append(fetched, msg)
+	}
+	return fetched, nil
+}
+
+func (gmail *GmailProvider) getMessage(ctx context.Context, id string) (*GmailMessage, error) {
+	query := url.Values{"format": []string{"metadata"}}
+	for _, header := range metadataHeaders {
+		query.Add("metadataHeaders", header)
+	}
+
+	var parsedMessage GmailMessage
+	if err := gmail.getJSON(ctx, "/messages/"+url.PathEscape(id), query, &parsedMessage); err != nil {
+		return nil, fmt.Errorf("gmail: error retrieving message id %q: %w", id, err)
+	}
+	return &parsedMessage, nil
+}
+
+// FetchMessage returns the complete message with the given Gmail message ID,
+// for scanners that need more than the metadata GetMail fetches.
+func (gmail *GmailProvider) FetchMessage(ctx context.Context, id string) (*message.Message, error) {
+	var parsedMessage GmailMessage
+	if err := gmail.getJSON(ctx, "/messages/"+url.PathEscape(id), url.Values{"format": []string{"raw"}}, &parsedMessage); err != nil {
+		return nil, fmt.Errorf("gmail: error retrieving message id %q: %w", id, err)
+	}
+
+	// the raw message is base64url encoded, with or without padding
+	raw, err := base64.URLEncoding.DecodeString(parsedMessage.Raw)
+	if err != nil {
+		if raw, err = base64.RawURLEncoding.DecodeString(parsedMessage.Raw); err != nil {
+			return nil, fmt.Errorf("gmail: error decoding message id %q: %w", id, err)
+		}
+	}
+
+	msg, err := message.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("gmail: error parsing message id %q: %w", id, err)
+	}
+	msg.SetID(id)
+	return msg, nil
+}
+
+// getJSON performs a GET request against the Gmail API and decodes the response into v.
+func (gmail *GmailProvider) getJSON(ctx context.Context, path string, query url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", gmail.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = query.Encode()
+
 	res, err := gmail.do(req)
 	if err != nil {
-		log.Fatalf("gmail: error listing messages: %s\n", err)
+		return err
 	}
+	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("gmail: err reading response body while listing messages: %s", err)
+		return fmt.Errorf("error reading response body: %w", err)
 	}
 
 	if res.StatusCode != 200 {
-		log.Fatalf("gmail: non-200 status code listing messages: %q", body)
+		return statusError(res.StatusCode, body)
 	}
 
-	fmt.Printf("%s", string(body))
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error parsing response: %w", err)
+	}
+	return nil
+}
 
-	var parsedBody GmailMessageListResponse
-	err = json.Unmarshal(body, &parsedBody)
-	if err != nil {
-		log.Fatalf("gmail: error parsing message list: %s\n", err)
+// statusError describes a non-200 response from the Gmail API, wrapping the
+// matching provider error.
+// https://developers.google.com/workspace/gmail/api/guides/handle-errors
+func statusError(statusCode int, body []byte) error {
+	var sentinel error
+	switch {
+	case statusCode == 401:
+		sentinel = provider.ErrAuthExpired
+	case statusCode == 429,
+		statusCode == 403 && (bytes.Contains(body, []byte("rateLimitExceeded")) || bytes.Contains(body, []byte("userRateLimitExceeded"))):
+		sentinel = provider.ErrRateLimited
+	case statusCode == 404:
+		sentinel = provider.ErrNotFound
+	case statusCode >= 500:
+		sentinel = provider.ErrUnavailable
+	default:
+		return fmt.Errorf("HTTP %d: %s", statusCode, bytes.TrimSpace(body))
 	}
+	return fmt.Errorf("HTTP %d: %s: %w", statusCode, bytes.TrimSpace(body), sentinel)
+}
 
-	messages := make([]*message.Message, len(parsedBody.Messages))
+// Send delivers a plain text message with users.messages.send.
+// https://developers.google.com/workspace/gmail/api/reference/rest/v1/users.messages/send
+func (gmail *GmailProvider) Send(ctx context.Context, to, subject, body string) error {
+	if !gmail.settings.send {
+		return errors.New("gmail: sending is disabled for this inbox, set gmail::send to true and re-authorize")
+	}
+	hasSendScope, err := gmail.hasScope(ctx, scopeSend)
+	if err != nil {
+		return err
+	}
+	if !hasSendScope {
+		return fmt.Errorf("gmail: the credentials lack the gmail.send scope: %w", provider.ErrAuthExpired)
+	}
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("gmail: line break in recipient or subject")
+	}
 
-	for i, listItem := range parsedBody.Messages {
-		gMessage := gmail.getMessage(listItem.Id)
-		messages[i] = gMessage.ToMessage()
+	headers := []message.Header{
+		{Name: "To", Value: to},
+		{Name: "Subject", Value: subject},
+		{Name: "MIME-Version", Value: "1.0"},
+		{Name: "Content-Type", Value: "text/plain; charset=utf-8"},
+		{Name: "Content-Transfer-Encoding", Value: "8bit"},
 	}
+	raw := message.NewMessage(headers, body).RFC822()
 
-	return messages
-}
+	payload, err := json.Marshal(GmailSendRequest{
+		Raw: base64.URLEncoding.EncodeToString([]byte(*raw)),
+	})
+	if err != nil {
+		return err
+	}
 
-func (gmail *GmailProvider) getMessage(id string) *GmailMessage {
-	req, err := http.NewRequest("GET", "https://gmail.googleapis.com/gmail/v1/users/me/messages/"+id, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", gmail.apiURL+"/messages/send", bytes.NewReader(payload))
 	if err != nil {
-		log.Fatalf("gmail: unexpected err creating request: %s", err)
+		return fmt.Errorf("gmail: error creating request: %w", err)
 	}
-	req.URL.RawQuery = "format=metadata"
+	req.Header.Set("content-type", "application/json")
 
 	res, err := gmail.do(req)
 	if err != nil {
-		log.Fatalf("gmail: unexpected err retrieving message id %q: %s", id, err)
+		return fmt.Errorf("gmail: error sending message to %s: %w", to, err)
 	}
+	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
+	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("gmail: unexpected err reading message id body: %s", err)
+		return fmt.Errorf("gmail: error reading send response: %w", err)
 	}
 
 	if res.StatusCode != 200 {
-		log.Fatalf("gmail: HTTP %d retrieving message id %q: %s", res.StatusCode, id, string(body))
+		return fmt.Errorf("gmail: error sending message to %s: %w", to, statusError(res.StatusCode, resBody))
 	}
 
-	var parsedMessage GmailMessage
-	err = json.Unmarshal(body, &parsedMessage)
-	if err != nil {
-		log.Fatalf("gmail: err parsing message id %q: %s", id, err)
+	var sent GmailMessage
+	if err := json.Unmarshal(resBody, &sent); err != nil {
+		return fmt.Errorf("gmail: error parsing send response: %w", err)
 	}
-	fmt.Println(string(body))
-	return &parsedMessage
-}
+	log.Printf("gmail: sent message id %s to %s", sent.Id, to)
 
-func (gmail *GmailProvider) Send(to, subject, body string) error {
 	return nil
 }
 
+// do sends req with the inbox's access token. On a 401 the token is refreshed
+// once and the request retried. Rate limited requests, and idempotent ones
+// that failed, are retried with exponential backoff, honouring Retry-After,
+// until the request's context is done.
 func (gmail *GmailProvider) do(req *http.Request) (*http.Response, error) {
-	accessToken := "Bearer " + gmail.inboxConfig.GetString("credentials::accessToken")
-	log.Printf("access token: %s", accessToken)
-	req.Header.Add("authorization", accessToken)
+	for attempt := 0; ; attempt++ {
+		res, err := gmail.doAuthorized(req)
+		if err != nil || attempt == maxRetries || !retryable(req, res.StatusCode) {
+			return res, err
+		}
 
-	res, err := gmail.httpClient.Do(req)
+		wait := backoff(attempt, res.Header.Get("Retry-After"))
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		log.Printf("gmail: HTTP %d, retrying in %s", res.StatusCode, wait)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if err := rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (gmail *GmailProvider) doAuthorized(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	accessToken, err := gmail.inboxConfig.GetString(ctx, "credentials::accessToken")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("authorization", "Bearer "+accessToken)
+
+	res, err := gmail.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 401 {
+		return res, nil
+	}
+
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	log.Printf("gmail: 401, refreshing access token: %s", body)
+	if err := gmail.refresh(ctx, accessToken); err != nil {
+		return nil, err
+	}
+
+	if err := rewind(req); err != nil {
+		return nil, err
+	}
+	accessToken, err = gmail.inboxConfig.GetString(ctx, "credentials::accessToken")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("authorization", "Bearer "+accessToken)
+
+	res, err = gmail.send(req)
 	if err != nil {
 		return nil, err
 	}
 
 	if res.StatusCode == 401 {
 		body, _ := io.ReadAll(res.Body)
-		if gmail.refreshing {
-			panic(fmt.Sprintf("gmail: got another 401 after refreshing the access token, %s", body))
-		} else {
-			log.Printf("gmail: 401, refreshing access token: %s", body)
-		}
-
-		tokens := gmail.oauthClient.refreshGmailCreds(gmail.inboxConfig.GetString("credentials::refreshToken"))
-		gmail.saveCredentials(tokens)
-		gmail.refreshing = true
-		return gmail.do(req)
+		res.Body.Close()
+		return nil, fmt.Errorf("gmail: got another 401 after refreshing the access token, %s: %w", body, provider.ErrAuthExpired)
 	}
 
-	gmail.refreshing = false
+	return res, nil
+}
+
+// send performs a single round trip. Network failures are reported as
+// provider.ErrUnavailable unless the request's context was cancelled.
+func (gmail *GmailProvider) send(req *http.Request) (*http.Response, error) {
+	res, err := gmail.httpClient.Do(req)
+	if err != nil && req.Context().Err() == nil {
+		return nil, fmt.Errorf("%w: %w", provider.ErrUnavailable, err)
+	}
 	return res, err
 }
+
+// refresh exchanges the refresh token for a new access token unless another
+// request already replaced staleToken while waiting for the lock.
+func (gmail *GmailProvider) refresh(ctx context.Context, staleToken string) error {
+	gmail.refreshMu.Lock()
+	defer gmail.refreshMu.Unlock()
+
+	accessToken, err := gmail.inboxConfig.GetString(ctx, "credentials::accessToken")
+	if err != nil || accessToken != staleToken {
+		return err
+	}
+
+	refreshToken, err := gmail.inboxConfig.GetString(ctx, "credentials::refreshToken")
+	if err != nil {
+		return err
+	}
+
+	tokens, err := gmail.oauthClient.refreshGmailCreds(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	return gmail.saveCredentials(ctx, tokens)
+}
+
+// rewind resets the body of req so it can be sent again.
+func rewind(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// retryable reports whether a request that got statusCode may be sent again.
+// A 429 means the request was not processed, but after a 5xx a POST such as
+// users.messages.send may already have taken effect.
+func retryable(req *http.Request, statusCode int) bool {
+	if statusCode == 429 {
+		return true
+	}
+	return statusCode >= 500 && req.Method != "POST"
+}
+
+// backoff returns how long to wait before retry attempt n, preferring the
+// server's Retry-After when given in seconds.
+func backoff(n int, retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(1<<n) * time.Second
+}
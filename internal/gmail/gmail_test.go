@@ -0,0 +1,757 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// fakeGmail serves users.messages.get with a fixed latency to mimic the round
+// trip to gmail.googleapis.com.
+type fakeGmail struct {
+	latency time.Duration
+	queries chan string
+	sent    chan string    // decoded raw messages posted to users.messages.send
+	mailbox []string       // message IDs served by users.messages.list, two per page
+	history []GmailHistory // records served by users.history.list, two per page
+
+	mu         sync.Mutex
+	lists      []url.Values // queries of users.messages.list and users.history.list
+	sendStatus []int        // statuses to fail users.messages.send with, one per request
+	sends      int          // users.messages.send requests received
+}
+
+// lastHistoryID is the mailbox history id reported by users.history.list, and
+// history ids below firstHistoryID have expired.
+const (
+	lastHistoryID  = "2000"
+	firstHistoryID = 1000
+)
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.latency)
+
+	if r.Header.Get("authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/profile":
+		json.NewEncoder(w).Encode(GmailProfile{HistoryId: "1234"})
+		return
+	case "/messages":
+		f.recordList(r.URL.Query())
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		pageSize := 2
+		if n, err := strconv.Atoi(r.URL.Query().Get("maxResults")); err == nil {
+			pageSize = min(pageSize, n)
+		}
+		end := min(start+pageSize, len(f.mailbox))
+
+		page := GmailMessageListResponse{ResultSizeEstimate: len(f.mailbox)}
+		for _, id := range f.mailbox[start:end] {
+			page.Messages = append(page.Messages, GmailMessageListItem{Id: id})
+		}
+		if end < len(f.mailbox) {
+			page.NextPageToken = strconv.Itoa(end)
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	case "/history":
+		f.recordList(r.URL.Query())
+		startHistoryID, _ := strconv.Atoi(r.URL.Query().Get("startHistoryId"))
+		if startHistoryID < firstHistoryID {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		records := make([]GmailHistory, 0)
+		for _, history := range f.history {
+			if id, _ := strconv.Atoi(history.Id); id > startHistoryID {
+				records = append(records, history)
+			}
+		}
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		end := min(start+2, len(records))
+
+		page := GmailHistoryListResponse{History: records[start:end], HistoryId: lastHistoryID}
+		if end < len(records) {
+			page.NextPageToken = strconv.Itoa(end)
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	case "/messages/send":
+		if status := f.sendFailure(); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		var req GmailSendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Method != "POST" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		raw, err := base64.URLEncoding.DecodeString(req.Raw)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.sent <- string(raw)
+		json.NewEncoder(w).Encode(GmailMessage{Id: "sent0001"})
+		return
+	}
+
+	id, ok := strings.CutPrefix(r.URL.Path, "/messages/")
+	if !ok || strings.HasPrefix(id, "deleted") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "raw" {
+		raw := "From: news@example.com\r\nContent-Type: text/html\r\n\r\n<a href=\"https://example.com/optout\">Unsubscribe</a>\r\n"
+		json.NewEncoder(w).Encode(GmailMessage{Id: id, Raw: base64.URLEncoding.EncodeToString([]byte(raw))})
+		return
+	}
+
+	if f.queries != nil {
+		select {
+		case f.queries <- r.URL.RawQuery:
+		default:
+		}
+	}
+
+	json.NewEncoder(w).Encode(GmailMessage{
+		Id: id,
+		Payload: GmailMessagePart{
+			Headers: []GmailMessageHeader{
+				{Name: "From", Value: "news@example.com"},
+				{Name: "Message-ID", Value: "<" + id + "@example.com>"},
+				{Name: "List-Unsubscribe", Value: "<mailto:leave@example.com>"},
+			},
+		},
+	})
+}
+
+func (f *fakeGmail) recordList(query url.Values) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists = append(f.lists, query)
+}
+
+// sendFailure counts a users.messages.send request and returns the status to
+// fail it with, or 0 to send the message.
+func (f *fakeGmail) sendFailure() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sends++
+	if len(f.sendStatus) == 0 {
+		return 0
+	}
+	status := f.sendStatus[0]
+	f.sendStatus = f.sendStatus[1:]
+	return status
+}
+
+// takeLists returns and forgets the queries of the list requests received so far.
+func (f *fakeGmail) takeLists() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lists := f.lists
+	f.lists = nil
+	return lists
+}
+
+func newTestProvider(tb testing.TB, srv *httptest.Server, concurrency int) *GmailProvider {
+	tb.Helper()
+
+	st := &store.SQLStore{}
+	if err := st.Open(filepath.Join(tb.TempDir(), "go-away.sqlite3")); err != nil {
+		tb.Fatalf("failed to open store: %v", err)
+	}
+	inbox, err := st.AddInbox(context.Background(), "sam@example.com", "gmail", nil)
+	if err != nil {
+		tb.Fatalf("failed to add inbox: %v", err)
+	}
+
+	inboxConfig := store.NewInboxConfig(inbox.ID, st)
+	inboxConfig.Set(context.Background(), "credentials::accessToken", "test-token")
+	inboxConfig.Set(context.Background(), "gmail::concurrency", strconv.Itoa(concurrency))
+
+	gmail := &GmailProvider{
+		inboxConfig: inboxConfig,
+		httpClient:  srv.Client(),
+		apiURL:      srv.URL,
+	}
+	if err := gmail.loadSettings(context.Background()); err != nil {
+		tb.Fatalf("failed to load settings: %v", err)
+	}
+	return gmail
+}
+
+func messageIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("msg%04d", i)
+	}
+	return ids
+}
+
+func TestGmailProvider_Init(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		config   map[string]string
+		expected error
+	}{
+		{"not authorized", map[string]string{}, provider.ErrAuthExpired},
+		{"authorized", map[string]string{"credentials::accessToken": "a", "credentials::refreshToken": "r", "credentials::scope": scopeReadonly}, nil},
+		{
+			name:     "send scope missing",
+			config:   map[string]string{"gmail::send": "true", "credentials::accessToken": "a", "credentials::refreshToken": "r", "credentials::scope": scopeReadonly},
+			expected: provider.ErrAuthExpired,
+		},
+		{
+			name:   "send scope granted",
+			config: map[string]string{"gmail::send": "true", "credentials::accessToken": "a", "credentials::refreshToken": "r", "credentials::scope": scopeReadonly + " " + scopeSend},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gmail := &GmailProvider{inboxConfig: store.NewPendingInboxConfig(tc.config)}
+			if err := gmail.loadSettings(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err := gmail.Init(ctx); !errors.Is(err, tc.expected) {
+				t.Errorf("expected error %v, got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestGmailProvider_getMessages(t *testing.T) {
+	fake := &fakeGmail{queries: make(chan string, 1)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	gmail := newTestProvider(t, srv, 4)
+	ids := messageIDs(25)
+
+	messages, err := gmail.getMessages(context.Background(), ids)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != len(ids) {
+		t.Fatalf("expected %d messages, got %d", len(ids), len(messages))
+	}
+	for i, msg := range messages {
+		if msg.Id != ids[i] {
+			t.Errorf("expected message %d to be %s, got %s", i, ids[i], msg.Id)
+		}
+	}
+
+	expectedQuery := "format=metadata&metadataHeaders=Date&metadataHeaders=From&metadataHeaders=List-Id&metadataHeaders=List-Unsubscribe&metadataHeaders=List-Unsubscribe-Post&metadataHeaders=Message-ID&metadataHeaders=Subject"
+	if query := <-fake.queries; query != expectedQuery {
+		t.Errorf("expected query %q, got %q", expectedQuery, query)
+	}
+}
+
+func TestGmailProvider_FetchMessage(t *testing.T) {
+	srv := httptest.NewServer(&fakeGmail{})
+	defer srv.Close()
+
+	gmail := newTestProvider(t, srv, 1)
+	msg, err := gmail.FetchMessage(context.Background(), "msg0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.ID() != "msg0001" || msg.GetHeader("Content-Type") != "text/html" || !strings.Contains(msg.Body(), "https://example.com/optout") {
+		t.Errorf("expected the raw message, got ID %q, headers %v and body %q", msg.ID(), msg.Headers(), msg.Body())
+	}
+
+	if _, err := gmail.FetchMessage(context.Background(), "deleted0002"); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("expected %v, got: %v", provider.ErrNotFound, err)
+	}
+}
+
+func TestGmailProvider_Send(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeGmail{sent: make(chan string, 1)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	gmail := newTestProvider(t, srv, 1)
+	gmail.settings.send = true
+
+	if err := gmail.Send(ctx, "leave@example.com", "unsubscribe", "GO AWAY"); !errors.Is(err, provider.ErrAuthExpired) {
+		t.Errorf("expected %v without the send scope, got: %v", provider.ErrAuthExpired, err)
+	}
+
+	gmail.inboxConfig.Set(ctx, "credentials::scope", scopeReadonly+" "+scopeSend)
+
+	for _, tc := range []struct{ to, subject string }{
+		{"leave@example.com", "unsubscribe\r\nBcc: victim@example.com"},
+		{"leave@example.com\nBcc: victim@example.com", "unsubscribe"},
+	} {
+		if err := gmail.Send(ctx, tc.to, tc.subject, "GO AWAY"); err == nil {
+			t.Errorf("expected an error for to %q, subject %q", tc.to, tc.subject)
+		}
+	}
+	select {
+	case raw := <-fake.sent:
+		t.Fatalf("expected nothing to be sent, got:\n%s", raw)
+	default:
+	}
+
+	if err := gmail.Send(ctx, "leave@example.com", "unsubscribe", "GO AWAY"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "To: leave@example.com\r\n" +
+		"Subject: unsubscribe\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"GO AWAY"
+	if raw := <-fake.sent; raw != expected {
+		t.Errorf("unexpected raw message:\n%q\nexpected:\n%q", raw, expected)
+	}
+
+	t.Run("server errors are not retried", func(t *testing.T) {
+		// the message may have gone out before the server failed
+		fake.mu.Lock()
+		fake.sendStatus, fake.sends = []int{503}, 0
+		fake.mu.Unlock()
+
+		if err := gmail.Send(ctx, "leave@example.com", "unsubscribe", "GO AWAY"); !errors.Is(err, provider.ErrUnavailable) {
+			t.Errorf("expected %v, got: %v", provider.ErrUnavailable, err)
+		}
+		if fake.sends != 1 {
+			t.Errorf("expected a single request, got %d", fake.sends)
+		}
+	})
+
+	t.Run("rate limits are retried", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.sendStatus, fake.sends = []int{429}, 0
+		fake.mu.Unlock()
+
+		if err := gmail.Send(ctx, "leave@example.com", "unsubscribe", "GO AWAY"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if fake.sends != 2 {
+			t.Errorf("expected the request to be retried once, got %d requests", fake.sends)
+		}
+		<-fake.sent
+	})
+
+	gmail.settings.send = false
+	if err := gmail.Send(ctx, "leave@example.com", "unsubscribe", "GO AWAY"); err == nil {
+		t.Errorf("expected an error when sending is disabled")
+	}
+}
+
+func TestOAuthClient_postToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.PostForm.Get("refresh_token") {
+		case "stalled":
+			time.Sleep(200 * time.Millisecond)
+		case "revoked":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(tokenErrorResponse{Error: "invalid_grant", ErrorDescription: "Token has been expired or revoked."})
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "fresh-token", ExpiresIn: 3600, Scope: scopeReadonly})
+	}))
+	defer srv.Close()
+
+	client := &oauthClient{
+		cilentID:     "client-id",
+		clientSecret: "client-secret",
+		httpClient:   &http.Client{Timeout: 50 * time.Millisecond},
+		tokenURL:     srv.URL,
+	}
+
+	creds, err := client.refreshGmailCreds(context.Background(), "valid")
+	if err != nil || creds.AccessToken != "fresh-token" {
+		t.Errorf("expected a fresh access token, got %+v, %v", creds, err)
+	}
+
+	if _, err := client.refreshGmailCreds(context.Background(), "revoked"); !errors.Is(err, provider.ErrAuthExpired) {
+		t.Errorf("expected %v, got: %v", provider.ErrAuthExpired, err)
+	}
+
+	if _, err := client.refreshGmailCreds(context.Background(), "stalled"); !errors.Is(err, provider.ErrUnavailable) {
+		t.Errorf("expected the request timeout to fail with %v, got: %v", provider.ErrUnavailable, err)
+	}
+}
+
+func TestGmailMessage_ToMessage(t *testing.T) {
+	var gmailMessage GmailMessage
+	err := json.Unmarshal([]byte(`{
+		"id": "msg0001",
+		"payload": {
+			"mimeType": "multipart/mixed",
+			"headers": [{"name": "Subject", "value": "Parts"}, {"name": "Content-Type", "value": "multipart/mixed; boundary=x"}],
+			"body": {"size": 0},
+			"parts": [
+				{"partId": "0", "mimeType": "multipart/alternative", "body": {"size": 0}, "parts": [
+					{"partId": "0.0", "mimeType": "text/plain", "headers": [{"name": "Content-Type", "value": "text/plain; charset=UTF-8"}], "body": {"data": "Q2Fmw6k_IFllcyE"}},
+					{"partId": "0.1", "mimeType": "text/html", "body": {"data": "PGI-Q2Fmw6k8L2I-"}}
+				]},
+				{"partId": "1", "mimeType": "application/pdf", "filename": "menu.pdf", "body": {"attachmentId": "att1", "size": 1024}}
+			]
+		}
+	}`), &gmailMessage)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg := gmailMessage.ToMessage()
+	if msg.ID() != "msg0001" || msg.GetHeader("Subject") != "Parts" {
+		t.Errorf("expected the message's ID and headers, got %q and %v", msg.ID(), msg.Headers())
+	}
+	if text, html := msg.TextBody(), msg.HTMLBody(); text != "Café? Yes!" || html != "<b>Café</b>" {
+		t.Errorf("expected the bodies of the parts, got %q and %q", text, html)
+	}
+	if attachments := msg.Attachments(); len(attachments) != 1 || attachments[0].Filename != "menu.pdf" || attachments[0].ContentType != "application/pdf" {
+		t.Errorf("expected the menu.pdf attachment, got %+v", attachments)
+	}
+}
+
+func TestGmailProvider_GetMail(t *testing.T) {
+	fake := &fakeGmail{mailbox: messageIDs(5)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	t.Run("stop early", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+
+		read := 0
+		for msg, err := range gmail.GetMail(context.Background()) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id := msg.GetHeader("Message-ID"); id != "<msg0000@example.com>" {
+				t.Errorf("expected first message, got %s", id)
+			}
+			read++
+			break
+		}
+
+		if read != 1 {
+			t.Errorf("expected to read 1 message, got %d", read)
+		}
+		if saved, _ := gmail.inboxConfig.IsSet(context.Background(), "gmail::historyId"); saved {
+			t.Errorf("history id should not be saved when the stream is not fully consumed")
+		}
+	})
+
+	t.Run("all pages", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+
+		read := 0
+		for msg, err := range gmail.GetMail(context.Background()) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := fmt.Sprintf("<%s@example.com>", fake.mailbox[read])
+			if id := msg.GetHeader("Message-ID"); id != expected {
+				t.Errorf("expected message %s, got %s", expected, id)
+			}
+			if msg.ID() != fake.mailbox[read] {
+				t.Errorf("expected provider ID %s, got %s", fake.mailbox[read], msg.ID())
+			}
+			read++
+		}
+
+		if read != len(fake.mailbox) {
+			t.Errorf("expected to read %d messages, got %d", len(fake.mailbox), read)
+		}
+		if historyID, _ := gmail.inboxConfig.GetString(context.Background(), "gmail::historyId"); historyID != "1234" {
+			t.Errorf("expected history id 1234 to be saved, got %q", historyID)
+		}
+	})
+	t.Run("maxMessages", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		gmail.settings.maxMessages = 3
+
+		messages, err := iter.Collect(gmail.GetMail(context.Background()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(messages) != 3 {
+			t.Errorf("expected 3 messages, got %d", len(messages))
+		}
+		if saved, _ := gmail.inboxConfig.IsSet(context.Background(), "gmail::historyId"); saved {
+			t.Errorf("history id should not be saved when maxMessages cut the listing short")
+		}
+	})
+}
+
+func TestGmailProvider_GetMailQuery(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeGmail{mailbox: messageIDs(6)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	gmail := newTestProvider(t, srv, 2)
+	for key, value := range map[string]string{
+		"gmail::query":            "from:news@example.com",
+		"gmail::newerThan":        "90d",
+		"gmail::labelIds":         "INBOX, CATEGORY_PROMOTIONS",
+		"gmail::includeSpamTrash": "true",
+		"gmail::maxMessages":      "3",
+	} {
+		gmail.inboxConfig.Set(ctx, key, value)
+	}
+	if err := gmail.loadSettings(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages, err := iter.Collect(gmail.GetMail(ctx))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("expected 3 messages, got %d", len(messages))
+	}
+
+	lists := fake.takeLists()
+	if len(lists) != 2 {
+		t.Fatalf("expected paging to stop after 2 pages, got %d requests", len(lists))
+	}
+	for i, query := range lists {
+		if q := query.Get("q"); q != "from:news@example.com newer_than:90d" {
+			t.Errorf("page %d: expected q %q, got %q", i, "from:news@example.com newer_than:90d", q)
+		}
+		if labelIDs := query["labelIds"]; !slices.Equal(labelIDs, []string{"INBOX", "CATEGORY_PROMOTIONS"}) {
+			t.Errorf("page %d: expected labelIds INBOX and CATEGORY_PROMOTIONS, got %q", i, labelIDs)
+		}
+		if query.Get("includeSpamTrash") != "true" {
+			t.Errorf("page %d: expected includeSpamTrash=true, got %q", i, query.Encode())
+		}
+	}
+	if lists[0].Get("maxResults") != "3" || lists[0].Has("pageToken") {
+		t.Errorf("expected the first page to ask for 3 messages, got %q", lists[0].Encode())
+	}
+	if lists[1].Get("maxResults") != "1" || lists[1].Get("pageToken") != "2" {
+		t.Errorf("expected the second page to ask for the 1 remaining message, got %q", lists[1].Encode())
+	}
+}
+
+func historyRecord(id string, messages ...GmailHistoryMessage) GmailHistory {
+	history := GmailHistory{Id: id}
+	for _, msg := range messages {
+		history.MessagesAdded = append(history.MessagesAdded, GmailHistoryMessageAdded{Message: msg})
+	}
+	return history
+}
+
+func TestGmailProvider_GetMailHistory(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeGmail{
+		mailbox: messageIDs(3),
+		history: []GmailHistory{
+			historyRecord("1300", GmailHistoryMessage{Id: "msg0005", LabelIds: []string{"INBOX"}}),
+			historyRecord("1301", GmailHistoryMessage{Id: "msg0006", LabelIds: []string{"SPAM"}}),
+			historyRecord("1302", GmailHistoryMessage{Id: "msg0007", LabelIds: []string{"INBOX", "CATEGORY_PROMOTIONS"}}),
+			historyRecord("1303",
+				GmailHistoryMessage{Id: "msg0008", LabelIds: []string{"INBOX"}},
+				GmailHistoryMessage{Id: "msg0009", LabelIds: []string{"CATEGORY_PROMOTIONS"}},
+			),
+		},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	collect := func(t *testing.T, gmail *GmailProvider) []string {
+		t.Helper()
+		messages, err := iter.Collect(gmail.GetMail(ctx))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			ids = append(ids, msg.ID())
+		}
+		return ids
+	}
+	savedHistoryID := func(gmail *GmailProvider) string {
+		historyID, _ := gmail.inboxConfig.GetString(ctx, "gmail::historyId")
+		return historyID
+	}
+
+	t.Run("incremental", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		gmail.inboxConfig.Set(ctx, "gmail::historyId", "1234")
+		fake.takeLists()
+
+		if ids, expected := collect(t, gmail), []string{"msg0005", "msg0007", "msg0008", "msg0009"}; !slices.Equal(ids, expected) {
+			t.Errorf("expected %q, got %q", expected, ids)
+		}
+		if historyID := savedHistoryID(gmail); historyID != lastHistoryID {
+			t.Errorf("expected history id %s to be saved, got %q", lastHistoryID, historyID)
+		}
+
+		lists := fake.takeLists()
+		if len(lists) != 2 {
+			t.Fatalf("expected 2 pages of history, got %d requests", len(lists))
+		}
+		for _, query := range lists {
+			if query.Get("startHistoryId") != "1234" || query.Get("historyTypes") != "messageAdded" {
+				t.Errorf("unexpected history query %q", query.Encode())
+			}
+		}
+		if lists[1].Get("pageToken") != "2" {
+			t.Errorf("expected the second page to be requested, got %q", lists[1].Encode())
+		}
+	})
+
+	t.Run("label filter", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		gmail.inboxConfig.Set(ctx, "gmail::historyId", "1234")
+		gmail.inboxConfig.Set(ctx, "gmail::labelIds", "CATEGORY_PROMOTIONS")
+		if err := gmail.loadSettings(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if ids, expected := collect(t, gmail), []string{"msg0007", "msg0009"}; !slices.Equal(ids, expected) {
+			t.Errorf("expected %q, got %q", expected, ids)
+		}
+	})
+
+	t.Run("expired history falls back to a full sync", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		gmail.inboxConfig.Set(ctx, "gmail::historyId", "999")
+
+		if ids := collect(t, gmail); !slices.Equal(ids, fake.mailbox) {
+			t.Errorf("expected the whole mailbox %q, got %q", fake.mailbox, ids)
+		}
+		if historyID := savedHistoryID(gmail); historyID != "1234" {
+			t.Errorf("expected the profile's history id 1234 to be saved, got %q", historyID)
+		}
+	})
+
+	t.Run("stops exactly at maxMessages", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		gmail.inboxConfig.Set(ctx, "gmail::historyId", "1234")
+		gmail.settings.maxMessages = 3
+
+		if ids, expected := collect(t, gmail), []string{"msg0005", "msg0007", "msg0008"}; !slices.Equal(ids, expected) {
+			t.Errorf("expected %q, got %q", expected, ids)
+		}
+		// 1303 was listed in part, so the next run starts over from it
+		if historyID := savedHistoryID(gmail); historyID != "1302" {
+			t.Errorf("expected history id 1302 to be saved, got %q", historyID)
+		}
+
+		if ids, expected := collect(t, gmail), []string{"msg0008", "msg0009"}; !slices.Equal(ids, expected) {
+			t.Errorf("expected the next run to resume with %q, got %q", expected, ids)
+		}
+		if historyID := savedHistoryID(gmail); historyID != lastHistoryID {
+			t.Errorf("expected history id %s to be saved, got %q", lastHistoryID, historyID)
+		}
+	})
+}
+
+func TestGmailProvider_GetMailErrors(t *testing.T) {
+	fake := &fakeGmail{mailbox: []string{"msg0000", "deleted0001", "msg0002"}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	t.Run("deleted messages are skipped", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+
+		messages, err := iter.Collect(gmail.GetMail(context.Background()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(messages) != 2 {
+			t.Errorf("expected 2 messages, got %d", len(messages))
+		}
+	})
+
+	t.Run("errors are yielded", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		gmail.inboxConfig.Set(context.Background(), "credentials::accessToken", "revoked-token")
+
+		_, err := iter.Collect(gmail.GetMail(context.Background()))
+		if err == nil || !strings.Contains(err.Error(), "HTTP 403") {
+			t.Errorf("expected HTTP 403 error, got: %v", err)
+		}
+	})
+
+	t.Run("cancellation is not reported as unavailable", func(t *testing.T) {
+		gmail := newTestProvider(t, srv, 2)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := iter.Collect(gmail.GetMail(ctx))
+		if !errors.Is(err, context.Canceled) || errors.Is(err, provider.ErrUnavailable) {
+			t.Errorf("expected error wrapping %v only, got: %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("status errors wrap provider errors", func(t *testing.T) {
+		testCases := []struct {
+			statusCode int
+			body       string
+			expected   error
+		}{
+			{401, `{}`, provider.ErrAuthExpired},
+			{429, `{}`, provider.ErrRateLimited},
+			{403, `{"error":{"errors":[{"reason":"userRateLimitExceeded"}]}}`, provider.ErrRateLimited},
+			{404, `{}`, provider.ErrNotFound},
+			{503, `{}`, provider.ErrUnavailable},
+		}
+
+		for _, tc := range testCases {
+			if err := statusError(tc.statusCode, []byte(tc.body)); !errors.Is(err, tc.expected) {
+				t.Errorf("expected HTTP %d to wrap %v, got: %v", tc.statusCode, tc.expected, err)
+			}
+		}
+	})
+}
+
+// BenchmarkGmailProvider_getMessages compares serial fetching against the
+// bounded concurrent fetcher, with 5ms of simulated latency per request.
+func BenchmarkGmailProvider_getMessages(b *testing.B) {
+	fake := &fakeGmail{latency: 5 * time.Millisecond}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ids := messageIDs(100)
+
+	for _, concurrency := range []int{1, defaultConcurrency, 25} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			gmail := newTestProvider(b, srv, concurrency)
+
+			b.ResetTimer()
+			for range b.N {
+				gmail.getMessages(context.Background(), ids)
+			}
+			b.ReportMetric(float64(b.N*len(ids))/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -13,17 +13,36 @@ import (
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/usrbinsam/go-away/internal/provider"
 )
 
 type oauthClient struct {
 	cilentID     string
 	clientSecret string
+
+	// httpClient bounds each token request by the inbox's request timeout.
+	httpClient *http.Client
+	tokenURL   string
 }
 
+const (
+	tokenURL = "https://oauth2.googleapis.com/token"
+
+	scopeReadonly = "https://www.googleapis.com/auth/gmail.readonly"
+	scopeSend     = "https://www.googleapis.com/auth/gmail.send"
+)
+
 type tokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 type refreshTokenResponse struct {
@@ -35,21 +54,40 @@ type OAuthCredentials struct {
 	AccessToken  string
 	ExpiresAt    time.Time
 	RefreshToken string // RefreshToken is not set when the token is obtained from the refresh token endpoint
+	Scope        string // space-delimited list of scopes granted by the user
+}
+
+// grantResult is the outcome of the consent redirect: either a grant code or the error reported by Google.
+type grantResult struct {
+	code string
+	err  error
 }
 
-func serveOnce() (string, <-chan string, func()) {
+func serveOnce() (string, <-chan grantResult, func(), error) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		panic(err)
+		return "", nil, nil, fmt.Errorf("gmail: unable to listen for the oauth redirect: %w", err)
 	}
 
 	addr := l.Addr().String()
-	s := &http.Server{}
+	mux := http.NewServeMux()
+	s := &http.Server{Handler: mux}
 	s.SetKeepAlivesEnabled(false)
 
-	codeChan := make(chan string, 1)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		codeChan <- r.URL.Query().Get("code")
+	resultChan := make(chan grantResult, 1)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		result := grantResult{code: q.Get("code")}
+		if e := q.Get("error"); e != "" || result.code == "" {
+			result.err = fmt.Errorf("gmail: consent was not granted: %q: %w", e, provider.ErrAuthExpired)
+		}
+
+		// only the first redirect counts, later requests (e.g. favicon.ico) are ignored
+		select {
+		case resultChan <- result:
+		default:
+		}
+
 		w.Header().Set("Connection", "close")
 		io.WriteString(w, "You can close this page now")
 	})
@@ -64,16 +102,21 @@ func serveOnce() (string, <-chan string, func()) {
 		s.Shutdown(ctx)
 	}
 
-	return addr, codeChan, shutdown
+	return addr, resultChan, shutdown, nil
 }
 
-func (client *oauthClient) getCredentials() *OAuthCredentials {
+// getCredentials runs the consent flow in the user's browser, requesting scopes.
+// It gives up when ctx is done before the user has completed consent.
+func (client *oauthClient) getCredentials(ctx context.Context, scopes []string) (*OAuthCredentials, error) {
 	u, err := url.Parse("https://accounts.google.com/o/oauth2/v2/auth")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	addr, codeChan, shutdown := serveOnce()
+	addr, resultChan, shutdown, err := serveOnce()
+	if err != nil {
+		return nil, err
+	}
 
 	q := u.Query()
 	redirectURI := "http://" + addr
@@ -81,42 +124,35 @@ func (client *oauthClient) getCredentials() *OAuthCredentials {
 	q.Set("redirect_uri", redirectURI)
 	q.Set("response_type", "code")
 	q.Set("access_type", "offline")
-	q.Set("scope", "https://www.googleapis.com/auth/gmail.readonly")
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("prompt", "consent")
 
 	u.RawQuery = q.Encode()
 	fmt.Printf("open this URL in your browser: %s\n", u.String())
 
-	code := <-codeChan
-	fmt.Println("received grant code")
-
+	var result grantResult
+	select {
+	case result = <-resultChan:
+	case <-ctx.Done():
+		result.err = fmt.Errorf("gmail: waiting for consent: %w", ctx.Err())
+	}
 	shutdown()
+	if result.err != nil {
+		return nil, result.err
+	}
+	fmt.Println("received grant code")
 
 	params := url.Values{}
-	params.Set("code", code)
+	params.Set("code", result.code)
 	params.Set("client_id", client.cilentID)
 	params.Set("client_secret", client.clientSecret)
 	params.Set("redirect_uri", redirectURI)
 	params.Set("grant_type", "authorization_code")
 	fmt.Println("requesting access token ...")
 
-	res, err := http.Post("https://oauth2.googleapis.com/token", "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
-	if err != nil {
-		panic(err)
-	}
-
-	tokenRes := tokenResponse{}
-	b, err := io.ReadAll(res.Body)
-
-	if res.StatusCode != 200 {
-		panic(fmt.Sprintf("error getting oauth2 tokens: %s", b))
-	}
-
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(b, &tokenRes)
-	if err != nil {
-		panic(err)
+	var tokenRes tokenResponse
+	if err := client.postToken(ctx, params, &tokenRes); err != nil {
+		return nil, fmt.Errorf("gmail: error getting oauth2 tokens: %w", err)
 	}
 	fmt.Println("success!")
 
@@ -126,10 +162,11 @@ func (client *oauthClient) getCredentials() *OAuthCredentials {
 		AccessToken:  tokenRes.AccessToken,
 		ExpiresAt:    expiresAt,
 		RefreshToken: tokenRes.RefreshToken,
-	}
+		Scope:        tokenRes.Scope,
+	}, nil
 }
 
-func (client *oauthClient) refreshGmailCreds(refreshToken string) *OAuthCredentials {
+func (client *oauthClient) refreshGmailCreds(ctx context.Context, refreshToken string) (*OAuthCredentials, error) {
 	params := url.Values{
 		"client_id":     []string{client.cilentID},
 		"client_secret": []string{client.clientSecret},
@@ -137,30 +174,59 @@ func (client *oauthClient) refreshGmailCreds(refreshToken string) *OAuthCredenti
 		"grant_type":    []string{"refresh_token"},
 	}
 
-	res, err := http.Post("https://oauth2.googleapis.com/token", "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
+	var tr tokenResponse
+	if err := client.postToken(ctx, params, &tr); err != nil {
+		return nil, fmt.Errorf("gmail: unable to refresh token: %w", err)
+	}
+
+	log.Printf("gmail: access token refresh success")
+	return &OAuthCredentials{
+		AccessToken: tr.AccessToken,
+		ExpiresAt:   time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+		Scope:       tr.Scope,
+	}, nil
+}
+
+// postToken calls the token endpoint with params and decodes the response into v.
+// An invalid_grant error (revoked or expired refresh token, reused code) is reported as provider.ErrAuthExpired.
+func (client *oauthClient) postToken(ctx context.Context, params url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", client.tokenURL, strings.NewReader(params.Encode()))
 	if err != nil {
-		log.Fatalf("unable to create request: %s", err.Error())
+		return err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	if res.StatusCode != 200 {
-		body, _ := io.ReadAll(res.Body)
-		log.Fatalf("unable to refresh token: %d - %s", res.StatusCode, string(body))
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %w", provider.ErrUnavailable, err)
 	}
+	defer res.Body.Close()
 
 	b, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("unable to read response body: %s", err.Error())
+		return fmt.Errorf("unable to read response body: %w", err)
 	}
 
-	var tr tokenResponse
-	err = json.Unmarshal(b, &tr)
-	if err != nil {
-		log.Fatalf("unable to unmarshal response body: %s", err.Error())
+	if res.StatusCode != 200 {
+		var tokenErr tokenErrorResponse
+		json.Unmarshal(b, &tokenErr)
+
+		switch {
+		case tokenErr.Error == "invalid_grant":
+			return fmt.Errorf("%s: %w", tokenErr.ErrorDescription, provider.ErrAuthExpired)
+		case res.StatusCode == 429:
+			return fmt.Errorf("HTTP %d: %w", res.StatusCode, provider.ErrRateLimited)
+		case res.StatusCode >= 500:
+			return fmt.Errorf("HTTP %d: %w", res.StatusCode, provider.ErrUnavailable)
+		}
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, b)
 	}
 
-	log.Printf("gmail: access token refresh success")
-	return &OAuthCredentials{
-		AccessToken: tr.AccessToken,
-		ExpiresAt:   time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unable to unmarshal response body: %w", err)
 	}
+	return nil
 }
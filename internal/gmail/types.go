@@ -1,6 +1,7 @@
 package gmail
 
 import (
+	"encoding/base64"
 	"strings"
 
 	"github.com/usrbinsam/go-away/internal/message"
@@ -14,7 +15,7 @@ type GmailMessageHeader struct {
 type GmailMessagePartBody struct {
 	AttachmentId string `json:"attachmentId"`
 	Size         int    `json:"size"`
-	Data         []byte `json:"data"`
+	Data         string `json:"data"` // base64url encoded
 }
 
 type GmailMessagePart struct {
@@ -46,18 +47,42 @@ func (gmailMessage *GmailMessage) GetHeader(name string) string {
 	return ""
 }
 
-func (gmailMessage *GmailMessage) Body() string {
-	return string(gmailMessage.Payload.Body.Data)
+// ToMessage converts the message and the tree of parts of its payload. Gmail
+// has already removed the transfer encoding of the parts' bodies.
+func (gmailMessage *GmailMessage) ToMessage() *message.Message {
+	msg := message.NewMessageFromPart(gmailMessage.Payload.ToPart())
+	msg.SetID(gmailMessage.Id)
+	return msg
 }
 
-func (gmailMessage *GmailMessage) ToMessage() *message.Message {
+func (part *GmailMessagePart) ToPart() *message.Part {
 	// annoying conversion because slice invariance is impossible in Go
-	headers := make([]message.Header, len(gmailMessage.Payload.Headers))
-	for i, header := range gmailMessage.Payload.Headers {
+	headers := make([]message.Header, len(part.Headers))
+	for i, header := range part.Headers {
 		headers[i] = message.Header{Name: header.Name, Value: header.Value}
 	}
 
-	return message.NewMessage(headers, gmailMessage.Body())
+	// the data is base64url encoded, with or without padding; parts whose
+	// data is only available as an attachment have none
+	body, err := base64.URLEncoding.DecodeString(part.Body.Data)
+	if err != nil {
+		body, _ = base64.RawURLEncoding.DecodeString(part.Body.Data)
+	}
+
+	children := make([]*message.Part, len(part.Parts))
+	for i := range part.Parts {
+		children[i] = part.Parts[i].ToPart()
+	}
+
+	p := message.NewPart(headers, body, children...)
+	if part.MimeType != "" {
+		// Gmail sets mimeType for parts without a Content-Type header too
+		p.ContentType = strings.ToLower(part.MimeType)
+	}
+	if part.Filename != "" {
+		p.Filename = part.Filename
+	}
+	return p
 }
 
 type GmailMessageListItem struct {
@@ -70,3 +95,38 @@ type GmailMessageListResponse struct {
 	NextPageToken      string                 `json:"nextPageToken"`
 	ResultSizeEstimate int                    `json:"resultSizeEstimate"`
 }
+
+// GmailSendRequest is the request body of users.messages.send.
+type GmailSendRequest struct {
+	Raw string `json:"raw"`
+}
+
+// GmailProfile is documented at https://developers.google.com/workspace/gmail/api/reference/rest/v1/users/getProfile
+type GmailProfile struct {
+	EmailAddress  string `json:"emailAddress"`
+	MessagesTotal int    `json:"messagesTotal"`
+	ThreadsTotal  int    `json:"threadsTotal"`
+	HistoryId     string `json:"historyId"`
+}
+
+type GmailHistoryMessage struct {
+	Id       string   `json:"id"`
+	ThreadId string   `json:"threadId"`
+	LabelIds []string `json:"labelIds,omitempty"`
+}
+
+type GmailHistoryMessageAdded struct {
+	Message GmailHistoryMessage `json:"message"`
+}
+
+// GmailHistory is documented at https://developers.google.com/workspace/gmail/api/reference/rest/v1/users.history/list#History
+type GmailHistory struct {
+	Id            string                     `json:"id"`
+	MessagesAdded []GmailHistoryMessageAdded `json:"messagesAdded,omitempty"`
+}
+
+type GmailHistoryListResponse struct {
+	History       []GmailHistory `json:"history"`
+	NextPageToken string         `json:"nextPageToken"`
+	HistoryId     string         `json:"historyId"`
+}
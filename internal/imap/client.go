@@ -0,0 +1,511 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/provider"
+)
+
+// client is a minimal IMAP4rev1 client (RFC 3501). It only implements the
+// handful of commands needed to read message headers from a single folder.
+type client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	tag     int
+	timeout time.Duration
+	stop    func() bool
+}
+
+// response is a single line (plus any literals) received from the server.
+type response struct {
+	tag    string // "*" for untagged responses
+	num    uint32 // leading number of untagged responses such as "* 3 EXISTS"
+	kind   string // OK, NO, BAD, BYE, EXISTS, FETCH, SEARCH, ...
+	fields []any  // parsed data of FETCH responses
+	text   string // remaining text of the response
+}
+
+// fetched holds the items of a FETCH response that the provider cares about.
+type fetched struct {
+	seq    uint32
+	uid    uint32
+	header []byte
+}
+
+// statusError is a NO or BAD completion of a command.
+type statusError struct {
+	verb string
+	kind string
+	text string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("imap: %s failed: %s %s", e.verb, e.kind, e.text)
+}
+
+const (
+	securityTLS      = "tls"
+	securityStartTLS = "starttls"
+	securityNone     = "none"
+)
+
+// dial connects to addr and reads the greeting. Every command on the returned
+// client must complete within timeout, and the connection is closed as soon
+// as ctx is done.
+func dial(ctx context.Context, addr, security string, tlsConfig *tls.Config, timeout time.Duration) (*client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if security == securityTLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("imap: error connecting to %s: %w: %w", addr, provider.ErrUnavailable, err)
+	}
+
+	c := &client{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	c.stop = context.AfterFunc(ctx, func() { conn.Close() })
+	c.setDeadline()
+
+	greeting, err := c.readResponse()
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("imap: reading greeting: %w", err)
+	}
+	if greeting.kind != "OK" && greeting.kind != "PREAUTH" {
+		c.close()
+		return nil, fmt.Errorf("imap: server rejected connection: %s %s", greeting.kind, greeting.text)
+	}
+
+	if security == securityStartTLS {
+		if _, err := c.command("STARTTLS"); err != nil {
+			c.close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			c.close()
+			return nil, fmt.Errorf("imap: STARTTLS handshake: %w", err)
+		}
+		c.conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+	}
+
+	return c, nil
+}
+
+func (c *client) close() error {
+	c.stop()
+	return c.conn.Close()
+}
+
+// setDeadline gives the next command c.timeout to complete.
+func (c *client) setDeadline() {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+func (c *client) login(username, password string) error {
+	user, err := quote(username)
+	if err != nil {
+		return fmt.Errorf("imap: username: %w", err)
+	}
+	pass, err := quote(password)
+	if err != nil {
+		return fmt.Errorf("imap: password: %w", err)
+	}
+
+	_, err = c.command("LOGIN %s %s", user, pass)
+	var noErr *statusError
+	if errors.As(err, &noErr) && noErr.kind == "NO" {
+		return fmt.Errorf("%w: %w", err, provider.ErrAuthExpired)
+	}
+	return err
+}
+
+// examine opens folder read-only and returns its number of messages and UIDVALIDITY.
+func (c *client) examine(folder string) (exists, uidValidity uint32, err error) {
+	mailbox, err := quote(folder)
+	if err != nil {
+		return 0, 0, fmt.Errorf("imap: folder %q: %w", folder, err)
+	}
+
+	responses, err := c.command("EXAMINE %s", mailbox)
+	var noErr *statusError
+	if errors.As(err, &noErr) && noErr.kind == "NO" {
+		return 0, 0, fmt.Errorf("%w: %w", err, provider.ErrNotFound)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, res := range responses {
+		switch res.kind {
+		case "EXISTS":
+			exists = res.num
+		case "OK":
+			if code, ok := strings.CutPrefix(res.text, "[UIDVALIDITY "); ok {
+				code, _, _ = strings.Cut(code, "]")
+				if n, err := strconv.ParseUint(code, 10, 32); err == nil {
+					uidValidity = uint32(n)
+				}
+			}
+		}
+	}
+	return exists, uidValidity, nil
+}
+
+// fetchHeaders returns the UID and full header section of every message in
+// seqSet. BODY.PEEK is used so the \Seen flag is left untouched.
+func (c *client) fetchHeaders(seqSet string) ([]fetched, error) {
+	responses, err := c.command("FETCH %s (UID BODY.PEEK[HEADER])", seqSet)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]fetched, 0, len(responses))
+	for _, res := range responses {
+		if res.kind != "FETCH" {
+			continue
+		}
+
+		msg := fetched{seq: res.num}
+		for i := 0; i+1 < len(res.fields); i += 2 {
+			name, ok := res.fields[i].(string)
+			if !ok {
+				continue
+			}
+
+			switch strings.ToUpper(name) {
+			case "UID":
+				if v, ok := res.fields[i+1].(string); ok {
+					uid, err := strconv.ParseUint(v, 10, 32)
+					if err != nil {
+						return nil, fmt.Errorf("imap: invalid UID %q: %w", v, err)
+					}
+					msg.uid = uint32(uid)
+				}
+			case "BODY[HEADER]":
+				switch v := res.fields[i+1].(type) {
+				case []byte:
+					msg.header = v
+				case string:
+					msg.header = []byte(v)
+				}
+			}
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// fetchMessage returns the complete message with the given UID, leaving the
+// \Seen flag untouched.
+func (c *client) fetchMessage(uid uint32) ([]byte, error) {
+	responses, err := c.command("UID FETCH %d (UID BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range responses {
+		if res.kind != "FETCH" {
+			continue
+		}
+		for i := 0; i+1 < len(res.fields); i += 2 {
+			if name, ok := res.fields[i].(string); !ok || strings.ToUpper(name) != "BODY[]" {
+				continue
+			}
+			switch v := res.fields[i+1].(type) {
+			case []byte:
+				return v, nil
+			case string:
+				return []byte(v), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("imap: no message with UID %d: %w", uid, provider.ErrNotFound)
+}
+
+func (c *client) logout() error {
+	_, err := c.command("LOGOUT")
+	return err
+}
+
+// command sends a tagged command and collects untagged responses until the
+// matching tagged completion is received. A NO or BAD completion is returned
+// as an error.
+func (c *client) command(format string, args ...any) ([]*response, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%03d", c.tag)
+	line := fmt.Sprintf(format, args...)
+
+	c.setDeadline()
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, line); err != nil {
+		return nil, err
+	}
+
+	verb, _, _ := strings.Cut(line, " ")
+	responses := make([]*response, 0)
+	for {
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.tag == "*" {
+			if res.kind == "BYE" && verb != "LOGOUT" {
+				return nil, fmt.Errorf("imap: server closed connection: %s", res.text)
+			}
+			responses = append(responses, res)
+			continue
+		}
+
+		if res.tag != tag {
+			continue
+		}
+
+		if res.kind != "OK" {
+			return nil, &statusError{verb, res.kind, res.text}
+		}
+		return responses, nil
+	}
+}
+
+func (c *client) readResponse() (*response, error) {
+	tag, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	res := &response{tag: tag}
+
+	if tag == "+" {
+		res.text, err = c.readText()
+		return res, err
+	}
+
+	if err := c.expect(' '); err != nil {
+		return nil, err
+	}
+
+	kind, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+
+	if tag == "*" {
+		if n, err := strconv.ParseUint(kind, 10, 32); err == nil {
+			res.num = uint32(n)
+			if err := c.expect(' '); err != nil {
+				return nil, err
+			}
+			if kind, err = c.readAtom(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res.kind = strings.ToUpper(kind)
+
+	if res.kind == "FETCH" {
+		if err := c.expect(' '); err != nil {
+			return nil, err
+		}
+		field, err := c.readField()
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := field.([]any)
+		if !ok {
+			return nil, errors.New("imap: malformed FETCH response")
+		}
+		res.fields = fields
+	}
+
+	res.text, err = c.readText()
+	return res, err
+}
+
+// readText consumes the rest of the current line, including any literals
+// announced at the end of it.
+func (c *client) readText() (string, error) {
+	var sb strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		n, ok := literalSize(line)
+		if !ok {
+			sb.WriteString(line)
+			return strings.TrimSpace(sb.String()), nil
+		}
+
+		sb.WriteString(line)
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return "", err
+		}
+		sb.Write(literal)
+	}
+}
+
+func (c *client) readField() (any, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch b {
+	case '(':
+		fields := make([]any, 0)
+		for {
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == ')' {
+				return fields, nil
+			}
+			if b == ' ' {
+				continue
+			}
+			c.r.UnreadByte()
+
+			field, err := c.readField()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+		}
+	case '"':
+		var sb strings.Builder
+		for {
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == '"' {
+				return sb.String(), nil
+			}
+			if b == '\\' {
+				if b, err = c.r.ReadByte(); err != nil {
+					return nil, err
+				}
+			}
+			sb.WriteByte(b)
+		}
+	case '{':
+		size, err := c.r.ReadString('}')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(size, "}"))
+		if err != nil {
+			return nil, fmt.Errorf("imap: invalid literal size %q: %w", size, err)
+		}
+		if err := c.expect('\r'); err != nil {
+			return nil, err
+		}
+		if err := c.expect('\n'); err != nil {
+			return nil, err
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return nil, err
+		}
+		return literal, nil
+	default:
+		c.r.UnreadByte()
+		atom, err := c.readAtom()
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(atom, "NIL") {
+			return nil, nil
+		}
+		return atom, nil
+	}
+}
+
+// readAtom reads an atom, keeping any bracketed section such as
+// BODY[HEADER.FIELDS (FROM)] intact.
+func (c *client) readAtom() (string, error) {
+	var sb strings.Builder
+	depth := 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case b == '[':
+			depth++
+		case b == ']' && depth > 0:
+			depth--
+		case depth == 0 && (b == ' ' || b == '(' || b == ')' || b == '\r' || b == '\n'):
+			c.r.UnreadByte()
+			if sb.Len() == 0 {
+				return "", fmt.Errorf("imap: expected atom, got %q", b)
+			}
+			return sb.String(), nil
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func (c *client) expect(want byte) error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != want {
+		return fmt.Errorf("imap: expected %q, got %q", want, b)
+	}
+	return nil
+}
+
+// literalSize reports whether line ends with a literal announcement ({n}).
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	start := strings.LastIndexByte(line, '{')
+	if start < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(line[start+1 : len(line)-1])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// quote returns s as an IMAP quoted string. Quoted strings cannot hold CR, LF
+// or NUL; a line break would end the command and let s start another.
+func quote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return "", errors.New("line break or NUL in quoted string")
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`, nil
+}
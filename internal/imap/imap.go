@@ -0,0 +1,307 @@
+// Package imap implements a provider for generic IMAP mailboxes (Fastmail,
+// Dovecot, Exchange, ...).
+package imap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+var IMAPInboxKey = "imap"
+
+// fetchBatchSize is the number of messages requested per FETCH command.
+const fetchBatchSize = 100
+
+type IMAPProvider struct {
+	host      string
+	port      string
+	security  string
+	folder    string
+	username  string
+	password  string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	// fetch is the connection FetchMessage reuses across calls, with the
+	// folder it has selected and that folder's UIDVALIDITY.
+	mu            sync.Mutex
+	fetch         *client
+	fetchFolder   string
+	fetchValidity uint32
+}
+
+// New creates an IMAP provider from the inbox config:
+//
+//	imap::host            server host name (required)
+//	imap::port            defaults to 993 for "tls" and 143 otherwise
+//	imap::security        "tls" (implicit TLS, default), "starttls" or "none"
+//	imap::folder          folder to scan, defaults to INBOX
+//	credentials::username (required)
+//	credentials::password (required)
+//	timeout::request      per-command timeout, defaults to provider.DefaultRequestTimeout
+func New(ctx context.Context, store store.Store, inboxConfig *store.InboxConfig) (*IMAPProvider, error) {
+	settings := make(map[string]string)
+	for _, key := range []string{"imap::host", "imap::port", "imap::security", "imap::folder", "credentials::username", "credentials::password"} {
+		value, err := inboxConfig.GetString(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+
+	for _, key := range []string{"imap::host", "credentials::username", "credentials::password"} {
+		if settings[key] == "" {
+			return nil, fmt.Errorf("imap: missing inbox config %q", key)
+		}
+	}
+
+	imap := &IMAPProvider{
+		host:     settings["imap::host"],
+		port:     settings["imap::port"],
+		security: settings["imap::security"],
+		folder:   settings["imap::folder"],
+		username: settings["credentials::username"],
+		password: settings["credentials::password"],
+	}
+
+	if imap.security == "" {
+		imap.security = securityTLS
+	}
+	switch imap.security {
+	case securityTLS, securityStartTLS, securityNone:
+	default:
+		return nil, fmt.Errorf("imap: unknown security mode %q", imap.security)
+	}
+
+	if imap.port == "" {
+		imap.port = "993"
+		if imap.security != securityTLS {
+			imap.port = "143"
+		}
+	}
+
+	if imap.folder == "" {
+		imap.folder = "INBOX"
+	}
+
+	timeout, err := provider.RequestTimeout(ctx, inboxConfig)
+	if err != nil {
+		return nil, err
+	}
+	imap.timeout = timeout
+
+	imap.tlsConfig = &tls.Config{ServerName: imap.host}
+	return imap, nil
+}
+
+func (imap *IMAPProvider) addr() string {
+	return net.JoinHostPort(imap.host, imap.port)
+}
+
+// connect dials and logs in. The connection is closed as soon as ctx is done.
+func (imap *IMAPProvider) connect(ctx context.Context) (*client, error) {
+	c, err := dial(ctx, imap.addr(), imap.security, imap.tlsConfig, imap.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.login(imap.username, imap.password); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetMail streams the headers of every message in the configured folder,
+// fetching fetchBatchSize messages per round trip. The connection is torn
+// down as soon as ctx is done, and the one kept by FetchMessage when the
+// stream ends.
+func (imap *IMAPProvider) GetMail(ctx context.Context) iter.Seq[message.Message] {
+	return func(yield func(*message.Message, error) bool) {
+		defer imap.Close()
+
+		c, err := imap.connect(ctx)
+		if err != nil {
+			yield(nil, cancelled(ctx, err))
+			return
+		}
+		defer c.close()
+
+		log.Printf("imap: loading messages from %q", imap.folder)
+
+		exists, uidValidity, err := c.examine(imap.folder)
+		if err != nil {
+			yield(nil, cancelled(ctx, fmt.Errorf("imap: error selecting folder %q: %w", imap.folder, err)))
+			return
+		}
+
+		for first := uint32(1); first <= exists; first += fetchBatchSize {
+			last := min(first+fetchBatchSize-1, exists)
+
+			fetchedMessages, err := c.fetchHeaders(fmt.Sprintf("%d:%d", first, last))
+			if err != nil {
+				yield(nil, cancelled(ctx, fmt.Errorf("imap: error fetching headers from %q: %w", imap.folder, err)))
+				return
+			}
+
+			for _, f := range fetchedMessages {
+				headers, err := message.ReadHeaders(bytes.NewReader(f.header))
+				if err != nil {
+					log.Printf("imap: skipping message uid %d: %s", f.uid, err)
+					continue
+				}
+				msg := message.NewMessage(headers, "")
+				// UIDs are only unique for one UIDVALIDITY of a folder (RFC 3501 2.3.1.1)
+				msg.SetID(fmt.Sprintf("%s/%d/%d", imap.folder, uidValidity, f.uid))
+				if !yield(msg, nil) {
+					c.logout()
+					return
+				}
+			}
+		}
+
+		if err := c.logout(); err != nil {
+			log.Printf("imap: error logging out: %s", err)
+		}
+	}
+}
+
+// FetchMessage returns the complete message whose ID was set by GetMail, i.e.
+// "<folder>/<UIDVALIDITY>/<UID>". It keeps a connection of its own, separate
+// from GetMail's, and reuses it while consecutive calls read the same folder.
+func (imap *IMAPProvider) FetchMessage(ctx context.Context, id string) (*message.Message, error) {
+	folder, uidValidity, uid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	imap.mu.Lock()
+	defer imap.mu.Unlock()
+
+	c, currentValidity, err := imap.fetchClient(ctx, folder)
+	if err != nil {
+		return nil, cancelled(ctx, err)
+	}
+	if currentValidity != uidValidity {
+		return nil, fmt.Errorf("imap: UIDs of folder %q changed: %w", folder, provider.ErrNotFound)
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	raw, err := c.fetchMessage(uid)
+	if !stop() || (err != nil && !errors.Is(err, provider.ErrNotFound)) {
+		imap.dropFetchClient()
+	}
+	if err != nil {
+		return nil, cancelled(ctx, err)
+	}
+
+	msg, err := message.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("imap: error parsing message %s: %w", id, err)
+	}
+	msg.SetID(id)
+	return msg, nil
+}
+
+// fetchClient returns the connection kept for FetchMessage with folder
+// selected, connecting or selecting the folder first when needed. imap.mu must
+// be held.
+func (imap *IMAPProvider) fetchClient(ctx context.Context, folder string) (*client, uint32, error) {
+	if imap.fetch != nil && imap.fetchFolder == folder {
+		return imap.fetch, imap.fetchValidity, nil
+	}
+
+	if imap.fetch == nil {
+		// the connection outlives ctx, which only bounds the commands below
+		c, err := imap.connect(context.Background())
+		if err != nil {
+			return nil, 0, err
+		}
+		imap.fetch = c
+	}
+
+	stop := context.AfterFunc(ctx, func() { imap.fetch.conn.Close() })
+	_, uidValidity, err := imap.fetch.examine(folder)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		imap.dropFetchClient()
+		return nil, 0, fmt.Errorf("imap: error selecting folder %q: %w", folder, err)
+	}
+
+	imap.fetchFolder, imap.fetchValidity = folder, uidValidity
+	return imap.fetch, uidValidity, nil
+}
+
+// dropFetchClient closes the connection kept for FetchMessage, so the next
+// call connects again. imap.mu must be held.
+func (imap *IMAPProvider) dropFetchClient() {
+	if imap.fetch != nil {
+		imap.fetch.close()
+		imap.fetch, imap.fetchFolder = nil, ""
+	}
+}
+
+// Close logs out of the connection kept by FetchMessage, if any. GetMail
+// calls it when its stream ends.
+func (imap *IMAPProvider) Close() error {
+	imap.mu.Lock()
+	defer imap.mu.Unlock()
+
+	if imap.fetch == nil {
+		return nil
+	}
+	err := imap.fetch.logout()
+	imap.dropFetchClient()
+	return err
+}
+
+// parseID splits a message ID set by GetMail. Folder names may contain slashes.
+func parseID(id string) (folder string, uidValidity, uid uint32, err error) {
+	rest, uidPart, ok := cutLast(id, "/")
+	folder, validityPart, ok2 := cutLast(rest, "/")
+	if ok && ok2 {
+		v, err1 := strconv.ParseUint(validityPart, 10, 32)
+		u, err2 := strconv.ParseUint(uidPart, 10, 32)
+		if err1 == nil && err2 == nil {
+			return folder, uint32(v), uint32(u), nil
+		}
+	}
+	return "", 0, 0, fmt.Errorf("imap: invalid message ID %q", id)
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func (imap *IMAPProvider) Send(ctx context.Context, to, subject, body string) error {
+	return errors.New("imap: sending mail is not supported by IMAP")
+}
+
+// cancelled attributes err to ctx when it was caused by the connection being
+// closed on cancellation, so callers can match context.Canceled.
+func cancelled(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
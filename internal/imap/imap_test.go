@@ -0,0 +1,428 @@
+package imap_test
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/imap"
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// fakeServer is a tiny in-process IMAP server that understands just enough of
+// RFC 3501 to serve message headers to the provider.
+type fakeServer struct {
+	listener net.Listener
+	username string
+	password string
+	folders  map[string][]string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeServer(t *testing.T, folders map[string][]string) *fakeServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	srv := &fakeServer{
+		listener: l,
+		username: "sam@example.com",
+		password: `app "password"`,
+		folders:  folders,
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1] fake server ready\r\n")
+
+	var selected []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, line)
+		srv.mu.Unlock()
+
+		tag, rest, _ := strings.Cut(line, " ")
+		verb, args, _ := strings.Cut(rest, " ")
+
+		switch strings.ToUpper(verb) {
+		case "LOGIN":
+			want := fmt.Sprintf("%q %q", srv.username, srv.password)
+			if args != want {
+				fmt.Fprintf(conn, "%s NO [AUTHENTICATIONFAILED] invalid credentials\r\n", tag)
+				continue
+			}
+			fmt.Fprintf(conn, "%s OK LOGIN completed\r\n", tag)
+		case "EXAMINE":
+			if strings.Trim(args, `"`) == "Stalled" {
+				// never answer, leaving the client waiting
+				continue
+			}
+			folder, ok := srv.folders[strings.Trim(args, `"`)]
+			if !ok {
+				fmt.Fprintf(conn, "%s NO [NONEXISTENT] no such folder\r\n", tag)
+				continue
+			}
+			selected = folder
+			fmt.Fprintf(conn, "* %d EXISTS\r\n* 0 RECENT\r\n* OK [UIDVALIDITY 1] UIDs valid\r\n", len(selected))
+			fmt.Fprintf(conn, "%s OK [READ-ONLY] EXAMINE completed\r\n", tag)
+		case "FETCH":
+			for i, header := range selected {
+				fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[HEADER] {%d}\r\n%s)\r\n", i+1, 100+i, len(header), header)
+			}
+			fmt.Fprintf(conn, "%s OK FETCH completed\r\n", tag)
+		case "UID":
+			var uid int
+			if _, err := fmt.Sscanf(args, "FETCH %d (UID BODY.PEEK[])", &uid); err == nil && uid-100 >= 0 && uid-100 < len(selected) {
+				raw := selected[uid-100]
+				fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid-99, uid, len(raw), raw)
+			}
+			fmt.Fprintf(conn, "%s OK UID FETCH completed\r\n", tag)
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE logging out\r\n%s OK LOGOUT completed\r\n", tag)
+			return
+		default:
+			fmt.Fprintf(conn, "%s BAD unknown command\r\n", tag)
+		}
+	}
+}
+
+func (srv *fakeServer) sawCommand(prefix string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, cmd := range srv.commands {
+		_, rest, _ := strings.Cut(cmd, " ")
+		if strings.HasPrefix(rest, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *fakeServer) countCommand(prefix string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	n := 0
+	for _, cmd := range srv.commands {
+		_, rest, _ := strings.Cut(cmd, " ")
+		if strings.HasPrefix(rest, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func newInboxConfig(t *testing.T, srv *fakeServer, folder string) *store.InboxConfig {
+	t.Helper()
+
+	st := &store.SQLStore{}
+	if err := st.Open(filepath.Join(t.TempDir(), "go-away.sqlite3")); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	inbox, err := st.AddInbox(context.Background(), "sam@example.com", "imap", nil)
+	if err != nil {
+		t.Fatalf("failed to add inbox: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	inboxConfig := store.NewInboxConfig(inbox.ID, st)
+	inboxConfig.Set(context.Background(), "imap::host", host)
+	inboxConfig.Set(context.Background(), "imap::port", port)
+	inboxConfig.Set(context.Background(), "imap::security", "none")
+	inboxConfig.Set(context.Background(), "credentials::username", srv.username)
+	inboxConfig.Set(context.Background(), "credentials::password", srv.password)
+	if folder != "" {
+		inboxConfig.Set(context.Background(), "imap::folder", folder)
+	}
+
+	return inboxConfig
+}
+
+func TestIMAPProvider_GetMail(t *testing.T) {
+	srv := newFakeServer(t, map[string][]string{
+		"INBOX": {
+			"From: News <news@example.com>\r\nList-Unsubscribe:\r\n <mailto:unsubscribe@example.com>\r\nSubject: Weekly\r\n\r\n",
+			"From: friend@example.org\r\nSubject: hi\r\n\r\n",
+		},
+		"Newsletters": {
+			"From: digest@example.net\r\nList-Unsubscribe: <mailto:leave@example.net>\r\n\r\n",
+		},
+		"Empty": {},
+	})
+
+	testCases := []struct {
+		name           string
+		folder         string
+		expectedFrom   []string
+		expectedUnsubs []string
+	}{
+		{
+			name:           "default folder",
+			expectedFrom:   []string{"News <news@example.com>", "friend@example.org"},
+			expectedUnsubs: []string{"<mailto:unsubscribe@example.com>", ""},
+		},
+		{
+			name:           "selected folder",
+			folder:         "Newsletters",
+			expectedFrom:   []string{"digest@example.net"},
+			expectedUnsubs: []string{"<mailto:leave@example.net>"},
+		},
+		{
+			name:   "empty folder",
+			folder: "Empty",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, err := imap.New(context.Background(), nil, newInboxConfig(t, srv, tc.folder))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			messages, err := iter.Collect(provider.GetMail(context.Background()))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(messages) != len(tc.expectedFrom) {
+				t.Fatalf("expected %d messages, got %d", len(tc.expectedFrom), len(messages))
+			}
+
+			for i, msg := range messages {
+				if from := msg.GetHeader("From"); from != tc.expectedFrom[i] {
+					t.Errorf("expected From: %q, got: %q", tc.expectedFrom[i], from)
+				}
+				if unsub := msg.GetHeader("List-Unsubscribe"); unsub != tc.expectedUnsubs[i] {
+					t.Errorf("expected List-Unsubscribe: %q, got: %q", tc.expectedUnsubs[i], unsub)
+				}
+				folder := cmp.Or(tc.folder, "INBOX")
+				if id := msg.ID(); id != fmt.Sprintf("%s/1/%d", folder, 100+i) {
+					t.Errorf("expected ID to be folder/UIDVALIDITY/UID, got: %q", id)
+				}
+			}
+		})
+	}
+
+	if !srv.sawCommand(`EXAMINE "INBOX"`) {
+		t.Errorf("expected folder to be opened read-only with EXAMINE")
+	}
+	if !srv.sawCommand("FETCH 1:2 (UID BODY.PEEK[HEADER])") {
+		t.Errorf("expected headers to be fetched with BODY.PEEK[HEADER]")
+	}
+}
+
+func TestIMAPProvider_FetchMessage(t *testing.T) {
+	srv := newFakeServer(t, map[string][]string{
+		"Promotions/2024": {
+			"From: deals@shop.example\r\nContent-Type: text/plain\r\n\r\nTo unsubscribe visit https://shop.example/optout\r\n",
+			"From: deals@shop.example\r\nContent-Type: text/plain\r\n\r\nLast chance!\r\n",
+		},
+		"INBOX": {
+			"From: sam@example.com\r\n\r\nHi\r\n",
+		},
+	})
+
+	p, err := imap.New(context.Background(), nil, newInboxConfig(t, srv, "Promotions/2024"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fetcher := provider.Fetcher(p)
+	if fetcher == nil {
+		t.Fatalf("expected the IMAP provider to fetch bodies")
+	}
+
+	msg, err := fetcher.FetchMessage(context.Background(), "Promotions/2024/1/100")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.GetHeader("Content-Type") != "text/plain" || !strings.Contains(msg.Body(), "https://shop.example/optout") {
+		t.Errorf("expected the complete message, got headers %v and body %q", msg.Headers(), msg.Body())
+	}
+	if msg.ID() != "Promotions/2024/1/100" {
+		t.Errorf("expected the ID to be kept, got %q", msg.ID())
+	}
+
+	if _, err := fetcher.FetchMessage(context.Background(), "Promotions/2024/2/100"); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("expected %v after UIDVALIDITY changed, got: %v", provider.ErrNotFound, err)
+	}
+	if _, err := fetcher.FetchMessage(context.Background(), "garbage"); err == nil {
+		t.Errorf("expected an error for an invalid ID")
+	}
+	if _, err := fetcher.FetchMessage(context.Background(), "Promotions/2024/1/200"); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("expected %v for a missing UID, got: %v", provider.ErrNotFound, err)
+	}
+
+	if _, err := fetcher.FetchMessage(context.Background(), "Promotions/2024/1/101"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logins, examines := srv.countCommand("LOGIN"), srv.countCommand("EXAMINE"); logins != 1 || examines != 1 {
+		t.Errorf("expected one connection for the folder, got %d LOGIN and %d EXAMINE", logins, examines)
+	}
+
+	if _, err := fetcher.FetchMessage(context.Background(), "INBOX/1/100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logins, examines := srv.countCommand("LOGIN"), srv.countCommand("EXAMINE"); logins != 1 || examines != 2 {
+		t.Errorf("expected the connection to switch folders, got %d LOGIN and %d EXAMINE", logins, examines)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("unexpected error closing: %v", err)
+	}
+	if !srv.sawCommand("LOGOUT") {
+		t.Errorf("expected Close to log out")
+	}
+}
+
+func TestIMAPProvider_FetchMessageCancelled(t *testing.T) {
+	srv := newFakeServer(t, map[string][]string{
+		"INBOX": {"From: sam@example.com\r\n\r\nHi\r\n"},
+	})
+
+	p, err := imap.New(context.Background(), nil, newInboxConfig(t, srv, ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.FetchMessage(ctx, "INBOX/1/100"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got: %v", context.Canceled, err)
+	}
+
+	// a cancelled call must not leave a broken connection behind
+	if _, err := p.FetchMessage(context.Background(), "INBOX/1/100"); err != nil {
+		t.Errorf("unexpected error after cancellation: %v", err)
+	}
+	p.Close()
+}
+
+func TestIMAPProvider_GetMailErrors(t *testing.T) {
+	srv := newFakeServer(t, map[string][]string{"INBOX": {}})
+
+	testCases := []struct {
+		name     string
+		config   map[string]string
+		expected error
+	}{
+		{"wrong password", map[string]string{"credentials::password": "wrong"}, provider.ErrAuthExpired},
+		{"missing folder", map[string]string{"imap::folder": "Archive"}, provider.ErrNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inboxConfig := newInboxConfig(t, srv, "")
+			for key, value := range tc.config {
+				inboxConfig.Set(context.Background(), key, value)
+			}
+
+			p, err := imap.New(context.Background(), nil, inboxConfig)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = iter.Collect(p.GetMail(context.Background()))
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected error wrapping %v, got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestIMAPProvider_GetMailRejectsLineBreaks(t *testing.T) {
+	srv := newFakeServer(t, map[string][]string{"INBOX": {}})
+
+	for key, value := range map[string]string{
+		"credentials::username": "sam@example.com\r\nA1 DELETE INBOX",
+		"credentials::password": "hunter2\nA1 DELETE INBOX",
+		"imap::folder":          "INBOX\x00",
+	} {
+		inboxConfig := newInboxConfig(t, srv, "")
+		inboxConfig.Set(context.Background(), key, value)
+
+		p, err := imap.New(context.Background(), nil, inboxConfig)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := iter.Collect(p.GetMail(context.Background())); err == nil {
+			t.Errorf("%s: expected an error for %q", key, value)
+		}
+	}
+	if srv.sawCommand("DELETE") || srv.sawCommand("EXAMINE") {
+		t.Errorf("expected no injected command and no EXAMINE to reach the server")
+	}
+}
+
+func TestIMAPProvider_GetMailStalled(t *testing.T) {
+	srv := newFakeServer(t, map[string][]string{"INBOX": {}})
+
+	t.Run("request timeout", func(t *testing.T) {
+		inboxConfig := newInboxConfig(t, srv, "Stalled")
+		inboxConfig.Set(context.Background(), "timeout::request", "50ms")
+
+		p, err := imap.New(context.Background(), nil, inboxConfig)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var netErr net.Error
+		_, err = iter.Collect(p.GetMail(context.Background()))
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("expected a timeout error, got: %v", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		p, err := imap.New(context.Background(), nil, newInboxConfig(t, srv, "Stalled"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err = iter.Collect(p.GetMail(ctx))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error wrapping %v, got: %v", context.DeadlineExceeded, err)
+		}
+	})
+}
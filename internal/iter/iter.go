@@ -16,3 +16,40 @@ func (it *Iter[T]) Next() (*T, bool) {
 	it.index++
 	return &it.items[it.index-1], true
 }
+
+// Seq is a streaming iterator over values of T. Values are produced lazily, so
+// consumers can start work before everything is loaded and stop early by
+// breaking out of a range loop. A producer that fails yields a nil value with
+// the error and stops. Seq is compatible with the standard library's
+// iter.Seq2[*T, error].
+type Seq[T any] func(yield func(*T, error) bool)
+
+// FromSlice returns a Seq over items.
+func FromSlice[T any](items []T) Seq[T] {
+	return func(yield func(*T, error) bool) {
+		for i := range items {
+			if !yield(&items[i], nil) {
+				return
+			}
+		}
+	}
+}
+
+// Fail returns a Seq that yields only err.
+func Fail[T any](err error) Seq[T] {
+	return func(yield func(*T, error) bool) {
+		yield(nil, err)
+	}
+}
+
+// Collect drains seq, returning the values read before the first error.
+func Collect[T any](seq Seq[T]) ([]*T, error) {
+	items := make([]*T, 0)
+	for item, err := range seq {
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
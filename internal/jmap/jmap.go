@@ -0,0 +1,487 @@
+// Package jmap implements a provider for JMAP servers (Fastmail, Stalwart,
+// Cyrus, ...), see RFC 8620 and RFC 8621.
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+var JMAPInboxKey = "jmap"
+
+// maxPageSize is the number of emails requested per round trip, unless the
+// server's maxObjectsInGet is lower.
+const maxPageSize = 500
+
+// headerProperties are the only headers requested for each email.
+var headerProperties = []string{"Date", "From", "List-Id", "List-Unsubscribe", "List-Unsubscribe-Post", "Message-ID", "Subject"}
+
+type JMAPProvider struct {
+	sessionURL string
+	token      string
+	mailbox    string
+	identity   string
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	session *Session
+}
+
+// New creates a JMAP provider from the inbox config:
+//
+//	jmap::sessionURL   the session resource, e.g. https://api.fastmail.com/jmap/session (required)
+//	jmap::mailbox      role or name of the mailbox to scan, defaults to inbox
+//	jmap::identity     address of the identity to send from, defaults to the first one
+//	credentials::token bearer token, e.g. a Fastmail API token (required)
+//	timeout::request   per-request timeout, defaults to provider.DefaultRequestTimeout
+func New(ctx context.Context, store store.Store, inboxConfig *store.InboxConfig) (*JMAPProvider, error) {
+	settings := make(map[string]string)
+	for _, key := range []string{"jmap::sessionURL", "jmap::mailbox", "jmap::identity", "credentials::token"} {
+		value, err := inboxConfig.GetString(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+
+	for _, key := range []string{"jmap::sessionURL", "credentials::token"} {
+		if settings[key] == "" {
+			return nil, fmt.Errorf("jmap: missing inbox config %q", key)
+		}
+	}
+
+	timeout, err := provider.RequestTimeout(ctx, inboxConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	jmap := &JMAPProvider{
+		sessionURL: settings["jmap::sessionURL"],
+		token:      settings["credentials::token"],
+		mailbox:    settings["jmap::mailbox"],
+		identity:   settings["jmap::identity"],
+		httpClient: &http.Client{Timeout: timeout},
+	}
+	if jmap.mailbox == "" {
+		jmap.mailbox = "inbox"
+	}
+	return jmap, nil
+}
+
+// GetMail streams the headers of the emails in the configured mailbox, newest
+// first, with an Email/query and an Email/get per page in a single request.
+func (jmap *JMAPProvider) GetMail(ctx context.Context) iter.Seq[message.Message] {
+	return func(yield func(*message.Message, error) bool) {
+		session, err := jmap.getSession(ctx)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		accountID := session.PrimaryAccounts[capabilityMail]
+
+		mailboxID, err := jmap.mailboxID(ctx, accountID)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		log.Printf("jmap: loading messages from %q", jmap.mailbox)
+
+		properties := []string{"id"}
+		for _, name := range headerProperties {
+			properties = append(properties, "header:"+name+":asRaw")
+		}
+
+		pageSize := maxPageSize
+		var core CoreCapability
+		if json.Unmarshal(session.Capabilities[capabilityCore], &core) == nil && core.MaxObjectsInGet > 0 {
+			pageSize = min(pageSize, core.MaxObjectsInGet)
+		}
+
+		for position := 0; ; {
+			responses, err := jmap.call(ctx, []string{capabilityCore, capabilityMail},
+				Invocation{"Email/query", map[string]any{
+					"accountId": accountID,
+					"filter":    map[string]any{"inMailbox": mailboxID},
+					"sort":      []map[string]any{{"property": "receivedAt", "isAscending": false}},
+					"position":  position,
+					"limit":     pageSize,
+				}, "query"},
+				Invocation{"Email/get", map[string]any{
+					"accountId":  accountID,
+					"#ids":       ResultReference{"query", "Email/query", "/ids"},
+					"properties": properties,
+				}, "get"},
+			)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			var query EmailQueryResponse
+			var get EmailGetResponse
+			if err := result(responses, "query", &query); err != nil {
+				yield(nil, err)
+				return
+			}
+			if err := result(responses, "get", &get); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			// the list is not guaranteed to be in the order of the query
+			emails := make(map[string]map[string]*string, len(get.List))
+			for _, email := range get.List {
+				if id := email["id"]; id != nil {
+					emails[*id] = email
+				}
+			}
+
+			for _, id := range query.IDs {
+				email, ok := emails[id]
+				if !ok {
+					// destroyed between the query and the get
+					continue
+				}
+				if !yield(toMessage(id, email), nil) {
+					return
+				}
+			}
+
+			position += len(query.IDs)
+			if len(query.IDs) < pageSize || query.Total != nil && position >= *query.Total {
+				return
+			}
+		}
+	}
+}
+
+func toMessage(id string, email map[string]*string) *message.Message {
+	headers := make([]message.Header, 0, len(headerProperties))
+	for _, name := range headerProperties {
+		// raw values keep the whitespace after the colon and any folding
+		if value := email["header:"+name+":asRaw"]; value != nil {
+			headers = append(headers, message.Header{Name: name, Value: strings.TrimSpace(*value)})
+		}
+	}
+
+	msg := message.NewMessage(headers, "")
+	msg.SetID(id)
+	return msg
+}
+
+// FetchMessage returns the complete message with the given email ID,
+// downloading its blob.
+func (jmap *JMAPProvider) FetchMessage(ctx context.Context, id string) (*message.Message, error) {
+	session, err := jmap.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accountID := session.PrimaryAccounts[capabilityMail]
+
+	responses, err := jmap.call(ctx, []string{capabilityCore, capabilityMail},
+		Invocation{"Email/get", map[string]any{"accountId": accountID, "ids": []string{id}, "properties": []string{"blobId"}}, "get"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	var get EmailGetResponse
+	if err := result(responses, "get", &get); err != nil {
+		return nil, err
+	}
+	if len(get.List) == 0 || get.List[0]["blobId"] == nil {
+		return nil, fmt.Errorf("jmap: email %q: %w", id, provider.ErrNotFound)
+	}
+
+	downloadURL := strings.NewReplacer(
+		"{accountId}", url.PathEscape(accountID),
+		"{blobId}", url.PathEscape(*get.List[0]["blobId"]),
+		"{type}", url.QueryEscape("message/rfc822"),
+		"{name}", "message.eml",
+	).Replace(session.DownloadURL)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := jmap.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jmap: error downloading email %q: %w", id, err)
+	}
+
+	msg, err := message.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("jmap: error parsing email %q: %w", id, err)
+	}
+	msg.SetID(id)
+	return msg, nil
+}
+
+// Send creates the message as a draft and submits it with EmailSubmission/set,
+// destroying the draft once it is sent.
+func (jmap *JMAPProvider) Send(ctx context.Context, to, subject, body string) error {
+	session, err := jmap.getSession(ctx)
+	if err != nil {
+		return err
+	}
+	accountID, ok := session.PrimaryAccounts[capabilitySubmission]
+	if !ok {
+		return errors.New("jmap: the server does not offer sending for this token")
+	}
+	using := []string{capabilityCore, capabilityMail, capabilitySubmission}
+
+	responses, err := jmap.call(ctx, using,
+		Invocation{"Identity/get", map[string]any{"accountId": accountID}, "identities"},
+		Invocation{"Mailbox/query", map[string]any{"accountId": accountID, "filter": map[string]any{"role": "drafts"}}, "drafts"},
+	)
+	if err != nil {
+		return err
+	}
+	var identities IdentityGetResponse
+	var drafts MailboxQueryResponse
+	if err := result(responses, "identities", &identities); err != nil {
+		return err
+	}
+	if err := result(responses, "drafts", &drafts); err != nil {
+		return err
+	}
+
+	identity, err := jmap.pickIdentity(identities.List)
+	if err != nil {
+		return err
+	}
+	if len(drafts.IDs) == 0 {
+		return errors.New("jmap: no drafts mailbox to create the message in")
+	}
+
+	recipient := EmailAddress{Email: to}
+	if addr, err := mail.ParseAddress(to); err == nil {
+		recipient = EmailAddress{addr.Name, addr.Address}
+	}
+
+	responses, err = jmap.call(ctx, using,
+		Invocation{"Email/set", map[string]any{
+			"accountId": accountID,
+			"create": map[string]any{"draft": map[string]any{
+				"mailboxIds": map[string]bool{drafts.IDs[0]: true},
+				"keywords":   map[string]bool{"$draft": true, "$seen": true},
+				"from":       []EmailAddress{{identity.Name, identity.Email}},
+				"to":         []EmailAddress{recipient},
+				"subject":    subject,
+				"bodyValues": map[string]any{"body": map[string]string{"value": body}},
+				"textBody":   []map[string]string{{"partId": "body", "type": "text/plain"}},
+			}},
+		}, "email"},
+		Invocation{"EmailSubmission/set", map[string]any{
+			"accountId":             accountID,
+			"create":                map[string]any{"send": map[string]string{"emailId": "#draft", "identityId": identity.ID}},
+			"onSuccessDestroyEmail": []string{"#send"},
+		}, "submission"},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, callID := range []string{"email", "submission"} {
+		var set SetResponse
+		if err := result(responses, callID, &set); err != nil {
+			return err
+		}
+		for _, setErr := range set.NotCreated {
+			return fmt.Errorf("jmap: sending to %s failed: %s: %s", to, setErr.Type, setErr.Description)
+		}
+	}
+	return nil
+}
+
+// pickIdentity returns the identity configured with jmap::identity, or the first one.
+func (jmap *JMAPProvider) pickIdentity(identities []Identity) (Identity, error) {
+	for _, identity := range identities {
+		if jmap.identity == "" || strings.EqualFold(identity.Email, jmap.identity) {
+			return identity, nil
+		}
+	}
+	if jmap.identity != "" {
+		return Identity{}, fmt.Errorf("jmap: no identity with address %s", jmap.identity)
+	}
+	return Identity{}, errors.New("jmap: the account has no identity to send from")
+}
+
+// mailboxID returns the ID of the configured mailbox, matching roles before names.
+func (jmap *JMAPProvider) mailboxID(ctx context.Context, accountID string) (string, error) {
+	responses, err := jmap.call(ctx, []string{capabilityCore, capabilityMail},
+		Invocation{"Mailbox/get", map[string]any{"accountId": accountID, "ids": nil, "properties": []string{"id", "name", "role"}}, "mailboxes"},
+	)
+	if err != nil {
+		return "", err
+	}
+	var mailboxes MailboxGetResponse
+	if err := result(responses, "mailboxes", &mailboxes); err != nil {
+		return "", err
+	}
+
+	for _, match := range []func(Mailbox) bool{
+		func(m Mailbox) bool { return strings.EqualFold(m.Role, jmap.mailbox) },
+		func(m Mailbox) bool { return m.Name == jmap.mailbox },
+	} {
+		for _, mailbox := range mailboxes.List {
+			if match(mailbox) {
+				return mailbox.ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("jmap: mailbox %q: %w", jmap.mailbox, provider.ErrNotFound)
+}
+
+// getSession fetches the session resource once.
+func (jmap *JMAPProvider) getSession(ctx context.Context) (*Session, error) {
+	jmap.mu.Lock()
+	defer jmap.mu.Unlock()
+	if jmap.session != nil {
+		return jmap.session, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", jmap.sessionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := jmap.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jmap: error fetching session: %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(body, &session); err != nil {
+		return nil, fmt.Errorf("jmap: error decoding session: %w", err)
+	}
+	if session.APIURL == "" || session.PrimaryAccounts[capabilityMail] == "" {
+		return nil, errors.New("jmap: the server does not offer mail for this token")
+	}
+
+	// servers may give the URLs as paths on the session resource's host
+	base, err := url.Parse(jmap.sessionURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range []*string{&session.APIURL, &session.DownloadURL} {
+		if strings.HasPrefix(*u, "/") {
+			*u = base.Scheme + "://" + base.Host + *u
+		}
+	}
+
+	jmap.session = &session
+	return jmap.session, nil
+}
+
+// call sends method calls to the API in a single request and returns the responses.
+func (jmap *JMAPProvider) call(ctx context.Context, using []string, calls ...Invocation) ([]Invocation, error) {
+	session, err := jmap.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(Request{using, calls})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", session.APIURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	body, err := jmap.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jmap: %s failed: %w", calls[0].Name, err)
+	}
+
+	var res Response
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("jmap: error decoding %s response: %w", calls[0].Name, err)
+	}
+	return res.MethodResponses, nil
+}
+
+// do sends an authorized request and returns the body of a 2xx response.
+func (jmap *JMAPProvider) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+jmap.token)
+
+	res, err := jmap.httpClient.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("%w: %w", err, provider.ErrUnavailable)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, statusError(res.StatusCode, body)
+	}
+	return body, nil
+}
+
+func statusError(statusCode int, body []byte) error {
+	var sentinel error
+	switch {
+	case statusCode == 401:
+		sentinel = provider.ErrAuthExpired
+	case statusCode == 429:
+		sentinel = provider.ErrRateLimited
+	case statusCode == 404:
+		sentinel = provider.ErrNotFound
+	case statusCode >= 500:
+		sentinel = provider.ErrUnavailable
+	default:
+		return fmt.Errorf("HTTP %d: %s", statusCode, bytes.TrimSpace(body))
+	}
+	return fmt.Errorf("HTTP %d: %s: %w", statusCode, bytes.TrimSpace(body), sentinel)
+}
+
+// result decodes the arguments of the response to callID into v, turning
+// an "error" response into an error.
+func result(responses []Invocation, callID string, v any) error {
+	for _, res := range responses {
+		if res.CallID != callID {
+			continue
+		}
+		args, _ := res.Args.(json.RawMessage)
+
+		if res.Name == "error" {
+			var methodErr MethodError
+			json.Unmarshal(args, &methodErr)
+			err := fmt.Errorf("jmap: method error %s: %s", methodErr.Type, methodErr.Description)
+			switch methodErr.Type {
+			case "serverUnavailable", "serverFail":
+				return fmt.Errorf("%w: %w", err, provider.ErrUnavailable)
+			case "accountNotFound":
+				return fmt.Errorf("%w: %w", err, provider.ErrNotFound)
+			}
+			return err
+		}
+
+		if err := json.Unmarshal(args, v); err != nil {
+			return fmt.Errorf("jmap: error decoding %s response: %w", res.Name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("jmap: no response to method call %q", callID)
+}
@@ -0,0 +1,339 @@
+package jmap
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+const testToken = "fmu1-secret"
+
+type stubEmail struct {
+	mailbox string
+	raw     string
+}
+
+// stubServer is a tiny JMAP server that understands just enough of RFC 8620
+// and RFC 8621 to serve the provider: the session resource, blob downloads
+// and the methods the provider calls.
+type stubServer struct {
+	*httptest.Server
+	emails      []stubEmail // newest first
+	maxObjects  int
+	noDrafts    bool
+	methodError string
+
+	mu        sync.Mutex
+	requests  int
+	submitted []map[string]any
+}
+
+func newStubServer(t *testing.T, emails []stubEmail) *stubServer {
+	t.Helper()
+	srv := &stubServer{emails: emails, maxObjects: 2}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jmap/session", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"username":        "sam@example.com",
+			"apiUrl":          "/jmap/api/",
+			"downloadUrl":     srv.URL + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+			"capabilities":    map[string]any{capabilityCore: map[string]int{"maxObjectsInGet": srv.maxObjects}, capabilityMail: map[string]any{}, capabilitySubmission: map[string]any{}},
+			"primaryAccounts": map[string]string{capabilityMail: "u1", capabilitySubmission: "u1"},
+			"state":           "s1",
+		})
+	})
+	mux.HandleFunc("GET /jmap/download/u1/{blobId}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		if _, err := fmt.Sscanf(r.PathValue("blobId"), "blob%d", &i); err != nil || i >= len(srv.emails) || r.URL.Query().Get("accept") != "message/rfc822" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, srv.emails[i].raw)
+	})
+	mux.HandleFunc("POST /jmap/api/", srv.api)
+
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (srv *stubServer) api(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Using       []string            `json:"using"`
+		MethodCalls [][]json.RawMessage `json:"methodCalls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.requests++
+
+	results := make(map[string]map[string]any)
+	responses := make([]any, 0)
+	for _, call := range req.MethodCalls {
+		var (
+			name, callID string
+			args         map[string]any
+		)
+		json.Unmarshal(call[0], &name)
+		json.Unmarshal(call[1], &args)
+		json.Unmarshal(call[2], &callID)
+
+		if srv.methodError != "" || !slices.Contains(req.Using, capabilityMail) {
+			responses = append(responses, []any{"error", map[string]string{"type": cmp.Or(srv.methodError, "unknownMethod")}, callID})
+			continue
+		}
+
+		// resolve back-references such as "#ids"
+		for key, value := range args {
+			if ref, ok := strings.CutPrefix(key, "#"); ok {
+				reference := value.(map[string]any)
+				args[ref] = results[reference["resultOf"].(string)][strings.TrimPrefix(reference["path"].(string), "/")]
+			}
+		}
+
+		response := srv.method(name, args)
+		results[callID] = response
+		responses = append(responses, []any{name, response, callID})
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"methodResponses": responses, "sessionState": "s1"})
+}
+
+func (srv *stubServer) method(name string, args map[string]any) map[string]any {
+	switch name {
+	case "Mailbox/get":
+		return map[string]any{"list": []map[string]any{
+			{"id": "mb-inbox", "name": "Inbox", "role": "inbox"},
+			{"id": "mb-news", "name": "Newsletters", "role": nil},
+		}}
+	case "Mailbox/query":
+		if srv.noDrafts {
+			return map[string]any{"ids": []string{}}
+		}
+		return map[string]any{"ids": []string{"mb-drafts"}}
+	case "Email/query":
+		mailbox := args["filter"].(map[string]any)["inMailbox"]
+		ids := make([]any, 0)
+		for i, email := range srv.emails {
+			if email.mailbox == mailbox {
+				ids = append(ids, fmt.Sprintf("e%d", i))
+			}
+		}
+		position, limit := int(args["position"].(float64)), int(args["limit"].(float64))
+		if limit > srv.maxObjects {
+			panic("limit above maxObjectsInGet")
+		}
+		total := len(ids)
+		ids = ids[min(position, len(ids)):min(position+limit, len(ids))]
+		return map[string]any{"ids": ids, "position": position, "total": total}
+	case "Email/get":
+		list, notFound := make([]map[string]any, 0), make([]any, 0)
+		for _, id := range args["ids"].([]any) {
+			var i int
+			if _, err := fmt.Sscanf(id.(string), "e%d", &i); err != nil || i >= len(srv.emails) {
+				notFound = append(notFound, id)
+				continue
+			}
+			list = append(list, srv.properties(i, args["properties"].([]any)))
+		}
+		// servers may return the list in any order
+		slices.Reverse(list)
+		return map[string]any{"list": list, "notFound": notFound}
+	case "Identity/get":
+		return map[string]any{"list": []map[string]string{
+			{"id": "id1", "name": "Sam", "email": "sam@example.com"},
+			{"id": "id2", "name": "Sam Alias", "email": "alias@example.com"},
+		}}
+	case "Email/set":
+		draft := args["create"].(map[string]any)["draft"].(map[string]any)
+		srv.submitted = append(srv.submitted, draft)
+		return map[string]any{"created": map[string]any{"draft": map[string]string{"id": "draft1"}}}
+	case "EmailSubmission/set":
+		submission := args["create"].(map[string]any)["send"].(map[string]any)
+		if submission["emailId"] != "#draft" {
+			return map[string]any{"notCreated": map[string]any{"send": map[string]string{"type": "invalidProperties", "description": "unknown emailId"}}}
+		}
+		srv.submitted[len(srv.submitted)-1]["identityId"] = submission["identityId"]
+		return map[string]any{"created": map[string]any{"send": map[string]string{"id": "sub1"}}}
+	}
+	return nil
+}
+
+// properties returns the requested properties of email i, parsing just
+// enough of its headers.
+func (srv *stubServer) properties(i int, properties []any) map[string]any {
+	header, _, _ := strings.Cut(srv.emails[i].raw, "\r\n\r\n")
+	email := map[string]any{"id": fmt.Sprintf("e%d", i)}
+	for _, property := range properties {
+		switch name := property.(string); name {
+		case "id":
+		case "blobId":
+			email[name] = fmt.Sprintf("blob%d", i)
+		default:
+			headerName := strings.TrimSuffix(strings.TrimPrefix(name, "header:"), ":asRaw")
+			email[name] = nil
+			for _, line := range strings.Split(header, "\r\n") {
+				if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(key, headerName) {
+					email[name] = value
+				}
+			}
+		}
+	}
+	return email
+}
+
+func newTestProvider(t *testing.T, srv *stubServer, settings map[string]string) *JMAPProvider {
+	t.Helper()
+	inboxConfig := store.NewPendingInboxConfig(nil)
+	inboxConfig.Set(context.Background(), "jmap::sessionURL", srv.URL+"/jmap/session")
+	inboxConfig.Set(context.Background(), "credentials::token", testToken)
+	for key, value := range settings {
+		inboxConfig.Set(context.Background(), key, value)
+	}
+
+	p, err := New(context.Background(), nil, inboxConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return p
+}
+
+var testEmails = []stubEmail{
+	{"mb-inbox", "From: News <news@example.com>\r\nList-Unsubscribe: <https://example.com/u>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\nSubject: Issue 3\r\n\r\nhi\r\n"},
+	{"mb-news", "From: digest@example.net\r\nList-Id: <digest.example.net>\r\n\r\ndigest\r\n"},
+	{"mb-inbox", "From: friend@example.org\r\nSubject: lunch\r\n\r\nFriday?\r\n"},
+	{"mb-inbox", "From: shop@example.com\r\nContent-Type: text/html\r\n\r\n<a href=\"https://shop.example.com/optout\">Unsubscribe</a>\r\n"},
+}
+
+func TestJMAPProvider_GetMail(t *testing.T) {
+	srv := newStubServer(t, testEmails)
+
+	testCases := []struct {
+		name     string
+		mailbox  string
+		expected []string
+	}{
+		{"inbox role by default", "", []string{"e0", "e2", "e3"}},
+		{"mailbox name", "Newsletters", []string{"e1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, srv, map[string]string{"jmap::mailbox": tc.mailbox})
+			messages, err := iter.Collect(p.GetMail(context.Background()))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ids := make([]string, len(messages))
+			for i, msg := range messages {
+				ids[i] = msg.ID()
+			}
+			if !slices.Equal(ids, tc.expected) {
+				t.Errorf("expected IDs %q in query order, got %q", tc.expected, ids)
+			}
+		})
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		p := newTestProvider(t, srv, nil)
+		messages, _ := iter.Collect(p.GetMail(context.Background()))
+		msg := messages[0]
+		if msg.GetHeader("From") != "News <news@example.com>" || msg.RawHeader("List-Unsubscribe") != "<https://example.com/u>" || msg.GetHeader("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+			t.Errorf("expected the requested headers, got %v", msg.Headers())
+		}
+		if msg.GetHeader("List-Id") != "" || msg.Body() != "" {
+			t.Errorf("expected no List-Id and no body, got %v and %q", msg.Headers(), msg.Body())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := iter.Collect(newTestProvider(t, srv, map[string]string{"credentials::token": "wrong"}).GetMail(context.Background()))
+		if !errors.Is(err, provider.ErrAuthExpired) {
+			t.Errorf("expected %v, got %v", provider.ErrAuthExpired, err)
+		}
+
+		_, err = iter.Collect(newTestProvider(t, srv, map[string]string{"jmap::mailbox": "Missing"}).GetMail(context.Background()))
+		if !errors.Is(err, provider.ErrNotFound) {
+			t.Errorf("expected %v, got %v", provider.ErrNotFound, err)
+		}
+
+		srv.methodError = "serverUnavailable"
+		defer func() { srv.methodError = "" }()
+		_, err = iter.Collect(newTestProvider(t, srv, nil).GetMail(context.Background()))
+		if !errors.Is(err, provider.ErrUnavailable) {
+			t.Errorf("expected %v, got %v", provider.ErrUnavailable, err)
+		}
+	})
+}
+
+func TestJMAPProvider_FetchMessage(t *testing.T) {
+	srv := newStubServer(t, testEmails)
+	p := newTestProvider(t, srv, nil)
+
+	fetcher := provider.Fetcher(p)
+	if fetcher == nil {
+		t.Fatalf("expected the JMAP provider to fetch bodies")
+	}
+	msg, err := fetcher.FetchMessage(context.Background(), "e3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.ID() != "e3" || !strings.Contains(msg.HTMLBody(), "https://shop.example.com/optout") {
+		t.Errorf("expected the complete email, got ID %q and body %q", msg.ID(), msg.HTMLBody())
+	}
+
+	if _, err := p.FetchMessage(context.Background(), "e99"); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("expected %v, got %v", provider.ErrNotFound, err)
+	}
+}
+
+func TestJMAPProvider_Send(t *testing.T) {
+	srv := newStubServer(t, nil)
+
+	p := newTestProvider(t, srv, map[string]string{"jmap::identity": "Alias@Example.com"})
+	if err := p.Send(context.Background(), "leave@example.com", "unsubscribe", "please"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.submitted) != 1 {
+		t.Fatalf("expected one submission, got %d", len(srv.submitted))
+	}
+	draft := srv.submitted[0]
+	to, _ := json.Marshal(draft["to"])
+	from, _ := json.Marshal(draft["from"])
+	if string(to) != `[{"email":"leave@example.com"}]` || string(from) != `[{"email":"alias@example.com","name":"Sam Alias"}]` || draft["subject"] != "unsubscribe" || draft["identityId"] != "id2" {
+		t.Errorf("unexpected submission %v", draft)
+	}
+
+	srv.noDrafts = true
+	if err := newTestProvider(t, srv, nil).Send(context.Background(), "leave@example.com", "unsubscribe", ""); err == nil {
+		t.Errorf("expected an error without a drafts mailbox")
+	}
+	if err := newTestProvider(t, srv, map[string]string{"jmap::identity": "nobody@example.com"}).Send(context.Background(), "leave@example.com", "unsubscribe", ""); err == nil {
+		t.Errorf("expected an error for an unknown identity")
+	}
+}
@@ -0,0 +1,140 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Capabilities used by the provider.
+const (
+	capabilityCore       = "urn:ietf:params:jmap:core"
+	capabilityMail       = "urn:ietf:params:jmap:mail"
+	capabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+// Session is documented at https://www.rfc-editor.org/rfc/rfc8620#section-2
+type Session struct {
+	Username        string                     `json:"username"`
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	State           string                     `json:"state"`
+}
+
+// CoreCapability holds the limits of urn:ietf:params:jmap:core that the provider respects.
+type CoreCapability struct {
+	MaxObjectsInGet   int `json:"maxObjectsInGet"`
+	MaxCallsInRequest int `json:"maxCallsInRequest"`
+}
+
+// Request is documented at https://www.rfc-editor.org/rfc/rfc8620#section-3.3
+type Request struct {
+	Using       []string     `json:"using"`
+	MethodCalls []Invocation `json:"methodCalls"`
+}
+
+// Response is documented at https://www.rfc-editor.org/rfc/rfc8620#section-3.4
+type Response struct {
+	MethodResponses []Invocation `json:"methodResponses"`
+	SessionState    string       `json:"sessionState"`
+}
+
+// Invocation is a method call or response, encoded as the JSON array
+// [name, arguments, method call id]. Decoded arguments are a json.RawMessage.
+type Invocation struct {
+	Name   string
+	Args   any
+	CallID string
+}
+
+func (i Invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{i.Name, i.Args, i.CallID})
+}
+
+func (i *Invocation) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("invocation has %d elements, expected 3", len(fields))
+	}
+
+	var args json.RawMessage
+	if err := json.Unmarshal(fields[0], &i.Name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[1], &args); err != nil {
+		return err
+	}
+	i.Args = args
+	return json.Unmarshal(fields[2], &i.CallID)
+}
+
+// ResultReference is documented at https://www.rfc-editor.org/rfc/rfc8620#section-3.7
+type ResultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// MethodError is the arguments of an "error" method response.
+type MethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// SetError is documented at https://www.rfc-editor.org/rfc/rfc8620#section-5.3
+type SetError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+type Mailbox struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type MailboxGetResponse struct {
+	List []Mailbox `json:"list"`
+}
+
+type MailboxQueryResponse struct {
+	IDs []string `json:"ids"`
+}
+
+type EmailQueryResponse struct {
+	IDs      []string `json:"ids"`
+	Position int      `json:"position"`
+	Total    *int     `json:"total,omitempty"`
+}
+
+// EmailGetResponse holds the properties requested of each email. Header
+// properties such as "header:List-Unsubscribe:asRaw" are null when the email
+// has no such header.
+type EmailGetResponse struct {
+	List     []map[string]*string `json:"list"`
+	NotFound []string             `json:"notFound"`
+}
+
+type Identity struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type IdentityGetResponse struct {
+	List []Identity `json:"list"`
+}
+
+type EmailAddress struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+}
+
+type SetResponse struct {
+	Created    map[string]json.RawMessage `json:"created"`
+	NotCreated map[string]SetError        `json:"notCreated"`
+}
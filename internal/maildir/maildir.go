@@ -0,0 +1,262 @@
+// Package maildir implements an offline provider reading Maildir directories,
+// such as those kept by offlineimap, mbsync or Dovecot.
+package maildir
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+var MaildirInboxKey = "maildir"
+
+type MaildirProvider struct {
+	root string
+
+	// index maps the folders FetchMessage has read, or GetMail has listed,
+	// to the files of their messages by unique name.
+	mu    sync.Mutex
+	index map[string]map[string]string
+}
+
+// New creates a Maildir provider from the inbox config:
+//
+//	maildir::path  a Maildir, or a directory with Maildirs anywhere below it (required)
+func New(ctx context.Context, store store.Store, inboxConfig *store.InboxConfig) (*MaildirProvider, error) {
+	root, err := inboxConfig.GetString(ctx, "maildir::path")
+	if err != nil {
+		return nil, err
+	}
+	if root == "" {
+		return nil, errors.New(`maildir: missing inbox config "maildir::path"`)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("maildir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("maildir: %s is not a directory", root)
+	}
+	return &MaildirProvider{root: root}, nil
+}
+
+// GetMail streams the headers of the messages in new and cur of every Maildir
+// under the configured path, folder by folder. Message IDs are the folder's
+// path relative to the configured one and the message's unique name, which
+// stays the same when another client changes its flags.
+func (m *MaildirProvider) GetMail(ctx context.Context) iter.Seq[message.Message] {
+	return func(yield func(*message.Message, error) bool) {
+		folders, err := m.folders()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		for _, folder := range folders {
+			log.Printf("maildir: loading messages from %q", folder)
+
+			names, err := messageFiles(filepath.Join(m.root, folder))
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			m.setIndex(folder, names)
+
+			for _, name := range names {
+				if err := ctx.Err(); err != nil {
+					yield(nil, err)
+					return
+				}
+
+				headers, err := readHeaders(filepath.Join(m.root, folder, name))
+				if errors.Is(err, fs.ErrNotExist) {
+					// moved or deleted by another client since it was listed
+					continue
+				}
+				if err != nil {
+					log.Printf("maildir: skipping message %s: %s", name, err)
+					continue
+				}
+
+				msg := message.NewMessage(headers, "")
+				msg.SetID(filepath.ToSlash(filepath.Join(folder, uniqueName(filepath.Base(name)))))
+				if !yield(msg, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// FetchMessage returns the complete message whose ID was set by GetMail. The
+// files of a folder are listed once and listed again only when a message is
+// missing, e.g. because another client moved it from new to cur.
+func (m *MaildirProvider) FetchMessage(ctx context.Context, id string) (*message.Message, error) {
+	folder, unique := filepath.Split(filepath.FromSlash(id))
+	if unique == "" || !filepath.IsLocal(filepath.Join(folder, unique)) {
+		return nil, fmt.Errorf("maildir: invalid message ID %q", id)
+	}
+	folder = filepath.Clean(folder)
+
+	var raw []byte
+	for refresh := false; ; refresh = true {
+		name, err := m.lookup(folder, unique, refresh)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			raw, err = os.ReadFile(filepath.Join(m.root, folder, name))
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("maildir: %w", err)
+			}
+		}
+		if refresh {
+			return nil, fmt.Errorf("maildir: message %s: %w", id, provider.ErrNotFound)
+		}
+	}
+
+	msg, err := message.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("maildir: error parsing message %s: %w", id, err)
+	}
+	msg.SetID(id)
+	return msg, nil
+}
+
+// lookup returns the file of the message with the unique name in folder,
+// relative to the folder, or "" when there is none. The folder is listed when
+// it has not been yet or when refresh is set.
+func (m *MaildirProvider) lookup(folder, unique string, refresh bool) (string, error) {
+	m.mu.Lock()
+	files, ok := m.index[folder]
+	m.mu.Unlock()
+
+	if !ok || refresh {
+		names, err := messageFiles(filepath.Join(m.root, folder))
+		if err != nil {
+			return "", err
+		}
+		files = m.setIndex(folder, names)
+	}
+	return files[unique], nil
+}
+
+// setIndex replaces the index of folder with the message files in names.
+func (m *MaildirProvider) setIndex(folder string, names []string) map[string]string {
+	files := make(map[string]string, len(names))
+	for _, name := range names {
+		files[uniqueName(filepath.Base(name))] = name
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.index == nil {
+		m.index = make(map[string]map[string]string)
+	}
+	m.index[folder] = files
+	return files
+}
+
+func (m *MaildirProvider) Send(ctx context.Context, to, subject, body string) error {
+	return errors.New("maildir: sending mail is not supported by Maildir, configure SMTP for this inbox")
+}
+
+// folders returns the Maildirs under the root, i.e. the directories with a
+// cur or new subdirectory, relative to the root and sorted.
+func (m *MaildirProvider) folders() ([]string, error) {
+	folders := make([]string, 0)
+	err := filepath.WalkDir(m.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			// a Maildir++ folder such as .Archive may sit next to these
+			return fs.SkipDir
+		}
+		if isMaildir(path) {
+			rel, err := filepath.Rel(m.root, path)
+			if err != nil {
+				return err
+			}
+			folders = append(folders, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("maildir: %w", err)
+	}
+	if len(folders) == 0 {
+		return nil, fmt.Errorf("maildir: no Maildir found in %s", m.root)
+	}
+	return folders, nil
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// messageFiles returns the files of new and cur of the Maildir dir, relative
+// to it, sorted by name. Files being delivered are in tmp and not returned.
+func messageFiles(dir string) ([]string, error) {
+	names := make([]string, 0)
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("maildir: %w", err)
+		}
+
+		for _, entry := range entries {
+			// dot files are not messages, e.g. Dovecot's and mbsync's state
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				names = append(names, filepath.Join(sub, entry.Name()))
+			}
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// uniqueName strips the info, i.e. the flags, from a Maildir file name.
+func uniqueName(name string) string {
+	unique, _, _ := strings.Cut(name, ":")
+	return unique
+}
+
+func readHeaders(path string) ([]message.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return message.ReadHeaders(bufio.NewReader(f))
+}
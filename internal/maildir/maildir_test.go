@@ -0,0 +1,129 @@
+package maildir_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/maildir"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newProvider(t *testing.T, path string) (*maildir.MaildirProvider, error) {
+	t.Helper()
+	inboxConfig := store.NewPendingInboxConfig(nil)
+	inboxConfig.Set(context.Background(), "maildir::path", path)
+	return maildir.New(context.Background(), nil, inboxConfig)
+}
+
+func TestMaildirProvider(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "cur", "1700000001.M1P1.host:2,S"), "From: news@example.com\r\nList-Id: <news.example.com>\r\n\r\nIssue 1\r\n")
+	writeFile(t, filepath.Join(root, "new", "1700000002.M2P2.host"), "From: friend@example.org\nSubject: hi\n\nhello\n")
+	writeFile(t, filepath.Join(root, "tmp", "1700000003.M3P3.host"), "From: half@delivered.example\r\n")
+	writeFile(t, filepath.Join(root, "cur", ".mbsyncstate"), "state")
+	writeFile(t, filepath.Join(root, ".Archive", "cur", "1600000000.M0P0.host:2,RS"), "From: old@example.net\r\nContent-Type: text/plain\r\n\r\nunsubscribe at https://example.net/u\r\n")
+	writeFile(t, filepath.Join(root, "Lists", "Go", "new", "1700000004.M4P4.host"), "From: golang-nuts@googlegroups.com\r\n\r\n")
+	os.MkdirAll(filepath.Join(root, "Lists", "Go", "cur"), 0o755)
+
+	p, err := newProvider(t, root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages, err := iter.Collect(p.GetMail(context.Background()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ids, senders := make([]string, 0), make([]string, 0)
+	for _, msg := range messages {
+		ids = append(ids, msg.ID())
+		senders = append(senders, msg.GetHeader("From"))
+		if msg.Body() != "" {
+			t.Errorf("expected only headers, got body %q", msg.Body())
+		}
+	}
+	expected := []string{".Archive/1600000000.M0P0.host", "Lists/Go/1700000004.M4P4.host", "1700000001.M1P1.host", "1700000002.M2P2.host"}
+	slices.Sort(ids)
+	slices.Sort(expected)
+	if !slices.Equal(ids, expected) {
+		t.Errorf("expected IDs %q, got %q", expected, ids)
+	}
+	if len(senders) != 4 || slices.Contains(senders, "half@delivered.example") {
+		t.Errorf("expected the 4 delivered messages, got %q", senders)
+	}
+
+	t.Run("fetch after a flag change", func(t *testing.T) {
+		os.Rename(filepath.Join(root, ".Archive", "cur", "1600000000.M0P0.host:2,RS"), filepath.Join(root, ".Archive", "cur", "1600000000.M0P0.host:2,RST"))
+
+		msg, err := provider.Fetcher(p).FetchMessage(context.Background(), ".Archive/1600000000.M0P0.host")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if msg.TextBody() != "unsubscribe at https://example.net/u\r\n" || msg.ID() != ".Archive/1600000000.M0P0.host" {
+			t.Errorf("expected the complete message, got body %q and ID %q", msg.TextBody(), msg.ID())
+		}
+	})
+
+	t.Run("fetch a message delivered after listing", func(t *testing.T) {
+		writeFile(t, filepath.Join(root, "Lists", "Go", "new", "1700000005.M5P5.host"), "From: golang-nuts@googlegroups.com\r\n\r\nnew\r\n")
+
+		for _, id := range []string{"Lists/Go/1700000004.M4P4.host", "Lists/Go/1700000005.M5P5.host"} {
+			if _, err := p.FetchMessage(context.Background(), id); err != nil {
+				t.Errorf("%s: unexpected error: %v", id, err)
+			}
+		}
+	})
+
+	t.Run("fetch errors", func(t *testing.T) {
+		if _, err := p.FetchMessage(context.Background(), "gone.host"); !errors.Is(err, provider.ErrNotFound) {
+			t.Errorf("expected %v, got %v", provider.ErrNotFound, err)
+		}
+		if _, err := p.FetchMessage(context.Background(), "../outside"); err == nil {
+			t.Errorf("expected an error for an ID outside the Maildir")
+		}
+	})
+
+	t.Run("stops when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := iter.Collect(p.GetMail(ctx)); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	empty := t.TempDir()
+	file := filepath.Join(empty, "file")
+	writeFile(t, file, "")
+
+	for _, path := range []string{"", filepath.Join(empty, "missing"), file} {
+		if _, err := newProvider(t, path); err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+
+	p, err := newProvider(t, empty)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := iter.Collect(p.GetMail(context.Background())); err == nil {
+		t.Errorf("expected an error for a directory without Maildirs")
+	}
+}
@@ -1,5 +1,7 @@
 package mailer
 
+import "context"
+
 type Mailer interface {
-	Send(to, subject, body string) error
+	Send(ctx context.Context, to, subject, body string) error
 }
@@ -0,0 +1,324 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+const (
+	securityTLS      = "tls"
+	securityStartTLS = "starttls"
+	securityNone     = "none"
+)
+
+// SMTPMailer sends mail through an SMTP submission server configured per inbox.
+//
+// Recognised inbox config keys:
+//
+//	smtp::host      submission server host name (required)
+//	smtp::port      defaults to 465 for "tls" and 587 otherwise
+//	smtp::security  "tls" (implicit TLS, default), "starttls" or "none"
+//	smtp::auth      "plain" (default), "login", "xoauth2" or "none"
+//	smtp::username  defaults to credentials::username
+//	smtp::password  defaults to credentials::password
+//	smtp::from      envelope and header sender, defaults to the username
+//
+// A session is bounded by the inbox's "timeout::request", see provider.RequestTimeout.
+// XOAUTH2 uses credentials::accessToken as the bearer token.
+type SMTPMailer struct {
+	host      string
+	port      string
+	security  string
+	auth      string
+	username  string
+	password  string
+	token     string
+	from      string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+// SMTPConfigured reports whether inboxConfig has an SMTP server configured.
+func SMTPConfigured(ctx context.Context, inboxConfig *store.InboxConfig) (bool, error) {
+	return inboxConfig.IsSet(ctx, "smtp::host")
+}
+
+func NewSMTPMailer(ctx context.Context, inboxConfig *store.InboxConfig) (*SMTPMailer, error) {
+	var err error
+	get := func(key, fallback string) string {
+		if err != nil {
+			return ""
+		}
+		var value string
+		if value, err = inboxConfig.GetString(ctx, key); value != "" {
+			return value
+		}
+		return fallback
+	}
+
+	m := &SMTPMailer{
+		host:     get("smtp::host", ""),
+		security: get("smtp::security", securityTLS),
+		auth:     get("smtp::auth", "plain"),
+		username: get("smtp::username", get("credentials::username", "")),
+		password: get("smtp::password", get("credentials::password", "")),
+		token:    get("credentials::accessToken", ""),
+	}
+	m.from = get("smtp::from", m.username)
+	m.tlsConfig = &tls.Config{ServerName: m.host}
+
+	defaultPort := "587"
+	if m.security == securityTLS {
+		defaultPort = "465"
+	}
+	m.port = get("smtp::port", defaultPort)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if m.timeout, err = provider.RequestTimeout(ctx, inboxConfig); err != nil {
+		return nil, err
+	}
+
+	if m.host == "" {
+		return nil, errors.New("smtp: missing inbox config \"smtp::host\"")
+	}
+
+	switch m.security {
+	case securityTLS, securityStartTLS, securityNone:
+	default:
+		return nil, fmt.Errorf("smtp: unknown security mode %q", m.security)
+	}
+
+	if _, err := mail.ParseAddress(m.from); err != nil {
+		return nil, fmt.Errorf("smtp: invalid sender address %q: %w", m.from, err)
+	}
+
+	return m, nil
+}
+
+// Send delivers a single message. The SMTP session is aborted when ctx is
+// cancelled or when its deadline or the request timeout passes, whichever
+// comes first.
+func (m *SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("smtp: invalid recipient address %q: %w", to, err)
+	}
+
+	sender, _ := mail.ParseAddress(m.from)
+	msg, err := m.compose(sender, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	auth, err := m.smtpAuth()
+	if err != nil {
+		return err
+	}
+
+	c, err := m.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	if m.security == securityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp: server does not support STARTTLS")
+		}
+		if err := c.StartTLS(m.tlsConfig); err != nil {
+			return fmt.Errorf("smtp: STARTTLS failed: %w", err)
+		}
+	}
+
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("smtp: authentication failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(sender.Address); err != nil {
+		return fmt.Errorf("smtp: MAIL FROM rejected: %w", err)
+	}
+	if err := c.Rcpt(rcpt.Address); err != nil {
+		return fmt.Errorf("smtp: RCPT TO rejected: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: DATA rejected: %w", err)
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("smtp: error writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: message rejected: %w", err)
+	}
+
+	return c.Quit()
+}
+
+func (m *SMTPMailer) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.host, m.port)
+	deadline := time.Now().Add(m.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if m.security == securityTLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: m.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("smtp: error connecting to %s: %w", addr, err)
+	}
+	// a server that stops answering mid-session would otherwise block forever
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp: error greeting %s: %w", addr, err)
+	}
+	return c, nil
+}
+
+func (m *SMTPMailer) smtpAuth() (smtp.Auth, error) {
+	switch strings.ToLower(m.auth) {
+	case "none":
+		return nil, nil
+	case "plain":
+		return smtp.PlainAuth("", m.username, m.password, m.host), nil
+	case "login":
+		return &loginAuth{m.username, m.password, m.host}, nil
+	case "xoauth2":
+		return &xoauth2Auth{m.username, m.token, m.host}, nil
+	}
+	return nil, fmt.Errorf("smtp: unknown auth mechanism %q", m.auth)
+}
+
+// compose builds the RFC 5322 message handed to the server in DATA.
+func (m *SMTPMailer) compose(sender *mail.Address, to, subject, body string) (string, error) {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return "", errors.New("smtp: line break in recipient or subject")
+	}
+
+	headers := []message.Header{
+		{Name: "Date", Value: time.Now().Format(time.RFC1123Z)},
+		{Name: "Message-ID", Value: newMessageID(sender.Address)},
+		{Name: "From", Value: sender.String()},
+		{Name: "To", Value: to},
+		{Name: "Subject", Value: subject},
+		{Name: "MIME-Version", Value: "1.0"},
+		{Name: "Content-Type", Value: "text/plain; charset=utf-8"},
+		{Name: "Content-Transfer-Encoding", Value: "8bit"},
+	}
+
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\n", "\r\n")
+	if !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+
+	return *message.NewMessage(headers, body).RFC822(), nil
+}
+
+// newMessageID returns a unique Message-ID using the domain of the sender.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if _, d, ok := strings.Cut(from, "@"); ok && d != "" {
+		domain = d
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(b), domain)
+}
+
+// loginAuth implements the non-standard but widely deployed LOGIN mechanism.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); prompt {
+	case "username:", "user name", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN prompt %q", prompt)
+	}
+}
+
+// xoauth2Auth implements Google's XOAUTH2 SASL mechanism.
+// https://developers.google.com/workspace/gmail/imap/xoauth2-protocol
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	if a.token == "" {
+		return "", nil, errors.New("no access token available for XOAUTH2")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sent a JSON error; an empty response makes it finish the exchange
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// checkServer refuses to send credentials over an unencrypted connection
+// unless the server is on localhost, mirroring smtp.PlainAuth.
+func checkServer(server *smtp.ServerInfo, host string) error {
+	isLocalhost := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !isLocalhost {
+		return errors.New("unencrypted connection")
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package mailer_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/mailer"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// smtpSink is a local SMTP server that records a single transaction.
+type smtpSink struct {
+	listener net.Listener
+	done     chan struct{}
+
+	auth     []string // mechanism followed by the decoded client responses
+	mailFrom string
+	rcptTo   []string
+	data     string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	sink := &smtpSink{listener: l, done: make(chan struct{})}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer close(sink.done)
+		sink.serve(conn)
+	}()
+
+	return sink
+}
+
+func (sink *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	readLine := func() string {
+		line, _ := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	}
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	challenge := func(prompt string) string {
+		fmt.Fprintf(conn, "334 %s\r\n", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		return decode(readLine())
+	}
+
+	fmt.Fprint(conn, "220 sink.example.com ESMTP\r\n")
+	for {
+		line := readLine()
+		verb, args, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			fmt.Fprint(conn, "250-sink.example.com\r\n250-8BITMIME\r\n250 AUTH PLAIN LOGIN XOAUTH2\r\n")
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(args, " ")
+			sink.auth = append(sink.auth, mechanism)
+			switch mechanism {
+			case "LOGIN":
+				sink.auth = append(sink.auth, challenge("Username:"), challenge("Password:"))
+			default:
+				sink.auth = append(sink.auth, decode(initial))
+			}
+			fmt.Fprint(conn, "235 2.7.0 authenticated\r\n")
+		case "MAIL":
+			sink.mailFrom = args
+			fmt.Fprint(conn, "250 2.1.0 ok\r\n")
+		case "RCPT":
+			sink.rcptTo = append(sink.rcptTo, args)
+			fmt.Fprint(conn, "250 2.1.5 ok\r\n")
+		case "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var sb strings.Builder
+			for {
+				line, _ := r.ReadString('\n')
+				if line == ".\r\n" || line == "" {
+					break
+				}
+				sb.WriteString(line)
+			}
+			sink.data = sb.String()
+			fmt.Fprint(conn, "250 2.0.0 queued\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "221 2.0.0 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "502 5.5.2 unknown command\r\n")
+		}
+	}
+}
+
+func newInboxConfig(t *testing.T, sink *smtpSink, config map[string]string) *store.InboxConfig {
+	t.Helper()
+
+	st := &store.SQLStore{}
+	if err := st.Open(filepath.Join(t.TempDir(), "go-away.sqlite3")); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	inbox, err := st.AddInbox(context.Background(), "sam@example.com", "imap", nil)
+	if err != nil {
+		t.Fatalf("failed to add inbox: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(sink.listener.Addr().String())
+	inboxConfig := store.NewInboxConfig(inbox.ID, st)
+	inboxConfig.Set(context.Background(), "smtp::host", host)
+	inboxConfig.Set(context.Background(), "smtp::port", port)
+	inboxConfig.Set(context.Background(), "smtp::security", "none")
+	inboxConfig.Set(context.Background(), "credentials::username", "sam@example.com")
+	inboxConfig.Set(context.Background(), "credentials::password", "hunter2")
+	for key, value := range config {
+		inboxConfig.Set(context.Background(), key, value)
+	}
+
+	return inboxConfig
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       map[string]string
+		expectedAuth []string
+		expectedFrom string
+	}{
+		{
+			name:         "PLAIN",
+			expectedAuth: []string{"PLAIN", "\x00sam@example.com\x00hunter2"},
+			expectedFrom: "sam@example.com",
+		},
+		{
+			name:         "LOGIN",
+			config:       map[string]string{"smtp::auth": "login"},
+			expectedAuth: []string{"LOGIN", "sam@example.com", "hunter2"},
+			expectedFrom: "sam@example.com",
+		},
+		{
+			name:         "XOAUTH2",
+			config:       map[string]string{"smtp::auth": "xoauth2", "credentials::accessToken": "ya29.token"},
+			expectedAuth: []string{"XOAUTH2", "user=sam@example.com\x01auth=Bearer ya29.token\x01\x01"},
+			expectedFrom: "sam@example.com",
+		},
+		{
+			name:         "no auth with explicit sender",
+			config:       map[string]string{"smtp::auth": "none", "smtp::from": "Sam <unsub@example.com>"},
+			expectedFrom: "unsub@example.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := newSMTPSink(t)
+
+			m, err := mailer.NewSMTPMailer(context.Background(), newInboxConfig(t, sink, tc.config))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = m.Send(context.Background(), "leave@list.example.org", "unsubscribe", "GO AWAY\n.hidden line")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			select {
+			case <-sink.done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for the SMTP transaction")
+			}
+
+			if strings.Join(sink.auth, "|") != strings.Join(tc.expectedAuth, "|") {
+				t.Errorf("expected auth: %q, got: %q", tc.expectedAuth, sink.auth)
+			}
+
+			expectedMailFrom := "FROM:<" + tc.expectedFrom + "> BODY=8BITMIME"
+			if sink.mailFrom != expectedMailFrom {
+				t.Errorf("expected MAIL %s, got: MAIL %s", expectedMailFrom, sink.mailFrom)
+			}
+			if len(sink.rcptTo) != 1 || sink.rcptTo[0] != "TO:<leave@list.example.org>" {
+				t.Errorf("expected RCPT TO:<leave@list.example.org>, got: %q", sink.rcptTo)
+			}
+
+			msg, err := mail.ReadMessage(strings.NewReader(sink.data))
+			if err != nil {
+				t.Fatalf("DATA is not a valid message: %v\n%s", err, sink.data)
+			}
+
+			if _, err := msg.Header.Date(); err != nil {
+				t.Errorf("invalid Date header %q: %v", msg.Header.Get("Date"), err)
+			}
+			messageID := regexp.MustCompile(`^<[^<>@\s]+@example\.com>$`)
+			if !messageID.MatchString(msg.Header.Get("Message-ID")) {
+				t.Errorf("invalid Message-ID header: %q", msg.Header.Get("Message-ID"))
+			}
+
+			from, err := msg.Header.AddressList("From")
+			if err != nil || len(from) != 1 || from[0].Address != tc.expectedFrom {
+				t.Errorf("expected From address %s, got: %q", tc.expectedFrom, msg.Header.Get("From"))
+			}
+
+			// everything after Date and Message-ID is deterministic
+			_, rest, _ := strings.Cut(sink.data, "From: ")
+			expectedRest := "To: leave@list.example.org\r\n" +
+				"Subject: unsubscribe\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: 8bit\r\n" +
+				"\r\n" +
+				"GO AWAY\r\n" +
+				"..hidden line\r\n"
+			if _, rest, _ = strings.Cut(rest, "\r\n"); rest != expectedRest {
+				t.Errorf("unexpected DATA:\n%q\nexpected:\n%q", rest, expectedRest)
+			}
+		})
+	}
+}
+
+func TestNewSMTPMailer_Invalid(t *testing.T) {
+	sink := newSMTPSink(t)
+
+	for _, config := range []map[string]string{
+		{"smtp::security": "ssl3"},
+		{"smtp::from": "not an address"},
+	} {
+		if _, err := mailer.NewSMTPMailer(context.Background(), newInboxConfig(t, sink, config)); err == nil {
+			t.Errorf("expected error for config %v", config)
+		}
+	}
+}
+
+func TestSMTPMailer_SendDisplayNameRecipient(t *testing.T) {
+	sink := newSMTPSink(t)
+
+	m, err := mailer.NewSMTPMailer(context.Background(), newInboxConfig(t, sink, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := m.Send(context.Background(), "List <leave@list.example.org>", "unsubscribe", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-sink.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the SMTP transaction")
+	}
+
+	if len(sink.rcptTo) != 1 || sink.rcptTo[0] != "TO:<leave@list.example.org>" {
+		t.Errorf("expected RCPT TO:<leave@list.example.org>, got: %q", sink.rcptTo)
+	}
+}
+
+func TestSMTPMailer_SendRejectsLineBreaks(t *testing.T) {
+	sink := newSMTPSink(t)
+
+	m, err := mailer.NewSMTPMailer(context.Background(), newInboxConfig(t, sink, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct{ to, subject string }{
+		{"leave@list.example.org", "unsubscribe\r\nBcc: victim@example.com"},
+		{"leave@list.example.org", "unsubscribe\nBcc: victim@example.com"},
+		{"\"List\r\nBcc: victim@example.com\" <leave@list.example.org>", "unsubscribe"},
+	} {
+		if err := m.Send(context.Background(), tc.to, tc.subject, "GO AWAY"); err == nil {
+			t.Errorf("expected an error for to %q, subject %q", tc.to, tc.subject)
+		}
+	}
+
+	select {
+	case <-sink.done:
+		t.Errorf("expected no SMTP transaction, got RCPT %q", sink.rcptTo)
+	default:
+	}
+}
+
+func TestSMTPMailer_SendTimeout(t *testing.T) {
+	// a server that accepts the connection but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	silent := &smtpSink{listener: l}
+	m, err := mailer.NewSMTPMailer(context.Background(), newInboxConfig(t, silent, map[string]string{"timeout::request": "200ms"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	err = m.Send(context.Background(), "leave@list.example.org", "unsubscribe", "")
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected %v, got: %v", os.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected Send to give up after the request timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,270 @@
+// Package mbox implements an offline provider reading mbox files, such as
+// Google Takeout exports.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+var MboxInboxKey = "mbox"
+
+// reQuotedFrom matches body lines escaped by mboxrd writers, which add a ">"
+// to lines starting with "From " or any number of ">" and "From ".
+var reQuotedFrom = regexp.MustCompile(`(?m)^>(>*From )`)
+
+type MboxProvider struct {
+	path  string
+	files []string
+}
+
+// New creates an mbox provider from the inbox config:
+//
+//	mbox::path  an mbox file, or a directory whose *.mbox files are read (required)
+func New(ctx context.Context, store store.Store, inboxConfig *store.InboxConfig) (*MboxProvider, error) {
+	path, err := inboxConfig.GetString(ctx, "mbox::path")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, errors.New(`mbox: missing inbox config "mbox::path"`)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("mbox: %w", err)
+	}
+	if !info.IsDir() {
+		if err := checkMbox(path); err != nil {
+			return nil, err
+		}
+		return &MboxProvider{filepath.Dir(path), []string{filepath.Base(path)}}, nil
+	}
+
+	// Glob returns the files sorted by name
+	files, err := filepath.Glob(filepath.Join(path, "*.mbox"))
+	if err != nil {
+		return nil, fmt.Errorf("mbox: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("mbox: no *.mbox file found in %s", path)
+	}
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	return &MboxProvider{path, files}, nil
+}
+
+// checkMbox fails unless the file at path is empty or starts with a "From " line.
+func checkMbox(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("mbox: %w", err)
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(io.LimitReader(f, 1024)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("mbox: %w", err)
+	}
+	if len(line) > 0 && !isFromLine(line) {
+		return fmt.Errorf("mbox: %s is not an mbox file", path)
+	}
+	return nil
+}
+
+// GetMail streams the headers of every message of the mbox files. Message IDs
+// are the file name and the offset of the message's "From " line, so exports
+// must not be changed while their inbox is in use.
+func (m *MboxProvider) GetMail(ctx context.Context) iter.Seq[message.Message] {
+	return func(yield func(*message.Message, error) bool) {
+		for _, name := range m.files {
+			log.Printf("mbox: loading messages from %q", name)
+
+			f, err := os.Open(filepath.Join(m.path, name))
+			if err != nil {
+				yield(nil, fmt.Errorf("mbox: %w", err))
+				return
+			}
+
+			ok := m.readFile(ctx, f, name, yield)
+			f.Close()
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// readFile yields the headers of the messages of one mbox file, returning
+// false once the stream is to stop.
+func (m *MboxProvider) readFile(ctx context.Context, f *os.File, name string, yield func(*message.Message, error) bool) bool {
+	r := &reader{br: bufio.NewReader(f)}
+	for {
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+			return false
+		}
+
+		offset, raw, err := r.next(true)
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			yield(nil, fmt.Errorf("mbox: error reading %s: %w", name, err))
+			return false
+		}
+
+		headers, err := message.ReadHeaders(bytes.NewReader(raw))
+		if err != nil {
+			log.Printf("mbox: skipping message at offset %d of %s: %s", offset, name, err)
+			continue
+		}
+		msg := message.NewMessage(headers, "")
+		msg.SetID(name + ":" + strconv.FormatInt(offset, 10))
+		if !yield(msg, nil) {
+			return false
+		}
+	}
+}
+
+// FetchMessage returns the complete message whose ID was set by GetMail, i.e.
+// "<file name>:<offset>".
+func (m *MboxProvider) FetchMessage(ctx context.Context, id string) (*message.Message, error) {
+	name, offsetPart, ok := cutLast(id, ":")
+	offset, err := strconv.ParseInt(offsetPart, 10, 64)
+	if !ok || err != nil || offset < 0 || filepath.Base(name) != name {
+		return nil, fmt.Errorf("mbox: invalid message ID %q", id)
+	}
+
+	f, err := os.Open(filepath.Join(m.path, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("mbox: message %s: %w", id, provider.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mbox: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("mbox: %w", err)
+	}
+	r := &reader{br: bufio.NewReader(f), offset: offset}
+	start, raw, err := r.next(false)
+	if err == io.EOF || err == nil && start != offset {
+		// the file changed since GetMail read it
+		return nil, fmt.Errorf("mbox: message %s: %w", id, provider.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mbox: error reading %s: %w", name, err)
+	}
+
+	msg, err := message.Parse(reQuotedFrom.ReplaceAll(raw, []byte("$1")))
+	if err != nil {
+		return nil, fmt.Errorf("mbox: error parsing message %s: %w", id, err)
+	}
+	msg.SetID(id)
+	return msg, nil
+}
+
+func (m *MboxProvider) Send(ctx context.Context, to, subject, body string) error {
+	return errors.New("mbox: sending mail is not supported by mbox, configure SMTP for this inbox")
+}
+
+// reader splits an mbox file into messages. A message starts after a
+// "From " line at the start of the file or following an empty line.
+type reader struct {
+	br      *bufio.Reader
+	offset  int64 // of the next line
+	pending bool  // whether the last line read was a "From " line
+	start   int64 // offset of that line
+}
+
+// next returns the offset of the "From " line of the next message and the
+// message, or only its header section if headersOnly is set. It returns
+// io.EOF after the last message.
+func (r *reader) next(headersOnly bool) (int64, []byte, error) {
+	for !r.pending {
+		line, err := r.readLine()
+		if len(line) == 0 && err != nil {
+			return 0, nil, err
+		}
+		if isFromLine(line) {
+			r.pending, r.start = true, r.offset-int64(len(line))
+		}
+	}
+	r.pending = false
+	start := r.start
+
+	var (
+		raw      []byte
+		inHeader = true
+		blank    = false
+	)
+	for {
+		line, err := r.readLine()
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return start, raw, nil
+			}
+			return 0, nil, err
+		}
+
+		if blank && isFromLine(line) {
+			r.pending, r.start = true, r.offset-int64(len(line))
+			// the empty line before "From " separates the messages
+			return start, trimLastLine(raw), nil
+		}
+		blank = len(bytes.TrimRight(line, "\r\n")) == 0
+
+		if !headersOnly || inHeader {
+			raw = append(raw, line...)
+		}
+		if blank {
+			inHeader = false
+		}
+	}
+}
+
+func (r *reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadBytes('\n')
+	r.offset += int64(len(line))
+	return line, err
+}
+
+// reFromLine matches the "From " lines that start messages, e.g.
+// "From sender@example.com Mon Jan  2 15:04:05 2006", so that body lines a
+// writer failed to escape are rarely mistaken for them.
+var reFromLine = regexp.MustCompile(`^From \S+ +[A-Z][a-z]{2} [A-Z][a-z]{2} +\d`)
+
+func isFromLine(line []byte) bool {
+	return reFromLine.Match(line)
+}
+
+// trimLastLine removes the empty line that ends every message but the last.
+func trimLastLine(raw []byte) []byte {
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	return bytes.TrimSuffix(raw, []byte("\r"))
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
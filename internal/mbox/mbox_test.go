@@ -0,0 +1,124 @@
+package mbox_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/mbox"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// takeout is shaped like a Google Takeout export: mboxrd with CRLF line
+// endings. The second message has a "From " line its writer did not escape.
+const takeout = "From 1781234567890123456@xxx Mon Jan 02 15:04:05 +0000 2006\r\n" +
+	"X-GM-THRID: 1781234567890123456\r\n" +
+	"From: News <news@example.com>\r\n" +
+	"List-Unsubscribe: <mailto:leave@example.com>\r\n" +
+	"Subject: Issue 1\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	">From the editor: hi\r\n" +
+	"\r\n" +
+	"From 1781234567890123457@xxx Tue Jan 03 15:04:05 +0000 2006\r\n" +
+	"From: deals@shop.example\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"From now on, unsubscribe at https://shop.example/optout\r\n" +
+	"\r\n" +
+	"From 1781234567890123458@xxx Wed Jan 04 15:04:05 +0000 2006\r\n" +
+	"From: friend@example.org\r\n" +
+	"\r\n" +
+	"bye\r\n"
+
+func newProvider(t *testing.T, path string) (*mbox.MboxProvider, error) {
+	t.Helper()
+	inboxConfig := store.NewPendingInboxConfig(nil)
+	inboxConfig.Set(context.Background(), "mbox::path", path)
+	return mbox.New(context.Background(), nil, inboxConfig)
+}
+
+func TestMboxProvider(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "All mail Including Spam and Trash.mbox")
+	os.WriteFile(path, []byte(takeout), 0o644)
+	os.WriteFile(filepath.Join(dir, "Sent.mbox"), []byte("From a@b Thu Jan 05 15:04:05 2006\nFrom: me@example.com\n\nsent\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not mail"), 0o644)
+
+	t.Run("file", func(t *testing.T) {
+		p, err := newProvider(t, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		messages, err := iter.Collect(p.GetMail(context.Background()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(messages) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(messages))
+		}
+		if from := messages[1].GetHeader("From"); from != "deals@shop.example" || messages[1].Body() != "" {
+			t.Errorf("expected the headers of the second message, got From %q and body %q", from, messages[1].Body())
+		}
+
+		msg, err := provider.Fetcher(p).FetchMessage(context.Background(), messages[0].ID())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if body := msg.TextBody(); body != "Hello\r\nFrom the editor: hi\r\n" {
+			t.Errorf("expected the unescaped body of the first message, got %q", body)
+		}
+		if msg.GetHeader("Subject") != "Issue 1" || msg.ID() != messages[0].ID() {
+			t.Errorf("expected the first message, got %v with ID %q", msg.Headers(), msg.ID())
+		}
+
+		msg, err = p.FetchMessage(context.Background(), messages[2].ID())
+		if err != nil || msg.TextBody() != "bye\r\n" {
+			t.Errorf("expected the last message, got %v, %v", msg, err)
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		p, err := newProvider(t, dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		messages, err := iter.Collect(p.GetMail(context.Background()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(messages) != 4 || messages[3].GetHeader("From") != "me@example.com" || messages[3].ID() != "Sent.mbox:0" {
+			t.Errorf("expected the messages of both mbox files, got %d", len(messages))
+		}
+	})
+
+	t.Run("fetch errors", func(t *testing.T) {
+		p, _ := newProvider(t, path)
+		for _, id := range []string{"All mail Including Spam and Trash.mbox:7", "All mail Including Spam and Trash.mbox:100000"} {
+			if _, err := p.FetchMessage(context.Background(), id); !errors.Is(err, provider.ErrNotFound) {
+				t.Errorf("%s: expected %v, got %v", id, provider.ErrNotFound, err)
+			}
+		}
+		for _, id := range []string{"no offset", "../secret.mbox:0", "x.mbox:-1"} {
+			if _, err := p.FetchMessage(context.Background(), id); err == nil || errors.Is(err, provider.ErrNotFound) {
+				t.Errorf("%s: expected an invalid ID error, got %v", id, err)
+			}
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	notMbox := filepath.Join(dir, "notes.txt")
+	os.WriteFile(notMbox, []byte("not mail"), 0o644)
+
+	for _, path := range []string{"", filepath.Join(dir, "missing.mbox"), notMbox, dir} {
+		if _, err := newProvider(t, path); err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+}
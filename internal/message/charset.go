@@ -0,0 +1,71 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// windows1252 maps the bytes 0x80 to 0x9f of windows-1252 to runes; the
+// other bytes are the same as in ISO 8859-1.
+var windows1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+// iso885915 maps the bytes ISO 8859-15 changed from ISO 8859-1.
+var iso885915 = map[byte]rune{0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž', 0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ'}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	b, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeCharset(strings.ToLower(charset), b)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}
+
+// decodeCharset converts b from charset to UTF-8. Unknown charsets are
+// treated as UTF-8, replacing invalid sequences, and reported as an error.
+func decodeCharset(charset string, b []byte) (string, error) {
+	switch charset {
+	case "", "us-ascii", "ascii", "utf-8", "utf8":
+		return strings.ToValidUTF8(string(b), string(utf8.RuneError)), nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1", "windows-1252", "cp1252", "iso-8859-15", "latin-9":
+		var sb strings.Builder
+		for _, c := range b {
+			switch {
+			case c >= 0x80 && c < 0xa0 && (charset == "windows-1252" || charset == "cp1252"):
+				sb.WriteRune(windows1252[c-0x80])
+			case iso885915[c] != 0 && (charset == "iso-8859-15" || charset == "latin-9"):
+				sb.WriteRune(iso885915[c])
+			default:
+				sb.WriteRune(rune(c))
+			}
+		}
+		return sb.String(), nil
+	case "utf-16", "utf-16be", "utf-16le":
+		var order binary.ByteOrder = binary.BigEndian
+		switch {
+		case charset == "utf-16le":
+			order = binary.LittleEndian
+		case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+			order, b = binary.LittleEndian, b[2:]
+		case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+			b = b[2:]
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return strings.ToValidUTF8(string(b), string(utf8.RuneError)), fmt.Errorf("message: unsupported charset %q", charset)
+}
@@ -0,0 +1,165 @@
+package message
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lineLength is the length RFC 5322 section 2.1.1 recommends header lines
+// stay within, excluding the CRLF.
+const lineLength = 78
+
+var (
+	wordDecoder   = &mime.WordDecoder{CharsetReader: charsetReader}
+	addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+)
+
+// addressHeaders are the headers whose values are address lists, of which
+// only display names may be encoded.
+var addressHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc"}
+
+// DecodeHeader decodes the RFC 2047 encoded words in a header value, returning
+// value as it is if they are malformed or in an unsupported charset.
+func DecodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// reLineBreak matches line breaks and the whitespace after them. A line break
+// in a value would end its header and start another one of the sender's
+// choosing, so EncodeHeader folds them into a space.
+var reLineBreak = regexp.MustCompile(`(?:[\r\n]+[ \t]*)+`)
+
+// maxWordLength is the longest an RFC 2047 encoded word may be.
+const maxWordLength = 75
+
+// EncodeHeader encodes a header value that is not plain ASCII as RFC 2047
+// encoded words, short enough for FormatHeader to fold the header within 78
+// columns. For address headers only the display names are encoded. Line breaks
+// are replaced with spaces.
+func EncodeHeader(name, value string) string {
+	value = reLineBreak.ReplaceAllString(value, " ")
+	if isASCII(value) {
+		return value
+	}
+
+	if slices.ContainsFunc(addressHeaders, func(h string) bool { return strings.EqualFold(h, name) }) {
+		if addrs, err := addressParser.ParseList(value); err == nil {
+			formatted := make([]string, len(addrs))
+			for i, addr := range addrs {
+				formatted[i] = addr.String()
+			}
+			return strings.Join(formatted, ", ")
+		}
+	}
+	return encodeWords(value, lineLength-len(name)-len(": "))
+}
+
+// encodeWords Q-encodes value as UTF-8 encoded words separated by spaces, the
+// first at most first characters long and the others at most 75, the longest
+// that fits a folded line. Characters are never split across words.
+func encodeWords(value string, first int) string {
+	const prefix, suffix = "=?utf-8?q?", "?="
+
+	var (
+		sb    strings.Builder
+		word  strings.Builder
+		limit = max(first, len(prefix+suffix)+len("=XX=XX=XX=XX"))
+	)
+	flush := func() {
+		if word.Len() == 0 {
+			return
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(prefix + word.String() + suffix)
+		word.Reset()
+		limit = maxWordLength
+	}
+
+	for _, r := range value {
+		encoded := qEncode(r)
+		if len(prefix)+word.Len()+len(encoded)+len(suffix) > limit {
+			flush()
+		}
+		word.WriteString(encoded)
+	}
+	flush()
+	return sb.String()
+}
+
+// qEncode encodes r as RFC 2047 section 4.2 Q encoding allows in any header.
+func qEncode(r rune) string {
+	switch {
+	case r == ' ':
+		return "_"
+	case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!*+-/", r)):
+		return string(r)
+	}
+
+	var sb strings.Builder
+	for _, b := range []byte(string(r)) {
+		fmt.Fprintf(&sb, "=%02X", b)
+	}
+	return sb.String()
+}
+
+// FormatHeader formats header as it is written in a message: encoded, folded
+// at whitespace to stay within 78 columns where possible and ending in CRLF.
+func FormatHeader(header Header) string {
+	return fold(header.Name+": "+EncodeHeader(header.Name, header.Value), len(header.Name)+2) + "\r\n"
+}
+
+// fold breaks line before whitespace so that each line is at most 78
+// characters long, not breaking within the first skip characters. Runs
+// without whitespace longer than that are left as they are.
+func fold(line string, skip int) string {
+	var sb strings.Builder
+	for len(line) > lineLength {
+		i := strings.LastIndexAny(line[:lineLength+1], " \t")
+		if i < skip {
+			// no whitespace early enough, break at the first one after
+			i = strings.IndexAny(line[lineLength:], " \t")
+			if i < 0 {
+				break
+			}
+			i += lineLength
+		}
+		sb.WriteString(line[:i])
+		sb.WriteString("\r\n")
+		line, skip = line[i:], 1
+	}
+	sb.WriteString(line)
+	return sb.String()
+}
+
+// unfold removes the line breaks of a folded header value, leaving the
+// whitespace that follows them, as RFC 5322 section 2.2.3 specifies.
+func unfold(value string) string {
+	if !strings.ContainsAny(value, "\r\n") {
+		return value
+	}
+	return strings.NewReplacer("\r\n", "", "\n", "", "\r", "").Replace(value)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,11 @@
 package message
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"net/mail"
 	"strings"
 )
 
@@ -13,32 +17,202 @@ type Header struct {
 type Message struct {
 	headers []Header
 	body    string
+	id      string
+	root    *Part
 }
 
-func NewMessage(headers []Header, body string) *Message { // XXX: rethink this
-	return &Message{headers, body}
+// NewMessage creates a message from its headers and its body as transmitted,
+// parsing the body into a MIME tree.
+func NewMessage(headers []Header, body string) *Message {
+	return &Message{headers: headers, body: body, root: ParsePart(headers, []byte(body))}
 }
 
+// NewMessageFromPart creates a message from a MIME tree whose root has the
+// message's headers. Body returns "" for such messages.
+func NewMessageFromPart(root *Part) *Message {
+	return &Message{headers: root.Headers, root: root}
+}
+
+// ID returns the identifier the provider assigned to the message, unique
+// within its inbox, or "" if the provider did not set one.
+func (m *Message) ID() string {
+	return m.id
+}
+
+func (m *Message) SetID(id string) {
+	m.id = id
+}
+
+// GetHeader returns the value of the first header called name, unfolded and
+// with RFC 2047 encoded words decoded, or "" if there is none. Values that are
+// parsed, such as addresses and URIs, should be read with RawHeader.
 func (m *Message) GetHeader(name string) string {
+	return DecodeHeader(m.RawHeader(name))
+}
+
+// RawHeader returns the value of the first header called name, unfolded but
+// otherwise as it was received, or "" if there is none.
+func (m *Message) RawHeader(name string) string {
 	for _, header := range m.headers {
 		if strings.EqualFold(header.Name, name) {
-			return header.Value
+			return unfold(header.Value)
 		}
 	}
 	return ""
 }
 
+// Headers returns the message's headers as they were received.
 func (m *Message) Headers() []Header {
 	return m.headers
 }
 
-func (m *Message) RFC822() *string {
-	headers := ""
+// From returns the first address of the From header.
+func (m *Message) From() (*mail.Address, error) {
+	addrs, err := m.AddressList("From")
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// To returns the addresses of the To header.
+func (m *Message) To() ([]*mail.Address, error) {
+	return m.AddressList("To")
+}
+
+// ReplyTo returns the addresses of the Reply-To header.
+func (m *Message) ReplyTo() ([]*mail.Address, error) {
+	return m.AddressList("Reply-To")
+}
+
+// AddressList parses the addresses of the header called name, decoding
+// encoded display names. It fails if the header is missing or has none.
+func (m *Message) AddressList(name string) ([]*mail.Address, error) {
+	value := m.RawHeader(name)
+	if value == "" {
+		return nil, fmt.Errorf("message: no %s header", name)
+	}
+
+	addrs, err := addressParser.ParseList(value)
+	if err != nil {
+		return nil, fmt.Errorf("message: error parsing %s header: %w", name, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("message: no address in %s header", name)
+	}
+	return addrs, nil
+}
+
+// Body returns the message body as it was received, still transfer-encoded.
+// Providers that only fetch headers leave it empty.
+func (m *Message) Body() string {
+	return m.body
+}
+
+// Root returns the root of the message's MIME tree.
+func (m *Message) Root() *Part {
+	if m.root == nil {
+		m.root = ParsePart(m.headers, []byte(m.body))
+	}
+	return m.root
+}
+
+// TextBody returns the first text/plain part of the message that is not an
+// attachment, converted to UTF-8, or "" if there is none.
+func (m *Message) TextBody() string {
+	return m.text("text/plain")
+}
+
+// HTMLBody returns the first text/html part of the message that is not an
+// attachment, converted to UTF-8, or "" if there is none.
+func (m *Message) HTMLBody() string {
+	return m.text("text/html")
+}
+
+func (m *Message) text(contentType string) string {
+	part := m.Root().find(contentType)
+	if part == nil {
+		return ""
+	}
+	// Text returns the best it can for unsupported charsets
+	text, _ := part.Text()
+	return text
+}
+
+// Attachments returns the attachment parts of the message.
+func (m *Message) Attachments() []*Part {
+	return m.Root().attachments(nil)
+}
 
+// RFC822 formats the message for sending, encoding non-ASCII header values
+// as RFC 2047 encoded words and folding header lines at 78 columns.
+func (m *Message) RFC822() *string {
+	var sb strings.Builder
 	for _, header := range m.headers {
-		headers += fmt.Sprintf("%s: %s\r\n", header.Name, header.Value)
+		sb.WriteString(FormatHeader(header))
 	}
 
-	v := fmt.Sprintf("%s\r\n%s", headers, m.body)
+	v := fmt.Sprintf("%s\r\n%s", sb.String(), m.body)
 	return &v
 }
+
+// ReadMessage parses an RFC 5322 message from r into its headers and MIME tree.
+func ReadMessage(r io.Reader) (*Message, error) {
+	br := bufio.NewReader(r)
+	headers, err := ReadHeaders(br)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(headers, string(body)), nil
+}
+
+// Parse parses a raw RFC 5322 message, see ReadMessage.
+func Parse(raw []byte) (*Message, error) {
+	return ReadMessage(bytes.NewReader(raw))
+}
+
+// ReadHeaders parses an RFC 5322 header section from r, stopping at the blank
+// line that separates headers from the body. Folded lines are unfolded and the
+// original header order is preserved.
+func ReadHeaders(r io.Reader) ([]Header, error) {
+	br := bufio.NewReader(r)
+	headers := make([]Header, 0)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			return headers, nil
+		}
+
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, fmt.Errorf("message: continuation line without a header: %q", trimmed)
+			}
+			last := &headers[len(headers)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(trimmed))
+		} else {
+			name, value, ok := strings.Cut(trimmed, ":")
+			if !ok {
+				return nil, fmt.Errorf("message: malformed header line: %q", trimmed)
+			}
+			headers = append(headers, Header{
+				Name:  strings.TrimSpace(name),
+				Value: strings.TrimSpace(value),
+			})
+		}
+
+		if err == io.EOF {
+			return headers, nil
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package message_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/message"
+)
+
+const rawMessage = "From: News <news@example.com>\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9_news?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed;\r\n" +
+	" boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"This is a multi-part message in MIME format.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 of the week: a very long line that is soft wrapped by quoted-pr=\r\n" +
+	"intable.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+Q2Fm6TwvcD4=\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; name=\"=?utf-8?q?men=C3=BC.txt?=\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"\r\n" +
+	"soup\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: forwarded\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>old news</p>\r\n" +
+	"--outer--\r\n" +
+	"epilogue\r\n"
+
+func TestParse(t *testing.T) {
+	msg, err := message.Parse([]byte(rawMessage))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	root := msg.Root()
+	if root.ContentType != "multipart/mixed" || len(root.Parts) != 3 || root.Body != nil {
+		t.Fatalf("expected a multipart/mixed root with 3 parts, got %q with %d parts", root.ContentType, len(root.Parts))
+	}
+
+	types := make([]string, 0)
+	for _, part := range root.All() {
+		types = append(types, part.ContentType)
+	}
+	expected := []string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "text/plain", "message/rfc822", "text/html"}
+	if !slices.Equal(types, expected) {
+		t.Errorf("expected parts %q, got %q", expected, types)
+	}
+
+	if text := msg.TextBody(); text != "Café of the week: a very long line that is soft wrapped by quoted-printable." {
+		t.Errorf("unexpected text body %q", text)
+	}
+	if html := msg.HTMLBody(); html != "<p>Café</p>" {
+		t.Errorf("unexpected HTML body %q", html)
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) != 1 || attachments[0].Filename != "menü.txt" || string(attachments[0].Body) != "soup" {
+		t.Errorf("expected the menü.txt attachment, got %+v", attachments)
+	}
+
+	forwarded := root.Parts[2]
+	if len(forwarded.Parts) != 1 || forwarded.Parts[0].GetHeader("Subject") != "forwarded" || string(forwarded.Parts[0].Body) != "<p>old news</p>" {
+		t.Errorf("expected the attached message to be parsed, got %+v", forwarded.Parts)
+	}
+}
+
+func TestParse_Lenient(t *testing.T) {
+	testCases := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{"no content type", "Subject: hi\r\n\r\nhello\r\n", "hello\r\n"},
+		{"header only", "Subject: hi\r\n", ""},
+		{"missing close delimiter", "Content-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\n\r\nhello\r\n", "hello\r\n"},
+		{"malformed content type", "Content-Type: text/plain; charset\r\n\r\nhello", "hello"},
+		{"unsupported charset", "Content-Type: text/plain; charset=x-unknown\r\n\r\nhello", "hello"},
+		{"windows-1252", "Content-Type: text/plain; charset=windows-1252\r\n\r\n\x93hi\x94", "“hi”"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := message.ReadMessage(strings.NewReader(tc.raw))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if text := msg.TextBody(); text != tc.expected {
+				t.Errorf("expected text body %q, got %q", tc.expected, text)
+			}
+		})
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	testCases := []struct {
+		value, expected string
+	}{
+		{"plain", "plain"},
+		{"=?utf-8?b?w6l0w6k=?=", "été"},
+		{"=?iso-8859-1?q?caf=E9?= au lait", "café au lait"},
+		{"=?x-unknown?q?abc?=", "=?x-unknown?q?abc?="},
+	}
+
+	for _, tc := range testCases {
+		if decoded := message.DecodeHeader(tc.value); decoded != tc.expected {
+			t.Errorf("DecodeHeader(%q): expected %q, got %q", tc.value, tc.expected, decoded)
+		}
+	}
+}
+
+func TestMessage_Headers(t *testing.T) {
+	msg, err := message.ReadMessage(strings.NewReader("From: =?utf-8?q?Jos=C3=A9_Doe=2C_Jr?= <Jose@Example.com>\r\n" +
+		"To: a@example.com, \"B\" <b@example.com>\r\n" +
+		"Subject: =?UTF-8?B?T2ZmZXJ0ZSBzcMOpY2lhbGU=?=\r\n" +
+		"\t=?UTF-8?B?IGV4Y2x1c2l2ZQ==?=\r\n" +
+		"List-Unsubscribe: <https://example.com/=?a?b?c?=>\r\n" +
+		"\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if subject := msg.GetHeader("Subject"); subject != "Offerte spéciale exclusive" {
+		t.Errorf("expected the decoded subject, got %q", subject)
+	}
+	if raw := msg.RawHeader("List-Unsubscribe"); raw != "<https://example.com/=?a?b?c?=>" {
+		t.Errorf("expected the raw List-Unsubscribe, got %q", raw)
+	}
+
+	from, err := msg.From()
+	if err != nil || from.Name != "José Doe, Jr" || from.Address != "Jose@Example.com" {
+		t.Errorf("expected José Doe, Jr <Jose@Example.com>, got %v, %v", from, err)
+	}
+	if to, err := msg.To(); err != nil || len(to) != 2 || to[1].Name != "B" {
+		t.Errorf("expected 2 To addresses, got %v, %v", to, err)
+	}
+	if _, err := msg.ReplyTo(); err == nil {
+		t.Errorf("expected an error for a missing Reply-To header")
+	}
+}
+
+func TestFormatHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   message.Header
+		expected string
+	}{
+		{"ascii", message.Header{Name: "Subject", Value: "Unsubscribe"}, "Subject: Unsubscribe\r\n"},
+		{"non-ascii", message.Header{Name: "Subject", Value: "Café"}, "Subject: =?utf-8?q?Caf=C3=A9?=\r\n"},
+		{"address", message.Header{Name: "To", Value: "José <jose@example.com>, ann@example.com"}, "To: =?utf-8?q?Jos=C3=A9?= <jose@example.com>, <ann@example.com>\r\n"},
+		{
+			"folded",
+			message.Header{Name: "List-Unsubscribe", Value: "<mailto:leave@example.com?subject=unsubscribe>, <https://example.com/unsubscribe?id=42>"},
+			"List-Unsubscribe: <mailto:leave@example.com?subject=unsubscribe>,\r\n <https://example.com/unsubscribe?id=42>\r\n",
+		},
+		{
+			"unbreakable",
+			message.Header{Name: "X-Token", Value: strings.Repeat("x", 90)},
+			"X-Token: " + strings.Repeat("x", 90) + "\r\n",
+		},
+		{
+			"line breaks",
+			message.Header{Name: "Subject", Value: "hi\r\nBcc: victim@example.com\n\t\r\n"},
+			"Subject: hi Bcc: victim@example.com \r\n",
+		},
+		{
+			"line breaks in a non-ascii value",
+			message.Header{Name: "Subject", Value: "café\r\nBcc: victim@example.com"},
+			"Subject: =?utf-8?q?caf=C3=A9_Bcc=3A_victim=40example=2Ecom?=\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if formatted := message.FormatHeader(tc.header); formatted != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, formatted)
+			}
+		})
+	}
+
+	t.Run("no injected headers", func(t *testing.T) {
+		headers := []message.Header{{Name: "To", Value: "list@example.com"}, {Name: "Subject", Value: "hi\r\nBcc: victim@example.com"}}
+		msg, err := message.Parse([]byte(*message.NewMessage(headers, "body\r\n").RFC822()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(msg.Headers()) != 2 || msg.GetHeader("Bcc") != "" || msg.TextBody() != "body\r\n" {
+			t.Errorf("expected only To and Subject, got %v", msg.Headers())
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		subject := "Ceci est un très long sujet avec des accents, qui ne tient pas sur une seule ligne d'en-tête"
+		raw := message.NewMessage([]message.Header{{Name: "Subject", Value: subject}}, "body\r\n").RFC822()
+
+		for line := range strings.Lines(*raw) {
+			if len(strings.TrimRight(line, "\r\n")) > 78 {
+				t.Errorf("expected lines of at most 78 characters, got %q", line)
+			}
+		}
+		msg, err := message.Parse([]byte(*raw))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if decoded := msg.GetHeader("Subject"); decoded != subject {
+			t.Errorf("expected %q, got %q", subject, decoded)
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// maxDepth limits how deeply nested multipart and message/rfc822 parts are parsed.
+const maxDepth = 10
+
+// Part is a node of a message's MIME tree. The root part has the message's
+// headers; multipart parts have their children in Parts and a message/rfc822
+// part has the root of the attached message.
+type Part struct {
+	Headers     []Header
+	ContentType string            // lowercased media type, text/plain when the part has none
+	Params      map[string]string // Content-Type parameters, e.g. charset and boundary
+	Encoding    string            // lowercased Content-Transfer-Encoding, 7bit when the part has none
+	Disposition string            // lowercased Content-Disposition type, e.g. attachment, or ""
+	Filename    string            // decoded file name of attachments, or ""
+
+	// Body is the content of the part with its transfer encoding removed,
+	// still in the part's charset. It is nil for multipart parts.
+	Body  []byte
+	Parts []*Part
+}
+
+// NewPart creates a part from its headers and its already decoded body,
+// e.g. for providers that deliver messages as a tree of parts rather than as
+// raw RFC 5322 bytes.
+func NewPart(headers []Header, body []byte, parts ...*Part) *Part {
+	p := newPart(headers)
+	p.Body, p.Parts = body, parts
+	return p
+}
+
+// ParsePart parses a part from its headers and its body as transmitted,
+// parsing the parts of multipart bodies and attached messages. Malformed
+// parts are kept as they are rather than failing the whole tree.
+func ParsePart(headers []Header, body []byte) *Part {
+	return parsePart(headers, body, 0)
+}
+
+func newPart(headers []Header) *Part {
+	p := &Part{Headers: headers, ContentType: "text/plain", Params: map[string]string{}, Encoding: "7bit"}
+
+	if value := p.GetHeader("Content-Type"); value != "" {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			// keep what can be read of a malformed header rather than
+			// treating the part as text, RFC 2045 section 5.2 notwithstanding
+			mediaType, _, _ = strings.Cut(value, ";")
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		}
+		if strings.Contains(mediaType, "/") {
+			p.ContentType = mediaType
+		}
+		if params != nil {
+			p.Params = params
+		}
+	}
+
+	if value := p.GetHeader("Content-Transfer-Encoding"); value != "" {
+		p.Encoding = strings.ToLower(strings.TrimSpace(value))
+	}
+
+	if value := p.GetHeader("Content-Disposition"); value != "" {
+		disposition, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			disposition, _, _ = strings.Cut(value, ";")
+			disposition = strings.ToLower(strings.TrimSpace(disposition))
+		}
+		p.Disposition = disposition
+		p.Filename = params["filename"]
+	}
+	if p.Filename == "" {
+		p.Filename = p.Params["name"]
+	}
+	p.Filename = DecodeHeader(p.Filename)
+
+	return p
+}
+
+func parsePart(headers []Header, body []byte, depth int) *Part {
+	p := newPart(headers)
+
+	switch {
+	case p.IsMultipart():
+		if boundary := p.Params["boundary"]; boundary != "" && depth < maxDepth {
+			for _, raw := range splitMultipart(body, boundary) {
+				br := bufio.NewReader(bytes.NewReader(raw))
+				partHeaders, err := ReadHeaders(br)
+				if err != nil {
+					// a part with malformed headers is kept as an opaque body
+					p.Parts = append(p.Parts, &Part{ContentType: "application/octet-stream", Params: map[string]string{}, Encoding: "7bit", Body: raw})
+					continue
+				}
+				rest, _ := io.ReadAll(br)
+				p.Parts = append(p.Parts, parsePart(partHeaders, rest, depth+1))
+			}
+			return p
+		}
+		p.Body = body
+	case p.ContentType == "message/rfc822":
+		p.Body = decodeTransfer(p.Encoding, body)
+		if depth < maxDepth {
+			br := bufio.NewReader(bytes.NewReader(p.Body))
+			if attachedHeaders, err := ReadHeaders(br); err == nil {
+				rest, _ := io.ReadAll(br)
+				p.Parts = []*Part{parsePart(attachedHeaders, rest, depth+1)}
+			}
+		}
+	default:
+		p.Body = decodeTransfer(p.Encoding, body)
+	}
+	return p
+}
+
+// splitMultipart returns the raw parts of a multipart body, without the
+// preamble, the epilogue and the line break before each delimiter. A missing
+// close delimiter ends the last part at the end of body.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+
+	var (
+		parts   [][]byte
+		current []byte
+		inPart  bool
+	)
+	for line := range bytes.Lines(body) {
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if bytes.HasPrefix(trimmed, delimiter) {
+			rest := trimmed[len(delimiter):]
+			if len(rest) == 0 || bytes.Equal(rest, []byte("--")) {
+				if inPart {
+					parts = append(parts, trimLineBreak(current))
+				}
+				if len(rest) != 0 {
+					return parts
+				}
+				current, inPart = nil, true
+				continue
+			}
+		}
+		if inPart {
+			current = append(current, line...)
+		}
+	}
+	if inPart {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// trimLineBreak removes the line break that belongs to the delimiter following b.
+func trimLineBreak(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+// decodeTransfer removes a base64 or quoted-printable transfer encoding. Body
+// is returned as it is for other encodings, and as far as it decodes when it
+// is malformed.
+func decodeTransfer(encoding string, body []byte) []byte {
+	var r io.Reader
+	switch encoding {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+
+	decoded, _ := io.ReadAll(r)
+	return decoded
+}
+
+func (p *Part) GetHeader(name string) string {
+	for _, header := range p.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// IsAttachment reports whether the part is meant to be saved rather than
+// shown: it has an attachment disposition, or a file name without an inline one.
+func (p *Part) IsAttachment() bool {
+	return p.Disposition == "attachment" || p.Filename != "" && p.Disposition != "inline" && !p.IsMultipart()
+}
+
+// Charset returns the lowercased charset of the part, us-ascii when a text
+// part has none, as RFC 2045 specifies.
+func (p *Part) Charset() string {
+	if charset := p.Params["charset"]; charset != "" {
+		return strings.ToLower(charset)
+	}
+	if strings.HasPrefix(p.ContentType, "text/") {
+		return "us-ascii"
+	}
+	return ""
+}
+
+// Text returns the body converted from the part's charset to UTF-8. For
+// charsets it cannot convert it returns the body with invalid UTF-8 replaced,
+// along with an error.
+func (p *Part) Text() (string, error) {
+	return decodeCharset(p.Charset(), p.Body)
+}
+
+// All returns the part and its descendants in depth-first order.
+func (p *Part) All() []*Part {
+	all := []*Part{p}
+	for _, child := range p.Parts {
+		all = append(all, child.All()...)
+	}
+	return all
+}
+
+// find returns the first part that is not an attachment with the given
+// content type, not descending into attached messages.
+func (p *Part) find(contentType string) *Part {
+	if p.ContentType == contentType && !p.IsAttachment() {
+		return p
+	}
+	if !p.IsMultipart() {
+		return nil
+	}
+	for _, child := range p.Parts {
+		if found := child.find(contentType); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// attachments appends the attachments among p and its descendants to found.
+func (p *Part) attachments(found []*Part) []*Part {
+	if p.IsAttachment() {
+		return append(found, p)
+	}
+	for _, child := range p.Parts {
+		found = child.attachments(found)
+	}
+	return found
+}
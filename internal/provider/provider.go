@@ -1,9 +1,64 @@
 package provider
 
-import "github.com/usrbinsam/go-away/internal/message"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// DefaultRequestTimeout bounds a single round trip to a provider unless the
+// inbox config sets "timeout::request" (e.g. "90s").
+const DefaultRequestTimeout = 60 * time.Second
+
+// RequestTimeout returns the per-request timeout configured for an inbox.
+func RequestTimeout(ctx context.Context, inboxConfig *store.InboxConfig) (time.Duration, error) {
+	return inboxConfig.GetDuration(ctx, "timeout::request", DefaultRequestTimeout)
+}
+
+// Errors returned by providers are wrapped around one of these where the cause is known,
+// so callers can decide whether to retry, skip the inbox or ask the user to re-authorize.
+var (
+	// ErrAuthExpired means the inbox credentials were rejected or have expired and must be renewed.
+	ErrAuthExpired = errors.New("credentials rejected or expired")
+	// ErrRateLimited means the provider is throttling requests and the operation should be retried later.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrNotFound means the requested message, folder or history no longer exists.
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable means the provider failed temporarily and the operation may be retried.
+	ErrUnavailable = errors.New("temporarily unavailable")
+)
 
 // A Provider defines the interface for an inbox provider (i.e., gmail, generic IMAP, etc.)
 type Provider interface {
-	GetMail() []*message.Message
-	Send(to, subject, body string) error
+	// GetMail streams the inbox's messages as they are downloaded. Consumers may stop early.
+	// A failure is yielded as an error, after which the stream ends.
+	GetMail(ctx context.Context) iter.Seq[message.Message]
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// BodyFetcher is implemented by providers whose GetMail yields messages
+// without their body. FetchMessage returns the complete message, headers and
+// body, whose ID (see message.Message.ID) is id.
+type BodyFetcher interface {
+	FetchMessage(ctx context.Context, id string) (*message.Message, error)
+}
+
+// Fetcher returns p as a BodyFetcher, looking through providers that wrap
+// another with an Unwrap method, or nil if p cannot fetch message bodies.
+func Fetcher(p Provider) BodyFetcher {
+	for p != nil {
+		if f, ok := p.(BodyFetcher); ok {
+			return f
+		}
+		wrapper, ok := p.(interface{ Unwrap() Provider })
+		if !ok {
+			return nil
+		}
+		p = wrapper.Unwrap()
+	}
+	return nil
 }
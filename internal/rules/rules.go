@@ -0,0 +1,199 @@
+// Package rules matches messages against user-defined sender rules, such as
+// the safe-sender allowlist and the always-unsubscribe blocklist.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/usrbinsam/go-away/internal/message"
+)
+
+type Kind string
+
+const (
+	// KindAddress matches a single address exactly, e.g. "alerts@bank.com".
+	KindAddress Kind = "address"
+	// KindDomain matches every address of one domain, e.g. "bank.com".
+	KindDomain Kind = "domain"
+	// KindSubdomain matches a domain and all of its subdomains, e.g. "*.bank.com".
+	KindSubdomain Kind = "subdomain"
+	// KindRegex matches addresses against a regular expression, e.g. "/^no-?reply@/".
+	KindRegex Kind = "regex"
+	// KindListID matches the List-Id of mailing list messages (RFC 2919), e.g. "list:news.example.com".
+	KindListID Kind = "list-id"
+)
+
+const listIDPrefix = "list:"
+
+// GlobalInbox is the InboxID of rules that apply to every inbox.
+const GlobalInbox = 0
+
+type Rule struct {
+	ID      int
+	InboxID int
+	Kind    Kind
+	Pattern string
+
+	re *regexp.Regexp
+}
+
+// Parse infers the kind of rule from pattern: "list:" introduces a List-Id,
+// "/.../" is a regex, a leading "*." a subdomain wildcard, anything with an
+// "@" an address and everything else a domain.
+func Parse(pattern string) (Rule, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case strings.HasPrefix(pattern, listIDPrefix):
+		return New(KindListID, strings.TrimPrefix(pattern, listIDPrefix))
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		return New(KindRegex, pattern[1:len(pattern)-1])
+	case strings.HasPrefix(pattern, "*."):
+		return New(KindSubdomain, strings.TrimPrefix(pattern, "*."))
+	case strings.Contains(pattern, "@"):
+		return New(KindAddress, pattern)
+	}
+	return New(KindDomain, pattern)
+}
+
+// New validates pattern for kind and returns the rule. Addresses and domains
+// are compared case-insensitively; regexes are matched case-insensitively
+// against the whole lower-cased address.
+func New(kind Kind, pattern string) (Rule, error) {
+	rule := Rule{Kind: kind, Pattern: pattern}
+
+	switch kind {
+	case KindAddress:
+		addr, err := mail.ParseAddress(pattern)
+		if err != nil {
+			return Rule{}, fmt.Errorf("rules: invalid address %q: %w", pattern, err)
+		}
+		rule.Pattern = strings.ToLower(addr.Address)
+	case KindDomain, KindSubdomain:
+		rule.Pattern = strings.ToLower(strings.Trim(pattern, "."))
+		if rule.Pattern == "" || strings.ContainsAny(rule.Pattern, "@*/ ") {
+			return Rule{}, fmt.Errorf("rules: invalid domain %q", pattern)
+		}
+	case KindRegex:
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return Rule{}, fmt.Errorf("rules: invalid regex %q: %w", pattern, err)
+		}
+		rule.re = re
+	case KindListID:
+		rule.Pattern = ListID(pattern)
+		if rule.Pattern == "" || strings.ContainsAny(rule.Pattern, " <>") {
+			return Rule{}, fmt.Errorf("rules: invalid List-Id %q", pattern)
+		}
+	default:
+		return Rule{}, fmt.Errorf("rules: unknown rule kind %q", kind)
+	}
+
+	return rule, nil
+}
+
+// String returns the rule in the syntax accepted by Parse.
+func (r Rule) String() string {
+	switch r.Kind {
+	case KindSubdomain:
+		return "*." + r.Pattern
+	case KindRegex:
+		return "/" + r.Pattern + "/"
+	case KindListID:
+		return listIDPrefix + r.Pattern
+	}
+	return r.Pattern
+}
+
+// Match reports whether the rule covers a message from addr, a bare
+// lower-cased address, sent to the list listID (as returned by ListID, empty
+// for messages that are not from a list).
+func (r Rule) Match(addr, listID string) bool {
+	_, domain, _ := strings.Cut(addr, "@")
+
+	switch r.Kind {
+	case KindListID:
+		return listID != "" && listID == r.Pattern
+	case KindAddress:
+		return addr == r.Pattern
+	case KindDomain:
+		return domain == r.Pattern
+	case KindSubdomain:
+		return domain == r.Pattern || strings.HasSuffix(domain, "."+r.Pattern)
+	case KindRegex:
+		re := r.re
+		if re == nil {
+			// the rule was built without New, compile it for this call only
+			var err error
+			if re, err = regexp.Compile("(?i)" + r.Pattern); err != nil {
+				return false
+			}
+		}
+		return re.MatchString(addr)
+	}
+	return false
+}
+
+// Set is a list of rules for any number of inboxes.
+type Set []Rule
+
+// Match returns the first rule covering msg that applies to inboxID, either
+// directly or globally. Sender rules are matched against the From address.
+func (s Set) Match(inboxID int, msg *message.Message) (Rule, bool) {
+	addr, err := Sender(msg)
+	if err != nil {
+		addr = ""
+	}
+	listID := ListID(msg.RawHeader("List-Id"))
+
+	for _, rule := range s {
+		if rule.InboxID != GlobalInbox && rule.InboxID != inboxID {
+			continue
+		}
+		if (addr != "" || rule.Kind == KindListID) && rule.Match(addr, listID) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// ListID returns the lower-cased list identifier of a List-Id header, i.e.
+// the part between angle brackets of "Weekly News <news.example.com>".
+func ListID(header string) string {
+	if start := strings.LastIndexByte(header, '<'); start >= 0 {
+		if end := strings.IndexByte(header[start:], '>'); end > 0 {
+			header = header[start+1 : start+end]
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(header))
+}
+
+// Sender returns the lower-cased From address of msg, see Address.
+func Sender(msg *message.Message) (string, error) {
+	if addr, err := msg.From(); err == nil {
+		return strings.ToLower(addr.Address), nil
+	}
+	return Address(msg.RawHeader("From"))
+}
+
+// Address extracts the lower-cased bare address from a From header, falling
+// back to the text between angle brackets when the header is not RFC 5322 compliant.
+func Address(from string) (string, error) {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return strings.ToLower(addr.Address), nil
+	}
+
+	if start := strings.LastIndexByte(from, '<'); start >= 0 {
+		if end := strings.IndexByte(from[start:], '>'); end > 0 {
+			from = from[start+1 : start+end]
+		}
+	}
+	from = strings.ToLower(strings.TrimSpace(from))
+	if strings.Count(from, "@") != 1 || strings.ContainsAny(from, " <>") {
+		return "", errors.New("rules: no sender address found")
+	}
+	return from, nil
+}
@@ -0,0 +1,102 @@
+package rules_test
+
+import (
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/rules"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		kind    rules.Kind
+		str     string
+		invalid bool
+	}{
+		{pattern: "Alerts@Bank.com", kind: rules.KindAddress, str: "alerts@bank.com"},
+		{pattern: "Bank.com", kind: rules.KindDomain, str: "bank.com"},
+		{pattern: "*.bank.com", kind: rules.KindSubdomain, str: "*.bank.com"},
+		{pattern: "/^no-?reply@/", kind: rules.KindRegex, str: "/^no-?reply@/"},
+		{pattern: "list:<News.Example.com>", kind: rules.KindListID, str: "list:news.example.com"},
+		{pattern: "list:", invalid: true},
+		{pattern: "/[/", invalid: true},
+		{pattern: "not an address@", invalid: true},
+		{pattern: "*.", invalid: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			rule, err := rules.Parse(tc.pattern)
+			if tc.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rule.Kind != tc.kind || rule.String() != tc.str {
+				t.Errorf("expected %s rule %q, got %s rule %q", tc.kind, tc.str, rule.Kind, rule.String())
+			}
+		})
+	}
+}
+
+func TestSet_Match(t *testing.T) {
+	set := rules.Set{}
+	for _, pattern := range []string{"bank.com", "*.example.org", "/^no-?reply@/", "friend@mail.net", "list:deals.shop.com"} {
+		rule, err := rules.Parse(pattern)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		set = append(set, rule)
+	}
+	inboxRule, _ := rules.Parse("shop.com")
+	inboxRule.InboxID = 2
+	set = append(set, inboxRule)
+
+	testCases := []struct {
+		from     string
+		listID   string
+		inboxID  int
+		expected string
+	}{
+		{from: "Bank <alerts@bank.com>", inboxID: 1, expected: "bank.com"},
+		{from: "alerts@notmybank.com", inboxID: 1},
+		{from: "phish@bank.com.evil.io", inboxID: 1},
+		{from: "news@example.org", inboxID: 1, expected: "*.example.org"},
+		{from: "news@lists.example.org", inboxID: 1, expected: "*.example.org"},
+		{from: "news@badexample.org", inboxID: 1},
+		{from: "NoReply@anything.io", inboxID: 1, expected: "/^no-?reply@/"},
+		{from: "\"Friend\" <Friend@Mail.net>", inboxID: 1, expected: "friend@mail.net"},
+		{from: "deals@shop.com", inboxID: 1},
+		{from: "deals@shop.com", inboxID: 2, expected: "shop.com"},
+		{from: "broken header <deals@bank.com", inboxID: 1},
+		{from: "Weird, Name <alerts@bank.com>", inboxID: 1, expected: "bank.com"},
+		{from: "deals@mailer.io", listID: "Shop Deals <deals.shop.com>", inboxID: 1, expected: "list:deals.shop.com"},
+		{from: "not an address", listID: "<DEALS.shop.com>", inboxID: 1, expected: "list:deals.shop.com"},
+		{from: "deals@mailer.io", listID: "<other.shop.com>", inboxID: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.from, func(t *testing.T) {
+			headers := []message.Header{{Name: "From", Value: tc.from}}
+			if tc.listID != "" {
+				headers = append(headers, message.Header{Name: "List-Id", Value: tc.listID})
+			}
+
+			rule, ok := set.Match(tc.inboxID, message.NewMessage(headers, ""))
+			if tc.expected == "" {
+				if ok {
+					t.Errorf("expected no match, got %q", rule)
+				}
+				return
+			}
+			if !ok || rule.String() != tc.expected {
+				t.Errorf("expected %q to match, got %q (matched: %v)", tc.expected, rule, ok)
+			}
+		})
+	}
+}
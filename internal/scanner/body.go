@@ -0,0 +1,235 @@
+package scanner
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/unsubscriber"
+)
+
+// MethodLink is the method of results that visit a link found in a message body.
+const MethodLink = "link"
+
+// BodyScannerName is the Scanner of results from BodyScanner.
+const BodyScannerName = "body"
+
+// Keywords suggesting a link unsubscribes, lowercased. Strong keywords say so
+// outright, weak ones lead to a page where the recipient can unsubscribe.
+var (
+	strongKeywords = []string{
+		"unsubscribe", "unsub", "opt-out", "opt out", "optout", "remove me",
+		"désabonner", "désinscrire", "désinscription", "désabonnement", // French
+		"abbestellen", "abmelden", "austragen", // German
+		"darse de baja", "darte de baja", "cancelar suscripción", "cancelar la suscripción", // Spanish
+		"disiscriviti", "annulla iscrizione", "cancella iscrizione", // Italian
+		"descadastrar", "cancelar inscrição", "cancelar assinatura", // Portuguese
+		"uitschrijven", "afmelden", // Dutch
+		"avregistrera", "avsluta prenumeration", "afmeld", "meld deg av", // Scandinavian
+		"wypisz", "zrezygnuj", // Polish
+		"odhlásit",              // Czech
+		"отписаться", "отписка", // Russian
+		"abonelikten çık", // Turkish
+		"配信停止", "購読解除",    // Japanese
+		"退订", "取消订阅", "取消訂閱", // Chinese
+		"구독 취소", "수신거부", // Korean
+		"إلغاء الاشتراك", // Arabic
+	}
+	weakKeywords = []string{
+		"manage preferences", "email preferences", "update preferences", "subscription preferences",
+		"manage subscription", "manage your subscription", "notification settings",
+		"préférences", "einstellungen", "preferencias", "preferenze", "preferências", "voorkeuren",
+		"настройки рассылки",
+	}
+	strongURLKeywords = []string{"unsubscribe", "unsub", "optout", "opt-out", "opt_out"}
+	weakURLKeywords   = []string{"preferences", "subscription", "manage"}
+)
+
+// Confidence that a link unsubscribes, by where its keyword was found.
+const (
+	strongTextConfidence = 0.7
+	weakTextConfidence   = 0.4
+	strongURLConfidence  = 0.6
+	weakURLConfidence    = 0.3
+
+	// minLinkConfidence is the confidence a link needs to be a hit: at least
+	// one strong keyword. Links that only mention preferences are reported
+	// without an Unsubscribe func, as they rarely unsubscribe by themselves.
+	minLinkConfidence = strongURLConfidence
+)
+
+var (
+	reAnchor  = regexp.MustCompile(`(?is)<a\s[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))[^>]*>(.*?)</a\s*>`)
+	reTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+	reComment = regexp.MustCompile(`(?s)<!--.*?-->|<(?i:style|script)[^>]*>.*?</(?i:style|script)\s*>`)
+	reURL     = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+)
+
+// Link is a link found in a message body that may unsubscribe.
+type Link struct {
+	URL  string
+	Text string // the anchor text, or the text around a plain text URL
+
+	// Confidence is how sure FindLinks is that the link unsubscribes, from 0 to 1.
+	Confidence float64
+}
+
+// BodyScanner looks for unsubscribe links in the text/plain and text/html
+// parts of messages without a List-Unsubscribe header. Messages fetched
+// without a body are fetched again in full when the provider can do so.
+type BodyScanner struct {
+	fetcher provider.BodyFetcher
+	link    *unsubscriber.LinkUnsubscriber
+}
+
+func NewBodyScanner(p provider.Provider) *BodyScanner {
+	return &BodyScanner{provider.Fetcher(p), unsubscriber.NewLinkUnsubscriber(nil)}
+}
+
+func (bs *BodyScanner) Scan(ctx context.Context, msg *message.Message) (*ScanResult, error) {
+	// HeaderScanner handles these, and fetching their bodies would be wasted
+	if msg.RawHeader("List-Unsubscribe") != "" {
+		return &ScanResult{Reason: "has a List-Unsubscribe header", Scanner: BodyScannerName}, nil
+	}
+
+	if plain, markup := textParts(msg); len(plain) == 0 && len(markup) == 0 {
+		if bs.fetcher == nil || msg.ID() == "" {
+			return &ScanResult{Reason: "no message body", Scanner: BodyScannerName}, nil
+		}
+
+		full, err := bs.fetcher.FetchMessage(ctx, msg.ID())
+		if err != nil {
+			return nil, fmt.Errorf("error fetching message body: %w", err)
+		}
+		msg = full
+	}
+
+	links := FindLinks(msg)
+	if len(links) == 0 {
+		return &ScanResult{Reason: "no unsubscribe link in body", Scanner: BodyScannerName}, nil
+	}
+
+	best := links[0]
+	if best.Confidence < minLinkConfidence {
+		reason := fmt.Sprintf("link %q in body may only lead to preferences", cmp.Or(best.Text, best.URL))
+		return &ScanResult{Reason: reason, Method: MethodLink, Target: best.URL, Scanner: BodyScannerName, Confidence: best.Confidence}, nil
+	}
+
+	target, err := url.Parse(best.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing unsubscribe link: %w", err)
+	}
+
+	link := bs.link
+	if link == nil {
+		link = unsubscriber.NewLinkUnsubscriber(nil)
+	}
+	unsubscribeFunc := func(ctx context.Context) error {
+		return link.Visit(ctx, target)
+	}
+
+	reason := fmt.Sprintf("found unsubscribe link %q in body", cmp.Or(best.Text, best.URL))
+	return &ScanResult{true, unsubscribeFunc, reason, MethodLink, best.URL, BodyScannerName, best.Confidence}, nil
+}
+
+// FindLinks returns the http(s) links in the text parts of msg whose text or
+// URL suggests they unsubscribe, most likely first.
+func FindLinks(msg *message.Message) []Link {
+	var links []Link
+	add := func(rawURL, text string) {
+		rawURL = strings.TrimSpace(html.UnescapeString(rawURL))
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return
+		}
+
+		confidence := linkConfidence(strings.ToLower(text), strings.ToLower(rawURL))
+		if confidence == 0 {
+			return
+		}
+
+		i := slices.IndexFunc(links, func(l Link) bool { return l.URL == rawURL })
+		if i < 0 {
+			links = append(links, Link{rawURL, text, confidence})
+		} else if confidence > links[i].Confidence {
+			links[i].Text, links[i].Confidence = text, confidence
+		}
+	}
+
+	plain, htmlParts := textParts(msg)
+	for _, part := range htmlParts {
+		part = reComment.ReplaceAllString(part, "")
+		for _, match := range reAnchor.FindAllStringSubmatch(part, -1) {
+			add(match[1]+match[2]+match[3], collapseSpace(html.UnescapeString(reTag.ReplaceAllString(match[4], " "))))
+		}
+	}
+	for _, part := range plain {
+		lines := strings.Split(part, "\n")
+		for i, line := range lines {
+			for _, loc := range reURL.FindAllStringIndex(line, -1) {
+				// the text of a plain text link is usually before it, on the
+				// same line or the one above
+				text := line[:loc[0]]
+				if i > 0 {
+					text = lines[i-1] + " " + text
+				}
+				add(strings.TrimRight(line[loc[0]:loc[1]], ".,;:!?"), collapseSpace(text))
+			}
+		}
+	}
+
+	slices.SortStableFunc(links, func(a, b Link) int { return cmp.Compare(b.Confidence, a.Confidence) })
+	return links
+}
+
+// linkConfidence combines the confidence of the keywords found in the
+// lowercased text and URL of a link, or returns 0 if neither has any.
+func linkConfidence(text, rawURL string) float64 {
+	contains := func(s string, keywords []string) bool {
+		return slices.ContainsFunc(keywords, func(k string) bool { return strings.Contains(s, k) })
+	}
+
+	missed := 1.0
+	switch {
+	case contains(text, strongKeywords):
+		missed *= 1 - strongTextConfidence
+	case contains(text, weakKeywords):
+		missed *= 1 - weakTextConfidence
+	}
+	switch {
+	case contains(rawURL, strongURLKeywords):
+		missed *= 1 - strongURLConfidence
+	case contains(rawURL, weakURLKeywords):
+		missed *= 1 - weakURLConfidence
+	}
+	return 1 - missed
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// textParts returns the text/plain and text/html parts of msg that are not
+// attachments or empty, converted to UTF-8.
+func textParts(msg *message.Message) (plain, markup []string) {
+	for _, part := range msg.Root().All() {
+		if part.IsAttachment() || len(part.Body) == 0 || part.ContentType != "text/plain" && part.ContentType != "text/html" {
+			continue
+		}
+		// Text returns the best it can for unsupported charsets
+		text, _ := part.Text()
+		if part.ContentType == "text/html" {
+			markup = append(markup, text)
+		} else {
+			plain = append(plain, text)
+		}
+	}
+	return plain, markup
+}
@@ -0,0 +1,195 @@
+package scanner_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/scanner"
+)
+
+func bodyMessage(contentType, body string, extra ...message.Header) *message.Message {
+	headers := []message.Header{
+		{Name: "From", Value: "news@example.com"},
+		{Name: "Content-Type", Value: contentType},
+	}
+	return message.NewMessage(append(headers, extra...), body)
+}
+
+const multipartBody = "--b1\r\n" +
+	"Content-Type: multipart/alternative; boundary=b2\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Pour vous d=C3=A9sabonner, cliquez ici :\r\n" +
+	"https://example.com/l?id=3D42\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PGEgaHJlZj0iaHR0cHM6Ly9leGFtcGxlLmNvbS9wcmVmcyI+RW1haWwgcHJlZmVyZW5jZXM8L2E+\r\n" +
+	"--b2--\r\n" +
+	"--b1\r\n" +
+	"Content-Type: image/png\r\n" +
+	"\r\n" +
+	"https://example.com/unsubscribe-in-an-image\r\n" +
+	"--b1--\r\n"
+
+func TestFindLinks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      *message.Message
+		expected []string
+	}{
+		{
+			name: "html anchors",
+			msg: bodyMessage("text/html", `<p>Read <a href="https://example.com/post">more</a>.</p>
+				<!-- <a href="https://example.com/commented/unsubscribe">x</a> -->
+				<a class="footer" href='https://example.com/u?a=1&amp;b=2'><span>Unsubscribe</span></a>
+				<a href="https://example.com/preferences">Settings</a>
+				<a href="mailto:leave@example.com">unsubscribe by mail</a>`),
+			expected: []string{"https://example.com/u?a=1&b=2", "https://example.com/preferences"},
+		},
+		{
+			name: "plain text",
+			msg: bodyMessage("text/plain", "Thanks for reading.\nhttps://example.com/about\n\n"+
+				"Don't want these emails? Opt out:\nhttps://example.com/o/abc.\n"),
+			expected: []string{"https://example.com/o/abc"},
+		},
+		{
+			name:     "nested multipart",
+			msg:      bodyMessage(`multipart/mixed; boundary="b1"`, multipartBody),
+			expected: []string{"https://example.com/l?id=42", "https://example.com/prefs"},
+		},
+		{
+			name:     "multilingual",
+			msg:      bodyMessage("text/html; charset=utf-8", `<a href="https://example.jp/x">配信停止はこちら</a> <a href="https://example.de/y">Newsletter abbestellen</a>`),
+			expected: []string{"https://example.jp/x", "https://example.de/y"},
+		},
+		{
+			name:     "no links",
+			msg:      bodyMessage("text/plain", "Lunch on Friday?"),
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			links := scanner.FindLinks(tc.msg)
+			urls := make([]string, len(links))
+			for i, link := range links {
+				urls[i] = link.URL
+			}
+			if len(urls) != len(tc.expected) {
+				t.Fatalf("expected links %q, got %q", tc.expected, urls)
+			}
+			for i := range urls {
+				if urls[i] != tc.expected[i] {
+					t.Errorf("expected links %q, got %q", tc.expected, urls)
+				}
+			}
+			for i := 1; i < len(links); i++ {
+				if links[i].Confidence > links[i-1].Confidence {
+					t.Errorf("expected links sorted by confidence, got %+v", links)
+				}
+			}
+		})
+	}
+}
+
+// fetchingProvider serves complete messages from FetchMessage.
+type fetchingProvider struct {
+	messages map[string]*message.Message
+	fetched  []string
+}
+
+func (f *fetchingProvider) GetMail(context.Context) iter.Seq[message.Message] {
+	return iter.FromSlice[message.Message](nil)
+}
+
+func (f *fetchingProvider) Send(context.Context, string, string, string) error { return nil }
+
+func (f *fetchingProvider) FetchMessage(_ context.Context, id string) (*message.Message, error) {
+	f.fetched = append(f.fetched, id)
+	msg, ok := f.messages[id]
+	if !ok {
+		return nil, provider.ErrNotFound
+	}
+	return msg, nil
+}
+
+func TestBodyScanner_Scan(t *testing.T) {
+	full := bodyMessage("text/html", `<a href="https://example.com/unsubscribe?u=1">Unsubscribe</a>`)
+	p := &fetchingProvider{messages: map[string]*message.Message{"42": full}}
+	bs := scanner.NewBodyScanner(p)
+	ctx := context.Background()
+
+	t.Run("fetches the body", func(t *testing.T) {
+		msg := message.NewMessage([]message.Header{{Name: "From", Value: "news@example.com"}}, "")
+		msg.SetID("42")
+
+		result, err := bs.Scan(ctx, msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Hit || result.Method != scanner.MethodLink || result.Target != "https://example.com/unsubscribe?u=1" || result.Scanner != scanner.BodyScannerName {
+			t.Errorf("expected a link hit, got %+v", result)
+		}
+		if result.Confidence <= 0 || result.Confidence >= 1 {
+			t.Errorf("expected a confidence below one-click, got %v", result.Confidence)
+		}
+	})
+
+	t.Run("preferences link is not a hit", func(t *testing.T) {
+		msg := bodyMessage("text/html", `<a href="https://example.com/preferences?u=1">Manage preferences</a>`)
+
+		result, err := bs.Scan(ctx, msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Hit || result.Unsubscribe != nil || result.Target != "https://example.com/preferences?u=1" {
+			t.Errorf("expected a non-hit candidate, got %+v", result)
+		}
+
+		pipeline, err := scanner.NewPipeline(p, func(name string) bool { return name == scanner.BodyScannerName })
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result, err := pipeline.Scan(ctx, msg); err != nil || result.Hit {
+			t.Errorf("expected the pipeline to miss, got %+v, %v", result, err)
+		}
+	})
+
+	t.Run("skips List-Unsubscribe messages", func(t *testing.T) {
+		p.fetched = nil
+		msg := message.NewMessage([]message.Header{{Name: "List-Unsubscribe", Value: "<mailto:leave@example.com>"}}, "")
+		msg.SetID("42")
+
+		result, err := bs.Scan(ctx, msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Hit || len(p.fetched) != 0 {
+			t.Errorf("expected no hit and no fetch, got %+v after fetching %q", result, p.fetched)
+		}
+	})
+
+	t.Run("fetch error", func(t *testing.T) {
+		msg := message.NewMessage(nil, "")
+		msg.SetID("gone")
+		if _, err := bs.Scan(ctx, msg); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("no fetcher", func(t *testing.T) {
+		result, err := scanner.NewBodyScanner(nil).Scan(ctx, message.NewMessage(nil, ""))
+		if err != nil || result.Hit {
+			t.Errorf("expected no hit, got %+v, %v", result, err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/rules"
+)
+
+// maxSampleSubjects is the number of distinct subjects a Candidate keeps.
+const maxSampleSubjects = 3
+
+// methodRank orders unsubscribe methods from least to most preferred.
+var methodRank = map[string]int{
+	MethodMailto:   1,
+	MethodOneClick: 2,
+}
+
+// Candidate is every message of one mailing list found in an inbox, with the
+// best way found to unsubscribe from it.
+type Candidate struct {
+	Key    string // ListID, or Sender for messages not sent to a list
+	ListID string // RFC 2919 list identifier, see rules.ListID
+	Sender string // From address of the first message
+
+	Count    int
+	First    time.Time // Date of the oldest message, zero if no message had a valid Date
+	Last     time.Time // Date of the newest message
+	Subjects []string  // sample of distinct subjects, in the order they were found
+	Methods  []string  // every unsubscribe method found, in the order they were found
+
+	Messages []*message.Message
+	Message  *message.Message // the message Result unsubscribes with, nil until a scanner hit
+	Result   *ScanResult
+
+	resultDate time.Time
+}
+
+// CandidateKey returns the key messages are grouped by: the List-Id when the
+// message has one, falling back to the sender address.
+func CandidateKey(msg *message.Message) string {
+	if listID := rules.ListID(msg.RawHeader("List-Id")); listID != "" {
+		return listID
+	}
+	if addr, err := rules.Sender(msg); err == nil {
+		return addr
+	}
+	return strings.ToLower(strings.TrimSpace(msg.GetHeader("From")))
+}
+
+// Add counts msg towards the candidate. result, which may be nil, replaces the
+// candidate's Result when it is a hit using a preferred method, or the same
+// method from a newer message.
+func (c *Candidate) Add(msg *message.Message, result *ScanResult) {
+	if c.Count == 0 {
+		c.Key = CandidateKey(msg)
+		c.ListID = rules.ListID(msg.RawHeader("List-Id"))
+		c.Sender, _ = rules.Sender(msg)
+	}
+	c.Count++
+	c.Messages = append(c.Messages, msg)
+
+	date, _ := mail.ParseDate(msg.GetHeader("Date"))
+	if !date.IsZero() {
+		if c.First.IsZero() || date.Before(c.First) {
+			c.First = date
+		}
+		if date.After(c.Last) {
+			c.Last = date
+		}
+	}
+
+	subject := strings.TrimSpace(msg.GetHeader("Subject"))
+	if subject != "" && len(c.Subjects) < maxSampleSubjects && !slices.Contains(c.Subjects, subject) {
+		c.Subjects = append(c.Subjects, subject)
+	}
+
+	if result != nil && result.Hit && result.Method != "" && !slices.Contains(c.Methods, result.Method) {
+		c.Methods = append(c.Methods, result.Method)
+	}
+
+	if betterResult(result, date, c.Result, c.resultDate) {
+		c.Message, c.Result, c.resultDate = msg, result, date
+	}
+}
+
+func betterResult(result *ScanResult, date time.Time, current *ScanResult, currentDate time.Time) bool {
+	if result == nil || !result.Hit {
+		return false
+	}
+	if current == nil || !current.Hit {
+		return true
+	}
+
+	rank, currentRank := methodRank[result.Method], methodRank[current.Method]
+	if rank != currentRank {
+		return rank > currentRank
+	}
+	return date.After(currentDate)
+}
@@ -0,0 +1,77 @@
+package scanner_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/scanner"
+)
+
+func newsletter(date, subject string, extra ...message.Header) *message.Message {
+	headers := []message.Header{
+		{Name: "From", Value: "Weekly News <News@Example.com>"},
+		{Name: "Date", Value: date},
+		{Name: "Subject", Value: subject},
+	}
+	return message.NewMessage(append(headers, extra...), "")
+}
+
+func TestCandidateKey(t *testing.T) {
+	testCases := []struct {
+		name     string
+		headers  []message.Header
+		expected string
+	}{
+		{"list id", []message.Header{{Name: "From", Value: "a@example.com"}, {Name: "List-Id", Value: "Weekly <Weekly.Example.com>"}}, "weekly.example.com"},
+		{"sender address", []message.Header{{Name: "From", Value: "Alerts <Alerts@Bank.com>"}}, "alerts@bank.com"},
+		{"unparsable sender", []message.Header{{Name: "From", Value: "Nobody"}}, "nobody"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if key := scanner.CandidateKey(message.NewMessage(tc.headers, "")); key != tc.expected {
+				t.Errorf("expected key %q, got %q", tc.expected, key)
+			}
+		})
+	}
+}
+
+func TestCandidate_Add(t *testing.T) {
+	mailto := &scanner.ScanResult{Hit: true, Method: scanner.MethodMailto, Target: "mailto:old@example.com"}
+	newerMailto := &scanner.ScanResult{Hit: true, Method: scanner.MethodMailto, Target: "mailto:new@example.com"}
+	oneClick := &scanner.ScanResult{Hit: true, Method: scanner.MethodOneClick, Target: "https://example.com/leave"}
+
+	c := &scanner.Candidate{}
+	c.Add(newsletter("Mon, 02 Jan 2006 15:04:05 +0000", "Issue 1"), mailto)
+	c.Add(newsletter("Mon, 09 Jan 2006 15:04:05 +0000", "Issue 2"), newerMailto)
+	c.Add(newsletter("Sun, 01 Jan 2006 15:04:05 +0000", "Issue 0"), oneClick)
+	c.Add(newsletter("Tue, 10 Jan 2006 15:04:05 +0000", "Issue 2"), newerMailto)
+	c.Add(newsletter("not a date", "Issue 3"), nil)
+
+	if c.Key != "news@example.com" || c.Sender != "news@example.com" || c.ListID != "" {
+		t.Errorf("expected candidate for news@example.com, got key %q sender %q list %q", c.Key, c.Sender, c.ListID)
+	}
+	if c.Count != 5 || len(c.Messages) != 5 {
+		t.Errorf("expected 5 messages, got %d", c.Count)
+	}
+	if c.First.Day() != 1 || c.Last.Day() != 10 {
+		t.Errorf("expected messages from Jan 1 to Jan 10, got %s to %s", c.First, c.Last)
+	}
+	if expected := []string{"Issue 1", "Issue 2", "Issue 0"}; !slices.Equal(c.Subjects, expected) {
+		t.Errorf("expected sample subjects %q, got %q", expected, c.Subjects)
+	}
+	if expected := []string{"mailto", "one-click"}; !slices.Equal(c.Methods, expected) {
+		t.Errorf("expected methods %q, got %q", expected, c.Methods)
+	}
+	if c.Result != oneClick {
+		t.Errorf("expected one-click to be the best method, got %+v", c.Result)
+	}
+
+	c = &scanner.Candidate{}
+	c.Add(newsletter("Mon, 02 Jan 2006 15:04:05 +0000", "Issue 1"), mailto)
+	c.Add(newsletter("Mon, 09 Jan 2006 15:04:05 +0000", "Issue 2"), newerMailto)
+	if c.Result != newerMailto {
+		t.Errorf("expected the newest message's link for the same method, got %+v", c.Result)
+	}
+}
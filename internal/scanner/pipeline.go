@@ -0,0 +1,142 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+)
+
+// Factory creates a scanner for an inbox. p is the inbox's provider, which
+// scanners use to send mailto: unsubscribe requests.
+type Factory func(p provider.Provider) Scanner
+
+type registered struct {
+	name    string
+	factory Factory
+	enabled bool // whether the scanner runs unless configured otherwise
+}
+
+// registry holds every scanner a Pipeline can run, in the order they run.
+var registry = []registered{
+	{HeaderScannerName, func(p provider.Provider) Scanner { return NewHeaderScanner(p) }, true},
+	// fetching message bodies is slow on most providers, so looking for links
+	// in them is opt-in
+	{BodyScannerName, func(p provider.Provider) Scanner { return NewBodyScanner(p) }, false},
+}
+
+// Register adds a scanner to the registry under name, replacing any scanner
+// registered under the same name. enabled is whether it runs when an inbox does
+// not configure it. It is meant to be called from init functions.
+func Register(name string, factory Factory, enabled bool) {
+	for i := range registry {
+		if registry[i].name == name {
+			registry[i].factory, registry[i].enabled = factory, enabled
+			return
+		}
+	}
+	registry = append(registry, registered{name, factory, enabled})
+}
+
+// EnabledByDefault reports whether the scanner registered under name runs when
+// an inbox does not configure it.
+func EnabledByDefault(name string) bool {
+	for _, r := range registry {
+		if r.name == name {
+			return r.enabled
+		}
+	}
+	return false
+}
+
+// Names returns the names of the registered scanners in the order they run.
+func Names() []string {
+	names := make([]string, len(registry))
+	for i, r := range registry {
+		names[i] = r.name
+	}
+	return names
+}
+
+// Pipeline runs several scanners on each message and merges their results.
+// A Pipeline is itself a Scanner.
+type Pipeline struct {
+	names    []string
+	scanners []Scanner
+}
+
+// NewPipeline creates every registered scanner for which enabled returns
+// true, or every scanner enabled by default if enabled is nil. It fails if no
+// scanner is enabled.
+func NewPipeline(p provider.Provider, enabled func(name string) bool) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	for _, r := range registry {
+		if enabled == nil && !r.enabled || enabled != nil && !enabled(r.name) {
+			continue
+		}
+		pipeline.names = append(pipeline.names, r.name)
+		pipeline.scanners = append(pipeline.scanners, r.factory(p))
+	}
+
+	if len(pipeline.scanners) == 0 {
+		return nil, fmt.Errorf("scanner: no scanner enabled, expected at least one of %s", strings.Join(Names(), ", "))
+	}
+	return pipeline, nil
+}
+
+// Names returns the names of the scanners the pipeline runs.
+func (p *Pipeline) Names() []string {
+	return slices.Clone(p.names)
+}
+
+// Scan runs every scanner on msg. When several hit, the result of the most
+// confident one is used to unsubscribe, the reasons of all of them are joined
+// and their confidence is combined, so that independent scanners agreeing
+// raise it. A scanner that fails is logged and skipped; Scan only fails when
+// all of them do.
+func (p *Pipeline) Scan(ctx context.Context, msg *message.Message) (*ScanResult, error) {
+	var (
+		best    *ScanResult
+		reasons []string
+		errs    []error
+		missed  = 1.0 // probability that every hit is wrong
+	)
+
+	for i, s := range p.scanners {
+		result, err := s.Scan(ctx, msg)
+		if err != nil {
+			log.Printf("scanner %s: %s", p.names[i], err)
+			errs = append(errs, fmt.Errorf("scanner %s: %w", p.names[i], err))
+			continue
+		}
+		if result.Scanner == "" {
+			result.Scanner = p.names[i]
+		}
+		if !result.Hit {
+			continue
+		}
+
+		reasons = append(reasons, result.Reason)
+		missed *= 1 - result.Confidence
+		if best == nil || result.Confidence > best.Confidence {
+			best = result
+		}
+	}
+
+	if len(errs) == len(p.scanners) {
+		return nil, errors.Join(errs...)
+	}
+	if best == nil {
+		return &ScanResult{Reason: "no scanner found a way to unsubscribe"}, nil
+	}
+
+	merged := *best
+	merged.Reason = strings.Join(reasons, "; ")
+	merged.Confidence = 1 - missed
+	return &merged, nil
+}
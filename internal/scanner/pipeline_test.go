@@ -0,0 +1,111 @@
+package scanner_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/scanner"
+)
+
+// fixedScanner returns the same result or error for every message.
+type fixedScanner struct {
+	result *scanner.ScanResult
+	err    error
+}
+
+func (f *fixedScanner) Scan(context.Context, *message.Message) (*scanner.ScanResult, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	result := *f.result
+	return &result, nil
+}
+
+func TestPipeline(t *testing.T) {
+	guess := &fixedScanner{result: &scanner.ScanResult{Hit: true, Reason: "looks like a newsletter", Method: "guess", Confidence: 0.5}}
+	broken := &fixedScanner{err: errors.New("broken")}
+	scanner.Register("test-guess", func(provider.Provider) scanner.Scanner { return guess }, true)
+	scanner.Register("test-broken", func(provider.Provider) scanner.Scanner { return broken }, false)
+
+	msg := message.NewMessage(
+		[]message.Header{
+			{Name: "From", Value: "news@example.com"},
+			{Name: "List-Unsubscribe", Value: "<mailto:leave@example.com>"},
+		},
+		"",
+	)
+	only := func(names ...string) func(string) bool {
+		return func(name string) bool { return slices.Contains(names, name) }
+	}
+
+	t.Run("registry order", func(t *testing.T) {
+		names := scanner.Names()
+		if names[0] != scanner.HeaderScannerName || !slices.Contains(names, "test-guess") {
+			t.Errorf("expected the header scanner first and test scanners registered, got %q", names)
+		}
+	})
+
+	t.Run("default scanners", func(t *testing.T) {
+		pipeline, err := scanner.NewPipeline(nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		names := pipeline.Names()
+		if !slices.Contains(names, "test-guess") || slices.Contains(names, "test-broken") || slices.Contains(names, scanner.BodyScannerName) {
+			t.Errorf("expected only scanners enabled by default, got %q", names)
+		}
+	})
+
+	t.Run("most confident result wins", func(t *testing.T) {
+		pipeline, err := scanner.NewPipeline(nil, only(scanner.HeaderScannerName, "test-guess", "test-broken"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		result, err := pipeline.Scan(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Hit || result.Method != scanner.MethodMailto || result.Scanner != scanner.HeaderScannerName {
+			t.Errorf("expected the header scanner's mailto result, got %+v", result)
+		}
+		if result.Reason != "matched List-Unsubscribe header; looks like a newsletter" {
+			t.Errorf("expected reasons of both hits, got %q", result.Reason)
+		}
+		if result.Confidence < 0.94 || result.Confidence > 0.96 {
+			t.Errorf("expected combined confidence 0.95, got %v", result.Confidence)
+		}
+	})
+
+	t.Run("disabled scanners do not run", func(t *testing.T) {
+		pipeline, err := scanner.NewPipeline(nil, only("test-guess"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if names := pipeline.Names(); !slices.Equal(names, []string{"test-guess"}) {
+			t.Errorf("expected only test-guess, got %q", names)
+		}
+
+		result, _ := pipeline.Scan(context.Background(), msg)
+		if result.Method != "guess" || result.Scanner != "test-guess" {
+			t.Errorf("expected the guess, got %+v", result)
+		}
+	})
+
+	t.Run("fails when every scanner fails", func(t *testing.T) {
+		pipeline, _ := scanner.NewPipeline(nil, only("test-broken"))
+		if _, err := pipeline.Scan(context.Background(), msg); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("no scanner enabled", func(t *testing.T) {
+		if _, err := scanner.NewPipeline(nil, only()); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
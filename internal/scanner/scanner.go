@@ -2,107 +2,84 @@
 package scanner
 
 import (
-	"errors"
-	"log"
-	"net/url"
-	"regexp"
+	"context"
 
 	"github.com/usrbinsam/go-away/internal/message"
 	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/unsubscriber"
 )
 
-type UnsubscribeFunc func() error
+type UnsubscribeFunc func(ctx context.Context) error
+
+// Unsubscribe methods reported in ScanResult.Method.
+const (
+	MethodOneClick = "one-click"
+	MethodMailto   = "mailto"
+)
 
 type ScanResult struct {
 	Hit         bool
 	Unsubscribe UnsubscribeFunc
 	Reason      string
+
+	Method  string // how Unsubscribe unsubscribes, e.g. MethodOneClick
+	Target  string // the URI Unsubscribe sends its request to
+	Scanner string // name of the scanner that produced the result
+
+	// Confidence is how sure the scanner is that Unsubscribe unsubscribes
+	// from the list, from 0 to 1.
+	Confidence float64
 }
 
 type Scanner interface {
-	Scan(*message.Message) (*ScanResult, error)
+	Scan(context.Context, *message.Message) (*ScanResult, error)
 }
 
-var reListUnsubsbscribe = regexp.MustCompile(`<([^>]+)>`)
+// HeaderScannerName is the Scanner of results from HeaderScanner.
+const HeaderScannerName = "header"
 
 type HeaderScanner struct {
 	provider provider.Provider
+	oneClick unsubscriber.Unsubscriber
 }
 
 func NewHeaderScanner(provider provider.Provider) *HeaderScanner {
-	return &HeaderScanner{provider}
+	return &HeaderScanner{provider, unsubscriber.NewOneClickUnsubscriber(nil)}
 }
 
-func (hs *HeaderScanner) Scan(message *message.Message) (*ScanResult, error) {
-	for _, name := range []string{"list-unsubscribe", "list-unsubscribe-post"} {
-		value := message.GetHeader(name)
-		if value == "" {
-			continue
-		}
-
-		to, subject, body, err := hs.getUnsubscribeTarget(value)
-		if err != nil {
-			return nil, err
+// Scan prefers RFC 8058 one-click unsubscription when the message advertises it
+// with List-Unsubscribe-Post, falling back to a mailto: List-Unsubscribe.
+func (hs *HeaderScanner) Scan(ctx context.Context, message *message.Message) (*ScanResult, error) {
+	if target, err := unsubscriber.OneClickTarget(message); err == nil {
+		oneClick := hs.oneClick
+		if oneClick == nil {
+			oneClick = unsubscriber.NewOneClickUnsubscriber(nil)
 		}
 
-		unsubscribeFunc := func() error {
-			return hs.provider.Send(to, subject, body)
+		unsubscribeFunc := func(ctx context.Context) error {
+			return oneClick.Unsubscribe(ctx, message)
 		}
 
-		return &ScanResult{true, unsubscribeFunc, "matched List-Unsubscribe header"}, nil
+		return &ScanResult{true, unsubscribeFunc, "matched List-Unsubscribe-Post one-click header", MethodOneClick, target.String(), HeaderScannerName, 1}, nil
 	}
-	return &ScanResult{false, nil, "no matching List-Unsubscribe header"}, nil
-}
 
-func (hs *HeaderScanner) getUnsubscribeTarget(listUnsubscribe string) (to, subject, body string, err error) {
-	matches := reListUnsubsbscribe.FindAllStringSubmatch(listUnsubscribe, -1)
-
-	for _, match := range matches {
-		if len(match) != 2 {
-			log.Print("List-Unsubscribe header does not match expected format: " + listUnsubscribe)
+	for _, name := range []string{"list-unsubscribe", "list-unsubscribe-post"} {
+		value := message.RawHeader(name)
+		if value == "" {
 			continue
 		}
 
-		to, subject, body, err = tryParse(match[1])
+		to, subject, body, err := unsubscriber.ParseMailto(value)
 		if err != nil {
-			log.Printf("error parsing List-Unsubscribe value '%s': %v", match[1], err)
-			continue
+			// https-only headers without List-Unsubscribe-Post are common, and not an error
+			return &ScanResult{Reason: "no usable mailto: List-Unsubscribe: " + err.Error(), Scanner: HeaderScannerName}, nil
 		}
 
-		return
-	}
-	err = errors.New("couldn't find a usable List-Unsubscribe. see logs for details")
-	return
-}
-
-func tryParse(listUnsubscribeValue string) (to, subject, body string, err error) {
-	u, err := url.Parse(listUnsubscribeValue)
-	if err != nil {
-		return
-	}
-
-	if u.Scheme != "mailto" {
-		err = errors.New("only mailto scheme is supported for List-Unsubscribe")
-		return
-	}
-
-	params := u.Query()
-	to = u.Opaque
-	body = params.Get("body")
-	subject = params.Get("subject")
-
-	if to == "" {
-		err = errors.New("expected opaque URI data")
-		return
-	}
-
-	if body == "" {
-		body = "Please unsubscribe me from this mailing list."
-	}
+		unsubscribeFunc := func(ctx context.Context) error {
+			return hs.provider.Send(ctx, to, subject, body)
+		}
 
-	if subject == "" {
-		subject = "Unsubscribe Request"
+		return &ScanResult{true, unsubscribeFunc, "matched List-Unsubscribe header", MethodMailto, "mailto:" + to, HeaderScannerName, 0.9}, nil
 	}
-
-	return
+	return &ScanResult{Reason: "no matching List-Unsubscribe header", Scanner: HeaderScannerName}, nil
 }
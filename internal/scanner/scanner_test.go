@@ -1,6 +1,7 @@
 package scanner_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/usrbinsam/go-away/internal/message"
@@ -30,7 +31,7 @@ func TestHeaderScanner_ScanMatch(t *testing.T) {
 	)
 
 	scanner := &scanner.HeaderScanner{}
-	result, err := scanner.Scan(v)
+	result, err := scanner.Scan(context.Background(), v)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -48,7 +49,7 @@ func TestHeaderScanner_ScanNoMatch(t *testing.T) {
 	)
 
 	scanner := &scanner.HeaderScanner{}
-	result, err := scanner.Scan(v)
+	result, err := scanner.Scan(context.Background(), v)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -56,3 +57,67 @@ func TestHeaderScanner_ScanNoMatch(t *testing.T) {
 		t.Errorf("message should not be unsubscribe-able, but it was")
 	}
 }
+
+func TestHeaderScanner_ScanPrefersOneClick(t *testing.T) {
+	v := message.NewMessage(
+		[]message.Header{
+			{Name: "From", Value: "foo@example.com"},
+			{Name: "List-Unsubscribe", Value: "<mailto:leave@example.com>, <https://example.com/unsubscribe?id=42>"},
+			{Name: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"},
+		},
+		"Click nowhere to unsubscribe.",
+	)
+
+	scanner := &scanner.HeaderScanner{}
+	result, err := scanner.Scan(context.Background(), v)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if !result.Hit {
+		t.Errorf("expected message to be unsubscribe-able, but it was not")
+	}
+	if result.Reason != "matched List-Unsubscribe-Post one-click header" {
+		t.Errorf("expected one-click to be preferred, got reason: %q", result.Reason)
+	}
+	if result.Method != "one-click" || result.Target != "https://example.com/unsubscribe?id=42" {
+		t.Errorf("expected one-click target, got %s %s", result.Method, result.Target)
+	}
+}
+
+func TestHeaderScanner_ScanRejectsLineBreaks(t *testing.T) {
+	v := message.NewMessage(
+		[]message.Header{
+			{Name: "From", Value: "foo@example.com"},
+			{Name: "List-Unsubscribe", Value: "<mailto:list@example.com?subject=hi%0D%0ABcc:%20victim@example.com>"},
+		},
+		"",
+	)
+
+	if result, err := (&scanner.HeaderScanner{}).Scan(context.Background(), v); err != nil || result.Hit {
+		t.Errorf("expected a miss for a CRLF in the subject, got %+v (err: %v)", result, err)
+	}
+}
+
+func TestHeaderScanner_ScanUnusableHeader(t *testing.T) {
+	for _, value := range []string{
+		"<https://example.com/unsubscribe?id=42>",
+		"<mailto:>",
+	} {
+		v := message.NewMessage(
+			[]message.Header{
+				{Name: "From", Value: "foo@example.com"},
+				{Name: "List-Unsubscribe", Value: value},
+			},
+			"",
+		)
+
+		result, err := (&scanner.HeaderScanner{}).Scan(context.Background(), v)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", value, err)
+			continue
+		}
+		if result.Hit || result.Reason == "" {
+			t.Errorf("%s: expected a miss with a reason, got %+v", value, result)
+		}
+	}
+}
@@ -1,48 +1,135 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/rules"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
 
-	_ "modernc.org/sqlite"
+// Errors returned by SQLStore are wrapped around one of these where the cause
+// is known.
+var (
+	// ErrNotFound means the inbox an operation refers to does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrBusy means another process kept the database locked for longer than
+	// the busy timeout, e.g. a second scan of the same database.
+	ErrBusy = errors.New("database is busy")
 )
 
+// defaultPragmas are applied to every connection unless the DSN given to Open
+// sets them itself. A writer waits up to busy_timeout milliseconds for another
+// to finish before failing with ErrBusy.
+var defaultPragmas = []string{"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"}
+
 type Store interface {
 	Open(db string) error
-	RecordUnsubscribe(messageID, listID, recipient string)
-	Unsubscribed(listID, recipient string) bool
-	MarkSeen(messageID, recipient string) string
-	Seen(messageID, recipient string) bool
+	RecordUnsubscribe(ctx context.Context, messageID, listID, recipient string) error
+	RecordAttempt(ctx context.Context, u Unsubscribe) error
+	Unsubscribed(ctx context.Context, listID, recipient string) (bool, error)
+	MarkSeen(ctx context.Context, inboxID int, providerID, messageID string) error
+	Seen(ctx context.Context, inboxID int, providerID, messageID string) (bool, error)
 }
 
 type SQLStore struct {
 	db *sql.DB
 }
 
+// Open opens the database at the path or DSN db, creating and migrating its
+// tables. The DSN may set its own pragmas, e.g. "go-away.sqlite3?_pragma=busy_timeout(100)".
 func (ss *SQLStore) Open(db string) error {
 	var err error
-	ss.db, err = sql.Open("sqlite", db)
+	ss.db, err = sql.Open("sqlite", withPragmas(db))
 	if err != nil {
 		return err
 	}
 
-	ss.createAll()
+	if err := ss.createAll(); err != nil {
+		return err
+	}
 	return ss.db.Ping()
 }
 
-func (ss *SQLStore) createAll() {
+func (ss *SQLStore) Close() error {
+	return ss.db.Close()
+}
+
+// withPragmas adds the defaultPragmas that dsn does not set to it.
+func withPragmas(dsn string) string {
+	for _, pragma := range defaultPragmas {
+		name, _, _ := strings.Cut(pragma, "(")
+		if strings.Contains(dsn, "_pragma="+name+"(") {
+			continue
+		}
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_pragma=" + pragma
+	}
+	return dsn
+}
+
+// dbError wraps err around ErrBusy or ErrNotFound when sqlite reports a
+// locked database or a reference to a missing inbox.
+func dbError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch code := sqliteErr.Code(); {
+	case code&0xff == sqlite3.SQLITE_BUSY, code&0xff == sqlite3.SQLITE_LOCKED:
+		return fmt.Errorf("%w: %w", ErrBusy, err)
+	case code == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+func (ss *SQLStore) createAll() error {
 	ddl := `
 create table if not exists unsubscribes (
 	id integer primary key autoincrement,
 	ts timestamp default current_timestamp,
 	message_id text not null,
 	list_id text not null,
-	recipient text not null
+	recipient text not null,
+	method text not null default '',
+	target text not null default '',
+	status text not null default 'ok',
+	error text not null default ''
 );
 create table if not exists seen (
 	id integer primary key autoincrement,
 	ts timestamp default current_timestamp,
 	message_id text not null,
-	recipient text not null
+	recipient text not null,
+	inbox_id integer not null default 0,
+	provider_id text not null default ''
+);
+create table if not exists blocklist_rules (
+	id integer primary key autoincrement,
+	inbox_id integer not null default 0,
+	kind text not null,
+	pattern text not null,
+	unique(inbox_id, kind, pattern)
+);
+create table if not exists decisions (
+	inbox_id integer not null,
+	list_key text not null,
+	decision text not null,
+	ts timestamp default current_timestamp,
+	primary key(inbox_id, list_key)
 );
 create table if not exists inboxes (
 	id integer primary key autoincrement,
@@ -51,6 +138,13 @@ create table if not exists inboxes (
 	oauth2_access_token text,
 	oauth2_refresh_token text
 );
+create table if not exists safe_sender_rules (
+	id integer primary key autoincrement,
+	inbox_id integer not null default 0,
+	kind text not null,
+	pattern text not null,
+	unique(inbox_id, kind, pattern)
+);
 create table if not exists config (
 	inbox_id integer not null,
 	key text not null,
@@ -61,60 +155,360 @@ create table if not exists config (
 	`
 	_, err := ss.db.Exec(ddl)
 	if err != nil {
-		panic("failed to create tables: " + err.Error())
+		return fmt.Errorf("store: failed to create tables: %w", dbError(err))
+	}
+	if err := ss.migrateSafeSenders(); err != nil {
+		return fmt.Errorf("store: failed to migrate safe senders: %w", dbError(err))
+	}
+	if err := ss.migrateColumns(); err != nil {
+		return fmt.Errorf("store: failed to migrate columns: %w", dbError(err))
+	}
+	return nil
+}
+
+// migrateColumns adds the columns of tables created before they existed.
+// Earlier unsubscribes were only ever recorded on success.
+func (ss *SQLStore) migrateColumns() error {
+	migrations := []struct {
+		table, column, definition string
+	}{
+		{"unsubscribes", "method", "text not null default ''"},
+		{"unsubscribes", "target", "text not null default ''"},
+		{"unsubscribes", "status", "text not null default '" + StatusOK + "'"},
+		{"unsubscribes", "error", "text not null default ''"},
+		{"seen", "inbox_id", "integer not null default 0"},
+		{"seen", "provider_id", "text not null default ''"},
+	}
+
+	for _, m := range migrations {
+		var count int
+		if err := ss.db.QueryRow("select count(*) from pragma_table_info(?) where name = ?", m.table, m.column).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := ss.db.Exec(fmt.Sprintf("alter table %s add column %s %s", m.table, m.column, m.definition)); err != nil {
+			return err
+		}
 	}
+
+	_, err := ss.db.Exec("create index if not exists seen_key on seen (inbox_id, provider_id, message_id)")
+	return err
 }
 
-func (ss *SQLStore) RecordUnsubscribe(messageID, listID, recipient string) {
-	stmt, err := ss.db.Prepare("insert into unsubscribes (message_id, list_id, recipient) values (?, ?, ?)")
+// migrateSafeSenders moves the plain patterns of the old safe_senders table
+// into safe_sender_rules as global rules. Patterns that are not a valid rule
+// keep their old substring behaviour as an escaped regex.
+func (ss *SQLStore) migrateSafeSenders() error {
+	var name string
+	err := ss.db.QueryRow("select name from sqlite_master where type = 'table' and name = 'safe_senders'").Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := ss.db.Query("select pattern from safe_senders")
+	if err != nil {
+		return err
+	}
+	patterns := make([]string, 0)
+	for rows.Next() {
+		var pattern string
+		if err := rows.Scan(&pattern); err != nil {
+			rows.Close()
+			return err
+		}
+		patterns = append(patterns, pattern)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := ss.db.Begin()
 	if err != nil {
-		panic("store: RecordUnsubscribe prepare stmt failed: " + err.Error())
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, pattern := range patterns {
+		rule, err := rules.Parse(pattern)
+		if err != nil {
+			rule, _ = rules.New(rules.KindRegex, regexp.QuoteMeta(pattern))
+		}
+		if _, err := tx.Exec("insert into safe_sender_rules (inbox_id, kind, pattern) values (?, ?, ?) on conflict do nothing", rules.GlobalInbox, rule.Kind, rule.Pattern); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("drop table safe_senders"); err != nil {
+		return err
 	}
-	stmt.Exec(messageID, listID, recipient)
+	return tx.Commit()
+}
+
+// RecordUnsubscribe records a successful unsubscribe whose method is unknown.
+func (ss *SQLStore) RecordUnsubscribe(ctx context.Context, messageID, listID, recipient string) error {
+	return ss.RecordAttempt(ctx, Unsubscribe{MessageID: messageID, ListID: listID, Recipient: recipient, Status: StatusOK})
 }
 
-func (ss *SQLStore) Unsubscribed(listID, recipient string) bool {
-	stmt, err := ss.db.Prepare("select count(*) from unsubscribes where list_id = ? and recipient = ?")
+// RecordAttempt records an unsubscribe attempt, successful or not. The Time of u is ignored.
+func (ss *SQLStore) RecordAttempt(ctx context.Context, u Unsubscribe) error {
+	_, err := ss.db.ExecContext(ctx,
+		"insert into unsubscribes (message_id, list_id, recipient, method, target, status, error) values (?, ?, ?, ?, ?, ?, ?)",
+		u.MessageID, u.ListID, u.Recipient, u.Method, u.Target, u.Status, u.Error,
+	)
 	if err != nil {
-		panic("store: Unsubscribed prepare stmt failed: " + err.Error())
+		return fmt.Errorf("store: RecordAttempt exec failed: %w", dbError(err))
 	}
+	return nil
+}
 
+// Unsubscribed reports whether recipient was successfully unsubscribed from listID.
+func (ss *SQLStore) Unsubscribed(ctx context.Context, listID, recipient string) (bool, error) {
 	var count uint8
-	err = stmt.QueryRow(listID, recipient).Scan(&count)
+	err := ss.db.QueryRowContext(ctx, "select count(*) from unsubscribes where list_id = ? and recipient = ? and status = ?", listID, recipient, StatusOK).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("store: Unsubscribed query failed: %w", dbError(err))
+	}
+
+	return count >= 1, nil
+}
+
+// DefaultSeenRetention is how long messages are remembered as seen unless
+// the inbox config sets "seen::retention" (e.g. "720h").
+const DefaultSeenRetention = 90 * 24 * time.Hour
+
+// SeenRetention returns the seen retention configured for an inbox.
+func SeenRetention(ctx context.Context, inboxConfig *InboxConfig) (time.Duration, error) {
+	return inboxConfig.GetDuration(ctx, "seen::retention", DefaultSeenRetention)
+}
+
+// MarkSeen remembers that a message of an inbox was processed. Messages are
+// identified by the provider's ID and the Message-ID header together, either
+// of which may be empty. Marking a message again renews it for retention.
+func (ss *SQLStore) MarkSeen(ctx context.Context, inboxID int, providerID, messageID string) error {
+	res, err := ss.db.ExecContext(ctx,
+		"update seen set ts = current_timestamp where inbox_id = ? and provider_id = ? and message_id = ?",
+		inboxID, providerID, messageID,
+	)
 	if err != nil {
-		panic("store: Unsubscribed query failed: " + err.Error())
+		return fmt.Errorf("store: MarkSeen exec failed: %w", dbError(err))
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
 	}
 
-	return count >= 1
+	_, err = ss.db.ExecContext(ctx,
+		"insert into seen (inbox_id, provider_id, message_id, recipient) values (?, ?, ?, '')",
+		inboxID, providerID, messageID,
+	)
+	if err != nil {
+		return fmt.Errorf("store: MarkSeen exec failed: %w", dbError(err))
+	}
+	return nil
 }
 
-func (ss *SQLStore) MarkSeen(messageID, recipient string) string {
-	stmt, err := ss.db.Prepare("insert into seen (message_id, recipient) values (?, ?)")
+// Seen reports whether MarkSeen was called for the message since the last prune.
+func (ss *SQLStore) Seen(ctx context.Context, inboxID int, providerID, messageID string) (bool, error) {
+	var count uint8
+	err := ss.db.QueryRowContext(ctx,
+		"select count(*) from seen where inbox_id = ? and provider_id = ? and message_id = ?",
+		inboxID, providerID, messageID,
+	).Scan(&count)
 	if err != nil {
-		panic("store: MarkSeen prepare stmt failed: " + err.Error())
+		return false, fmt.Errorf("store: Seen query failed: %w", dbError(err))
 	}
 
-	_, err = stmt.Exec(messageID, recipient)
+	return count >= 1, nil
+}
+
+// PruneSeen forgets the messages of an inbox last marked seen before before,
+// returning how many were removed.
+func (ss *SQLStore) PruneSeen(ctx context.Context, inboxID int, before time.Time) (int64, error) {
+	// current_timestamp is stored as UTC text, compare in the same format
+	res, err := ss.db.ExecContext(ctx, "delete from seen where inbox_id = ? and ts < ?", inboxID, before.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, fmt.Errorf("store: PruneSeen exec failed: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
-		panic("store: MarkSeen exec stmt failed: " + err.Error())
+		return 0, fmt.Errorf("store: PruneSeen exec failed: %w", dbError(err))
 	}
+	return n, nil
+}
+
+// Decisions made about a mailing list when reviewing scan results.
+const (
+	DecisionKeep        = "keep"
+	DecisionUnsubscribe = "unsubscribe"
+	DecisionSafe        = "safe"
+)
 
-	return messageID
+// SetDecision saves the decision made about the list listKey (see
+// scanner.CandidateKey) of an inbox, replacing any earlier one.
+func (ss *SQLStore) SetDecision(ctx context.Context, inboxID int, listKey, decision string) error {
+	_, err := ss.db.ExecContext(ctx,
+		"insert into decisions (inbox_id, list_key, decision) values (?, ?, ?) on conflict(inbox_id, list_key) do update set decision = excluded.decision, ts = current_timestamp",
+		inboxID, listKey, decision,
+	)
+	if err != nil {
+		return fmt.Errorf("store: SetDecision exec failed: %w", dbError(err))
+	}
+	return nil
 }
 
-func (ss *SQLStore) Seen(messageID, recipient string) bool {
-	stmt, err := ss.db.Prepare("select count(*) from seen where message_id = ? and recipient = ?")
+// Decisions returns the decisions saved for an inbox by list key.
+func (ss *SQLStore) Decisions(ctx context.Context, inboxID int) (map[string]string, error) {
+	rows, err := ss.db.QueryContext(ctx, "select list_key, decision from decisions where inbox_id = ?", inboxID)
 	if err != nil {
-		panic("store: Seen prepare stmt failed: " + err.Error())
+		return nil, fmt.Errorf("store: Decisions query failed: %w", dbError(err))
 	}
+	defer rows.Close()
 
-	var count uint8
-	err = stmt.QueryRow(messageID, recipient).Scan(&count)
+	decisions := make(map[string]string)
+	for rows.Next() {
+		var key, decision string
+		if err := rows.Scan(&key, &decision); err != nil {
+			return nil, fmt.Errorf("store: Decisions scan failed: %w", dbError(err))
+		}
+		decisions[key] = decision
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: Decisions query failed: %w", dbError(err))
+	}
+	return decisions, nil
+}
+
+// Statuses of an unsubscribe attempt.
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// Unsubscribe is a row of the unsubscribes table, one unsubscribe attempt.
+type Unsubscribe struct {
+	Time      time.Time
+	MessageID string
+	ListID    string
+	Recipient string
+	Method    string // e.g. one-click or mailto
+	Target    string // the URI the unsubscribe request went to
+	Status    string // StatusOK or StatusFailed
+	Error     string
+}
+
+// ListUnsubscribes returns every recorded unsubscribe attempt, most recent first.
+func (ss *SQLStore) ListUnsubscribes(ctx context.Context) ([]Unsubscribe, error) {
+	rows, err := ss.db.QueryContext(ctx, "select ts, message_id, list_id, recipient, method, target, status, error from unsubscribes order by ts desc, id desc")
+	if err != nil {
+		return nil, fmt.Errorf("store: ListUnsubscribes query failed: %w", dbError(err))
+	}
+	defer rows.Close()
+
+	unsubscribes := make([]Unsubscribe, 0)
+	for rows.Next() {
+		var u Unsubscribe
+		if err := rows.Scan(&u.Time, &u.MessageID, &u.ListID, &u.Recipient, &u.Method, &u.Target, &u.Status, &u.Error); err != nil {
+			return nil, fmt.Errorf("store: ListUnsubscribes scan failed: %w", dbError(err))
+		}
+		unsubscribes = append(unsubscribes, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: ListUnsubscribes query failed: %w", dbError(err))
+	}
+	return unsubscribes, nil
+}
+
+// AddSafeSender saves rule for rule.InboxID, or for every inbox when it is
+// rules.GlobalInbox. It reports false if the rule already existed.
+func (ss *SQLStore) AddSafeSender(ctx context.Context, rule rules.Rule) (bool, error) {
+	return ss.addRule(ctx, "safe_sender_rules", rule)
+}
+
+// RemoveSafeSender deletes rule and reports whether it existed.
+func (ss *SQLStore) RemoveSafeSender(ctx context.Context, rule rules.Rule) (bool, error) {
+	return ss.removeRule(ctx, "safe_sender_rules", rule)
+}
+
+// ListSafeSenders returns the global and per-inbox safe sender rules, global rules first.
+func (ss *SQLStore) ListSafeSenders(ctx context.Context) (rules.Set, error) {
+	return ss.listRules(ctx, "safe_sender_rules")
+}
+
+// AddBlocklistRule saves a rule for senders that are always unsubscribed from,
+// see AddSafeSender.
+func (ss *SQLStore) AddBlocklistRule(ctx context.Context, rule rules.Rule) (bool, error) {
+	return ss.addRule(ctx, "blocklist_rules", rule)
+}
+
+// RemoveBlocklistRule deletes rule and reports whether it existed.
+func (ss *SQLStore) RemoveBlocklistRule(ctx context.Context, rule rules.Rule) (bool, error) {
+	return ss.removeRule(ctx, "blocklist_rules", rule)
+}
+
+// ListBlocklist returns the global and per-inbox blocklist rules, global rules first.
+func (ss *SQLStore) ListBlocklist(ctx context.Context) (rules.Set, error) {
+	return ss.listRules(ctx, "blocklist_rules")
+}
+
+func (ss *SQLStore) addRule(ctx context.Context, table string, rule rules.Rule) (bool, error) {
+	res, err := ss.db.ExecContext(ctx, "insert into "+table+" (inbox_id, kind, pattern) values (?, ?, ?) on conflict do nothing", rule.InboxID, rule.Kind, rule.Pattern)
+	if err != nil {
+		return false, fmt.Errorf("store: adding rule to %s failed: %w", table, dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("store: adding rule to %s failed: %w", table, dbError(err))
+	}
+	return n > 0, nil
+}
+
+func (ss *SQLStore) removeRule(ctx context.Context, table string, rule rules.Rule) (bool, error) {
+	res, err := ss.db.ExecContext(ctx, "delete from "+table+" where inbox_id = ? and kind = ? and pattern = ?", rule.InboxID, rule.Kind, rule.Pattern)
+	if err != nil {
+		return false, fmt.Errorf("store: removing rule from %s failed: %w", table, dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("store: removing rule from %s failed: %w", table, dbError(err))
+	}
+	return n > 0, nil
+}
+
+func (ss *SQLStore) listRules(ctx context.Context, table string) (rules.Set, error) {
+	rows, err := ss.db.QueryContext(ctx, "select id, inbox_id, kind, pattern from "+table+" order by inbox_id, id")
 	if err != nil {
-		panic("store: Seen query failed: " + err.Error())
+		return nil, fmt.Errorf("store: listing %s failed: %w", table, dbError(err))
+	}
+	defer rows.Close()
+
+	set := make(rules.Set, 0)
+	for rows.Next() {
+		var (
+			id, inboxID   int
+			kind, pattern string
+		)
+		if err := rows.Scan(&id, &inboxID, &kind, &pattern); err != nil {
+			return nil, fmt.Errorf("store: listing %s failed: %w", table, dbError(err))
+		}
+
+		rule, err := rules.New(rules.Kind(kind), pattern)
+		if err != nil {
+			return nil, fmt.Errorf("store: listing %s: %w", table, err)
+		}
+		rule.ID, rule.InboxID = id, inboxID
+		set = append(set, rule)
 	}
 
-	return count >= 1
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: listing %s failed: %w", table, dbError(err))
+	}
+	return set, nil
 }
 
 type Inbox struct {
@@ -123,85 +517,289 @@ type Inbox struct {
 	Provider string
 }
 
-func (ss *SQLStore) ListInboxes() []Inbox {
-	stmt, err := ss.db.Prepare("select id, addr, provider from inboxes")
+// AddInbox inserts a new inbox along with the values of config, which may be
+// nil, and returns it with its assigned ID.
+func (ss *SQLStore) AddInbox(ctx context.Context, addr, provider string, config *InboxConfig) (Inbox, error) {
+	values := make(map[string]string)
+	if config != nil {
+		var err error
+		if values, err = config.Values(ctx); err != nil {
+			return Inbox{}, err
+		}
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Inbox{}, fmt.Errorf("store: AddInbox begin failed: %w", dbError(err))
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "insert into inboxes (addr, provider) values (?, ?)", addr, provider)
+	if err != nil {
+		return Inbox{}, fmt.Errorf("store: AddInbox exec failed: %w", dbError(err))
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Inbox{}, fmt.Errorf("store: AddInbox exec failed: %w", dbError(err))
+	}
+
+	if err := insertConfig(ctx, tx, int(id), values); err != nil {
+		return Inbox{}, fmt.Errorf("store: AddInbox exec failed: %w", dbError(err))
+	}
+	if err := tx.Commit(); err != nil {
+		return Inbox{}, fmt.Errorf("store: AddInbox commit failed: %w", dbError(err))
+	}
+	return Inbox{int(id), addr, provider}, nil
+}
+
+// ReplaceInboxConfig replaces all of an inbox's config with the values of config.
+func (ss *SQLStore) ReplaceInboxConfig(ctx context.Context, inboxID int, config *InboxConfig) error {
+	values, err := config.Values(ctx)
 	if err != nil {
-		panic("store: ListInboxes prepare stmt failed: " + err.Error())
+		return err
 	}
 
-	rows, err := stmt.Query()
+	tx, err := ss.db.BeginTx(ctx, nil)
 	if err != nil {
-		panic("store: ListInboxes query failed: " + err.Error())
+		return fmt.Errorf("store: ReplaceInboxConfig begin failed: %w", dbError(err))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "delete from config where inbox_id = ?", inboxID); err != nil {
+		return fmt.Errorf("store: ReplaceInboxConfig exec failed: %w", dbError(err))
+	}
+	if err := insertConfig(ctx, tx, inboxID, values); err != nil {
+		return fmt.Errorf("store: ReplaceInboxConfig exec failed: %w", dbError(err))
 	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("store: ReplaceInboxConfig commit failed: %w", dbError(err))
+	}
+	return nil
+}
+
+func insertConfig(ctx context.Context, tx *sql.Tx, inboxID int, values map[string]string) error {
+	for key, value := range values {
+		if _, err := tx.ExecContext(ctx, "insert into config (inbox_id, key, value) values (?, ?, ?)", inboxID, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveInbox deletes an inbox along with its config. It fails with ErrNotFound
+// when there is no such inbox.
+func (ss *SQLStore) RemoveInbox(ctx context.Context, inboxID int) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("store: RemoveInbox begin failed: %w", dbError(err))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "delete from config where inbox_id = ?", inboxID); err != nil {
+		return fmt.Errorf("store: RemoveInbox exec failed: %w", dbError(err))
+	}
+	for _, table := range []string{"safe_sender_rules", "blocklist_rules", "seen", "decisions"} {
+		if _, err := tx.ExecContext(ctx, "delete from "+table+" where inbox_id = ?", inboxID); err != nil {
+			return fmt.Errorf("store: RemoveInbox exec failed: %w", dbError(err))
+		}
+	}
+	res, err := tx.ExecContext(ctx, "delete from inboxes where id = ?", inboxID)
+	if err != nil {
+		return fmt.Errorf("store: RemoveInbox exec failed: %w", dbError(err))
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("store: RemoveInbox exec failed: %w", dbError(err))
+	} else if n == 0 {
+		return fmt.Errorf("store: RemoveInbox: no inbox %d: %w", inboxID, ErrNotFound)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("store: RemoveInbox commit failed: %w", dbError(err))
+	}
+	return nil
+}
+
+func (ss *SQLStore) ListInboxes(ctx context.Context) ([]Inbox, error) {
+	rows, err := ss.db.QueryContext(ctx, "select id, addr, provider from inboxes")
+	if err != nil {
+		return nil, fmt.Errorf("store: ListInboxes query failed: %w", dbError(err))
+	}
+	defer rows.Close()
 
 	inboxes := make([]Inbox, 0)
 	for rows.Next() {
 		var inbox Inbox
-		rows.Scan(&inbox.ID, &inbox.Addr, &inbox.Provider)
+		if err := rows.Scan(&inbox.ID, &inbox.Addr, &inbox.Provider); err != nil {
+			return nil, fmt.Errorf("store: ListInboxes scan failed: %w", dbError(err))
+		}
 		inboxes = append(inboxes, inbox)
 	}
 
-	return inboxes
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: ListInboxes query failed: %w", dbError(err))
+	}
+	return inboxes, nil
 }
 
-func (ss *SQLStore) ConfigSet(inboxID int, key, value string) {
-	stmt, err := ss.db.Prepare("insert into config (inbox_id, key, value) values (?, ?, ?) on conflict (inbox_id, key) do update set value = ?")
+// ConfigSet sets key for an inbox. It fails with ErrNotFound when there is no
+// such inbox.
+func (ss *SQLStore) ConfigSet(ctx context.Context, inboxID int, key, value string) error {
+	_, err := ss.db.ExecContext(ctx, "insert into config (inbox_id, key, value) values (?, ?, ?) on conflict (inbox_id, key) do update set value = ?", inboxID, key, value, value)
 	if err != nil {
-		panic("store: ConfigSet prepare stmt failed: " + err.Error())
+		return fmt.Errorf("store: ConfigSet exec failed: %w", dbError(err))
 	}
-	_, err = stmt.Exec(inboxID, key, value, value)
-	if err != nil {
-		panic("store: ConfigSet exec stmt failed: " + err.Error())
+	return nil
+}
+
+// ConfigGetString returns the value of key, or an empty string if it is not set.
+func (ss *SQLStore) ConfigGetString(ctx context.Context, inboxID int, key string) (string, error) {
+	var value sql.NullString
+	err := ss.db.QueryRowContext(ctx, "select value from config where inbox_id = ? and key = ?", inboxID, key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("store: ConfigGet query failed: %w", dbError(err))
 	}
+
+	return value.String, nil
 }
 
-func (ss *SQLStore) ConfigGetString(inboxID int, key string) string {
-	q, err := ss.db.Prepare("select value from config where inbox_id = ? and key = ?")
+// ConfigAll returns every config value of an inbox.
+func (ss *SQLStore) ConfigAll(ctx context.Context, inboxID int) (map[string]string, error) {
+	rows, err := ss.db.QueryContext(ctx, "select key, value from config where inbox_id = ?", inboxID)
 	if err != nil {
-		panic("store: ConfigGet prepare stmt failed: " + err.Error())
+		return nil, fmt.Errorf("store: ConfigAll query failed: %w", dbError(err))
 	}
+	defer rows.Close()
 
-	var value string
-	err = q.QueryRow(inboxID, key).Scan(&value)
-	if err != nil && err != sql.ErrNoRows {
-		panic("store: ConfigGet query failed: " + err.Error())
+	values := make(map[string]string)
+	for rows.Next() {
+		var (
+			key   string
+			value sql.NullString
+		)
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("store: ConfigAll scan failed: %w", dbError(err))
+		}
+		values[key] = value.String
 	}
 
-	return value
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: ConfigAll query failed: %w", dbError(err))
+	}
+	return values, nil
 }
 
-func (ss *SQLStore) ConfigIsSet(inboxID int, key string) bool {
-	q, err := ss.db.Prepare("select 1 from config where inbox_id = ? and key = ?")
+func (ss *SQLStore) ConfigUnset(ctx context.Context, inboxID int, key string) error {
+	_, err := ss.db.ExecContext(ctx, "delete from config where inbox_id = ? and key = ?", inboxID, key)
 	if err != nil {
-		panic("store: ConfigIsSet prepare stmt failed: " + err.Error())
+		return fmt.Errorf("store: ConfigUnset exec failed: %w", dbError(err))
 	}
+	return nil
+}
 
+func (ss *SQLStore) ConfigIsSet(ctx context.Context, inboxID int, key string) (bool, error) {
 	var count uint8
-	err = q.QueryRow(inboxID, key).Scan(&count)
+	err := ss.db.QueryRowContext(ctx, "select 1 from config where inbox_id = ? and key = ?", inboxID, key).Scan(&count)
 	if err != nil && err != sql.ErrNoRows {
-		panic("store: ConfigIsSet query failed: " + err.Error())
+		return false, fmt.Errorf("store: ConfigIsSet query failed: %w", dbError(err))
 	}
 
-	return count == 1
+	return count == 1, nil
 }
 
+// InboxConfig is the config of a single inbox. It is either backed by the
+// config table or, for an inbox that is still being set up, held in memory
+// until it is saved with AddInbox or ReplaceInboxConfig.
 type InboxConfig struct {
 	inboxID int
 	store   *SQLStore
+
+	mu      sync.Mutex
+	pending map[string]string
 }
 
 func NewInboxConfig(inboxID int, store *SQLStore) *InboxConfig {
 	return &InboxConfig{inboxID: inboxID, store: store}
 }
 
-func (ic *InboxConfig) Set(key, value string) {
-	ic.store.ConfigSet(ic.inboxID, key, value)
+// NewPendingInboxConfig returns an in-memory config starting with a copy of values.
+func NewPendingInboxConfig(values map[string]string) *InboxConfig {
+	pending := make(map[string]string, len(values))
+	maps.Copy(pending, values)
+	return &InboxConfig{pending: pending}
 }
 
-func (ic *InboxConfig) GetString(key string) string {
-	return ic.store.ConfigGetString(ic.inboxID, key)
+func (ic *InboxConfig) Set(ctx context.Context, key, value string) error {
+	if ic.store == nil {
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		ic.pending[key] = value
+		return nil
+	}
+	return ic.store.ConfigSet(ctx, ic.inboxID, key, value)
+}
+
+func (ic *InboxConfig) GetString(ctx context.Context, key string) (string, error) {
+	if ic.store == nil {
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		return ic.pending[key], nil
+	}
+	return ic.store.ConfigGetString(ctx, ic.inboxID, key)
+}
+
+func (ic *InboxConfig) Unset(ctx context.Context, key string) error {
+	if ic.store == nil {
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		delete(ic.pending, key)
+		return nil
+	}
+	return ic.store.ConfigUnset(ctx, ic.inboxID, key)
+}
+
+func (ic *InboxConfig) IsSet(ctx context.Context, key string) (bool, error) {
+	if ic.store == nil {
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		_, ok := ic.pending[key]
+		return ok, nil
+	}
+	return ic.store.ConfigIsSet(ctx, ic.inboxID, key)
 }
 
-func (ic *InboxConfig) IsSet(key string) bool {
-	return ic.store.ConfigIsSet(ic.inboxID, key)
+// Values returns a copy of every config value.
+func (ic *InboxConfig) Values(ctx context.Context) (map[string]string, error) {
+	if ic.store == nil {
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		return maps.Clone(ic.pending), nil
+	}
+	return ic.store.ConfigAll(ctx, ic.inboxID)
+}
+
+// GetBool returns the value of key parsed with strconv.ParseBool, or fallback if it is not set.
+func (ic *InboxConfig) GetBool(ctx context.Context, key string, fallback bool) (bool, error) {
+	value, err := ic.GetString(ctx, key)
+	if err != nil || value == "" {
+		return fallback, err
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("store: invalid boolean for %q: %w", key, err)
+	}
+	return b, nil
+}
+
+// GetDuration returns the value of key parsed with time.ParseDuration, or fallback if it is not set.
+func (ic *InboxConfig) GetDuration(ctx context.Context, key string, fallback time.Duration) (time.Duration, error) {
+	value, err := ic.GetString(ctx, key)
+	if err != nil || value == "" {
+		return fallback, err
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("store: invalid duration for %q: %w", key, err)
+	}
+	return d, nil
 }
@@ -1,34 +1,414 @@
 package store_test
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/rules"
 	"github.com/usrbinsam/go-away/internal/store"
 )
 
 func TestStore_Open(t *testing.T) {
+	ctx := context.Background()
 	st := store.SQLStore{}
-	err := st.Open(":memory:?_journal=WAL&_foreign_keys=on")
+	err := st.Open(":memory:")
 	if err != nil {
 		t.Fatalf("failed to open store: %v", err)
 	}
 
 	t.Run("Unsubscribed", func(t *testing.T) {
-		st.RecordUnsubscribe("aabbcc", "list@list.org", "sam@example.com")
+		if err := st.RecordUnsubscribe(ctx, "aabbcc", "list@list.org", "sam@example.com"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
 
-		if !st.Unsubscribed("list@list.org", "sam@example.com") {
-			t.Errorf("expected to find unsubscribe record")
+		if unsubscribed, err := st.Unsubscribed(ctx, "list@list.org", "sam@example.com"); err != nil || !unsubscribed {
+			t.Errorf("expected to find unsubscribe record (err: %v)", err)
 		}
 	})
 
 	t.Run("Seen", func(t *testing.T) {
-		st.MarkSeen("aabbcc", "sam@example.com")
-		if !st.Seen("aabbcc", "sam@example.com") {
-			t.Errorf("expected to find seen record")
+		if err := st.MarkSeen(ctx, 1, "18c2f", "aabbcc"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if seen, err := st.Seen(ctx, 1, "18c2f", "aabbcc"); err != nil || !seen {
+			t.Errorf("expected to find seen record (err: %v)", err)
 		}
 
-		if st.Seen("notseen", "sam@xample.com") {
-			t.Errorf("expected not to find seen record for non-existent message")
+		if seen, err := st.Seen(ctx, 1, "18c30", "notseen"); err != nil || seen {
+			t.Errorf("expected not to find seen record for non-existent message (err: %v)", err)
+		}
+		if seen, err := st.Seen(ctx, 2, "18c2f", "aabbcc"); err != nil || seen {
+			t.Errorf("expected not to find seen record for another inbox (err: %v)", err)
 		}
 	})
 }
+
+func openStore(t *testing.T) *store.SQLStore {
+	t.Helper()
+
+	st := &store.SQLStore{}
+	if err := st.Open(filepath.Join(t.TempDir(), "go-away.sqlite3")); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestStore_Inboxes(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	inbox, err := st.AddInbox(ctx, "sam@example.com", "imap", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	inboxConfig := store.NewInboxConfig(inbox.ID, st)
+	if err := inboxConfig.Set(ctx, "imap::host", "imap.example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	inboxes, err := st.ListInboxes(ctx)
+	if err != nil || len(inboxes) != 1 || inboxes[0] != inbox {
+		t.Fatalf("expected to list %+v, got %+v (err: %v)", inbox, inboxes, err)
+	}
+
+	if err := inboxConfig.Unset(ctx, "imap::host"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isSet, err := inboxConfig.IsSet(ctx, "imap::host"); err != nil || isSet {
+		t.Errorf("expected imap::host to be unset (err: %v)", err)
+	}
+
+	inboxConfig.Set(ctx, "imap::host", "imap.example.com")
+	if err := st.RemoveInbox(ctx, inbox.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inboxes, err := st.ListInboxes(ctx); err != nil || len(inboxes) != 0 {
+		t.Errorf("expected no inboxes after removal, got %+v (err: %v)", inboxes, err)
+	}
+	if isSet, err := inboxConfig.IsSet(ctx, "imap::host"); err != nil || isSet {
+		t.Errorf("expected config to be removed with the inbox (err: %v)", err)
+	}
+}
+
+func TestStore_SafeSenders(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	inboxRule, _ := rules.Parse("shop.com")
+	inboxRule.InboxID = 1
+	for _, pattern := range []string{"bank.com", "*.example.org", "bank.com"} {
+		rule, _ := rules.Parse(pattern)
+		if _, err := st.AddSafeSender(ctx, rule); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if added, err := st.AddSafeSender(ctx, inboxRule); err != nil || !added {
+		t.Fatalf("expected per-inbox rule to be added (err: %v)", err)
+	}
+
+	set, err := st.ListSafeSenders(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listed := make([]string, 0, len(set))
+	for _, rule := range set {
+		listed = append(listed, fmt.Sprintf("%d:%s", rule.InboxID, rule))
+	}
+	if expected := []string{"0:bank.com", "0:*.example.org", "1:shop.com"}; !slices.Equal(listed, expected) {
+		t.Errorf("expected safe senders %q, got %q", expected, listed)
+	}
+	if _, ok := set.Match(1, message.NewMessage([]message.Header{{Name: "From", Value: "deals@shop.com"}}, "")); !ok {
+		t.Errorf("expected per-inbox rule to match")
+	}
+
+	if removed, err := st.RemoveSafeSender(ctx, set[0]); err != nil || !removed {
+		t.Errorf("expected bank.com to be removed (err: %v)", err)
+	}
+	if removed, err := st.RemoveSafeSender(ctx, set[0]); err != nil || removed {
+		t.Errorf("expected bank.com to be gone already (err: %v)", err)
+	}
+}
+
+func TestStore_Blocklist(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	safe, _ := rules.Parse("shop.com")
+	st.AddSafeSender(ctx, safe)
+
+	blocked, _ := rules.Parse("list:deals.shop.com")
+	if added, err := st.AddBlocklistRule(ctx, blocked); err != nil || !added {
+		t.Fatalf("expected blocklist rule to be added (err: %v)", err)
+	}
+
+	set, err := st.ListBlocklist(ctx)
+	if err != nil || len(set) != 1 || set[0].String() != "list:deals.shop.com" {
+		t.Errorf("expected only the blocklist rule, got %v (err: %v)", set, err)
+	}
+
+	if removed, err := st.RemoveBlocklistRule(ctx, blocked); err != nil || !removed {
+		t.Errorf("expected blocklist rule to be removed (err: %v)", err)
+	}
+	if set, _ := st.ListSafeSenders(ctx); len(set) != 1 {
+		t.Errorf("expected safe senders to be untouched, got %v", set)
+	}
+}
+
+func TestStore_MigrateSafeSenders(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "go-away.sqlite3")
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = db.Exec(`create table safe_senders (id integer primary key autoincrement, pattern text not null unique);
+insert into safe_senders (pattern) values ('bank.com'), ('Bank <alerts@bank.com>'), ('weird pattern')`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	st := &store.SQLStore{}
+	if err := st.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	set, err := st.ListSafeSenders(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listed := make([]string, 0, len(set))
+	for _, rule := range set {
+		listed = append(listed, string(rule.Kind)+":"+rule.String())
+	}
+	if expected := []string{"domain:bank.com", "address:alerts@bank.com", "regex:/weird pattern/"}; !slices.Equal(listed, expected) {
+		t.Errorf("expected migrated rules %q, got %q", expected, listed)
+	}
+}
+
+func TestStore_ListUnsubscribes(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	st.RecordUnsubscribe(ctx, "<1@list.org>", "list.org", "sam@example.com")
+	st.RecordUnsubscribe(ctx, "<2@news.org>", "news.org", "sam@example.com")
+
+	unsubscribes, err := st.ListUnsubscribes(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unsubscribes) != 2 || unsubscribes[0].ListID != "news.org" || unsubscribes[0].Time.IsZero() {
+		t.Errorf("expected most recent unsubscribe first, got %+v", unsubscribes)
+	}
+}
+
+func TestStore_RecordAttempt(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	failed := store.Unsubscribe{
+		MessageID: "<1@list.org>", ListID: "list.org", Recipient: "sam@example.com",
+		Method: "one-click", Target: "https://list.org/leave", Status: store.StatusFailed, Error: "HTTP 500",
+	}
+	if err := st.RecordAttempt(ctx, failed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unsubscribed, _ := st.Unsubscribed(ctx, "list.org", "sam@example.com"); unsubscribed {
+		t.Errorf("a failed attempt should not count as unsubscribed")
+	}
+
+	unsubscribes, err := st.ListUnsubscribes(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unsubscribes) != 1 {
+		t.Fatalf("expected 1 attempt, got %d", len(unsubscribes))
+	}
+	if got := unsubscribes[0]; got.Method != failed.Method || got.Target != failed.Target || got.Status != failed.Status || got.Error != failed.Error {
+		t.Errorf("expected %+v, got %+v", failed, got)
+	}
+
+	failed.Status, failed.Error = store.StatusOK, ""
+	st.RecordAttempt(ctx, failed)
+	if unsubscribed, _ := st.Unsubscribed(ctx, "list.org", "sam@example.com"); !unsubscribed {
+		t.Errorf("expected a successful attempt to count as unsubscribed")
+	}
+}
+
+func TestStore_MigrateUnsubscribes(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "go-away.sqlite3")
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.Exec("create table unsubscribes (id integer primary key autoincrement, ts timestamp default current_timestamp, message_id text not null, list_id text not null, recipient text not null)")
+	db.Exec("insert into unsubscribes (message_id, list_id, recipient) values ('<1@list.org>', 'list.org', 'sam@example.com')")
+	db.Close()
+
+	st := &store.SQLStore{}
+	if err := st.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	if unsubscribed, err := st.Unsubscribed(ctx, "list.org", "sam@example.com"); err != nil || !unsubscribed {
+		t.Errorf("expected old rows to count as unsubscribed (err: %v)", err)
+	}
+}
+
+func TestStore_PruneSeen(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	st.MarkSeen(ctx, 1, "18c2f", "<1@list.org>")
+	st.MarkSeen(ctx, 1, "18c2f", "<1@list.org>")
+	st.MarkSeen(ctx, 2, "18c2f", "<1@list.org>")
+
+	if pruned, err := st.PruneSeen(ctx, 1, time.Now().Add(-time.Hour)); err != nil || pruned != 0 {
+		t.Errorf("expected recent messages to be kept, pruned %d (err: %v)", pruned, err)
+	}
+	if pruned, err := st.PruneSeen(ctx, 1, time.Now().Add(time.Hour)); err != nil || pruned != 1 {
+		t.Errorf("expected 1 message to be pruned, pruned %d (err: %v)", pruned, err)
+	}
+
+	if seen, _ := st.Seen(ctx, 1, "18c2f", "<1@list.org>"); seen {
+		t.Errorf("expected pruned message to be forgotten")
+	}
+	if seen, _ := st.Seen(ctx, 2, "18c2f", "<1@list.org>"); !seen {
+		t.Errorf("expected other inboxes to be left alone")
+	}
+}
+
+func TestStore_Decisions(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	st.SetDecision(ctx, 1, "news.example.com", store.DecisionUnsubscribe)
+	st.SetDecision(ctx, 1, "alerts@bank.com", store.DecisionSafe)
+	st.SetDecision(ctx, 2, "news.example.com", store.DecisionKeep)
+	if err := st.SetDecision(ctx, 1, "news.example.com", store.DecisionKeep); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	decisions, err := st.Decisions(ctx, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"news.example.com": store.DecisionKeep, "alerts@bank.com": store.DecisionSafe}
+	if !maps.Equal(decisions, expected) {
+		t.Errorf("expected decisions %v, got %v", expected, decisions)
+	}
+}
+
+func TestStore_Errors(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "go-away.sqlite3")
+
+	st := &store.SQLStore{}
+	if err := st.Open(path + "?_pragma=busy_timeout(50)"); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	t.Run("not found", func(t *testing.T) {
+		if err := st.RemoveInbox(ctx, 42); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected %v removing a missing inbox, got: %v", store.ErrNotFound, err)
+		}
+		if err := store.NewInboxConfig(42, st).Set(ctx, "imap::host", "imap.example.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected %v setting config of a missing inbox, got: %v", store.ErrNotFound, err)
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		// another process, e.g. a second scan, holding the write lock
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		defer db.Close()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, "begin immediate"); err != nil {
+			t.Fatalf("failed to lock the database: %v", err)
+		}
+
+		err = st.MarkSeen(ctx, 1, "18c2f", "aabbcc")
+		if !errors.Is(err, store.ErrBusy) {
+			t.Errorf("expected %v while the database is locked, got: %v", store.ErrBusy, err)
+		}
+
+		if _, err := conn.ExecContext(ctx, "rollback"); err != nil {
+			t.Fatalf("failed to unlock the database: %v", err)
+		}
+		if err := st.MarkSeen(ctx, 1, "18c2f", "aabbcc"); err != nil {
+			t.Errorf("unexpected error once unlocked: %v", err)
+		}
+	})
+}
+
+func TestStore_PendingInboxConfig(t *testing.T) {
+	ctx := context.Background()
+	st := openStore(t)
+
+	pending := store.NewPendingInboxConfig(map[string]string{"imap::host": "imap.example.com"})
+	pending.Set(ctx, "credentials::password", "hunter2")
+
+	if inboxes, _ := st.ListInboxes(ctx); len(inboxes) != 0 {
+		t.Fatalf("expected a pending config not to create an inbox, got %+v", inboxes)
+	}
+
+	inbox, err := st.AddInbox(ctx, "sam@example.com", "imap", pending)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	inboxConfig := store.NewInboxConfig(inbox.ID, st)
+	values, err := inboxConfig.Values(ctx)
+	if err != nil || !maps.Equal(values, map[string]string{"imap::host": "imap.example.com", "credentials::password": "hunter2"}) {
+		t.Errorf("unexpected config after AddInbox: %v (err: %v)", values, err)
+	}
+
+	replacement := store.NewPendingInboxConfig(values)
+	replacement.Unset(ctx, "credentials::password")
+	replacement.Set(ctx, "credentials::password", "correct horse")
+	if err := st.ReplaceInboxConfig(ctx, inbox.ID, replacement); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if password, _ := inboxConfig.GetString(ctx, "credentials::password"); password != "correct horse" {
+		t.Errorf("expected replaced password, got %q", password)
+	}
+	if host, _ := inboxConfig.GetString(ctx, "imap::host"); host != "imap.example.com" {
+		t.Errorf("expected imap::host to be kept, got %q", host)
+	}
+}
+
+func TestInboxConfig_GetBool(t *testing.T) {
+	ctx := context.Background()
+	inboxConfig := store.NewPendingInboxConfig(map[string]string{"scanner::header": "false", "scanner::body": "nope"})
+
+	if enabled, err := inboxConfig.GetBool(ctx, "scanner::header", true); err != nil || enabled {
+		t.Errorf("expected false, got %v (err: %v)", enabled, err)
+	}
+	if enabled, err := inboxConfig.GetBool(ctx, "scanner::unset", true); err != nil || !enabled {
+		t.Errorf("expected fallback, got %v (err: %v)", enabled, err)
+	}
+	if _, err := inboxConfig.GetBool(ctx, "scanner::body", true); err == nil {
+		t.Errorf("expected an error for an invalid boolean")
+	}
+}
@@ -0,0 +1,46 @@
+package unsubscriber
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// LinkUnsubscriber visits unsubscribe links found in message bodies. Unlike
+// RFC 8058 one-click unsubscription nothing defines what these links do: many
+// unsubscribe on a GET, others only show a confirmation page.
+type LinkUnsubscriber struct {
+	client *http.Client
+}
+
+// NewLinkUnsubscriber returns a link unsubscriber using a copy of client, or a default client if nil.
+// Cookies are never sent and redirects, which tracking links rely on, are only followed to https URIs.
+func NewLinkUnsubscriber(client *http.Client) *LinkUnsubscriber {
+	return &LinkUnsubscriber{newHTTPClient(client)}
+}
+
+// Visit requests target with a GET and fails unless the final response is a 2xx.
+func (l *LinkUnsubscriber) Visit(ctx context.Context, target *url.URL) error {
+	if target.Scheme != "https" && target.Scheme != "http" {
+		return fmt.Errorf("refusing to visit non-http URI %s", target)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error creating unsubscribe link request: %w", err)
+	}
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("visiting unsubscribe link on %s failed: %w", target.Host, err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("visiting unsubscribe link on %s failed: HTTP %d", target.Host, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package unsubscriber_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/unsubscriber"
+)
+
+func TestLinkUnsubscriber_Visit(t *testing.T) {
+	visited := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/track":
+			http.Redirect(w, r, "/leave?id=42", http.StatusFound)
+		case "/insecure":
+			http.Redirect(w, r, "http://example.com/leave", http.StatusFound)
+		case "/leave":
+			visited <- r.Method + " " + r.URL.RequestURI()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	link := unsubscriber.NewLinkUnsubscriber(srv.Client())
+	target := func(path string) *url.URL {
+		u, _ := url.Parse(srv.URL + path)
+		return u
+	}
+
+	if err := link.Visit(context.Background(), target("/track")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := <-visited; got != "GET /leave?id=42" {
+		t.Errorf("expected GET /leave?id=42 after the redirect, got %q", got)
+	}
+
+	for _, path := range []string{"/missing", "/insecure"} {
+		if err := link.Visit(context.Background(), target(path)); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+	if err := link.Visit(context.Background(), &url.URL{Scheme: "javascript", Opaque: "alert(1)"}); err == nil {
+		t.Errorf("expected non-http links to be refused")
+	}
+}
@@ -0,0 +1,121 @@
+package unsubscriber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/message"
+)
+
+const (
+	oneClickBody = "List-Unsubscribe=One-Click"
+	httpTimeout  = 30 * time.Second
+	maxRedirects = 5
+)
+
+// OneClickUnsubscriber implements the Unsubscriber interface for RFC 8058 one-click unsubscription.
+// https://www.rfc-editor.org/rfc/rfc8058
+type OneClickUnsubscriber struct {
+	client *http.Client
+}
+
+// NewOneClickUnsubscriber returns a one-click unsubscriber using a copy of client, or a default client if nil.
+// Cookies are never sent and redirects are only followed to the host of the original URI.
+func NewOneClickUnsubscriber(client *http.Client) *OneClickUnsubscriber {
+	c := newHTTPClient(client)
+	redirect := c.CheckRedirect
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := redirect(req, via); err != nil {
+			return err
+		}
+		if req.URL.Host != via[0].URL.Host {
+			return fmt.Errorf("refusing to follow redirect to foreign host %s", req.URL.Host)
+		}
+		return nil
+	}
+
+	return &OneClickUnsubscriber{c}
+}
+
+// newHTTPClient returns a copy of client, or a default client if nil, that
+// sends no cookies, gives up after httpTimeout unless client sets a timeout
+// and only follows up to maxRedirects redirects to https URIs.
+func newHTTPClient(client *http.Client) *http.Client {
+	c := &http.Client{}
+	if client != nil {
+		*c = *client
+	}
+
+	c.Jar = nil
+	if c.Timeout == 0 {
+		c.Timeout = httpTimeout
+	}
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing to follow redirect to non-https URI %s", req.URL)
+		}
+		return nil
+	}
+	return c
+}
+
+// OneClickTarget returns the HTTPS URI to POST to when msg supports one-click unsubscription,
+// i.e. it carries "List-Unsubscribe-Post: List-Unsubscribe=One-Click" and an https List-Unsubscribe URI.
+func OneClickTarget(msg *message.Message) (*url.URL, error) {
+	post := strings.TrimSpace(msg.RawHeader("List-Unsubscribe-Post"))
+	if post == "" {
+		return nil, errors.New("no List-Unsubscribe-Post header found")
+	}
+	if post != oneClickBody {
+		return nil, fmt.Errorf("unexpected List-Unsubscribe-Post value %q", post)
+	}
+
+	listUnsubscribe := msg.RawHeader("List-Unsubscribe")
+	for _, match := range reListUnsubsbscribe.FindAllStringSubmatch(listUnsubscribe, -1) {
+		u, err := url.Parse(stripSpace(match[1]))
+		if err != nil {
+			continue
+		}
+		if u.Scheme == "https" && u.Host != "" {
+			return u, nil
+		}
+	}
+
+	return nil, errors.New("no https List-Unsubscribe URI found for one-click unsubscription")
+}
+
+// Unsubscribe performs the RFC 8058 POST against the message's one-click List-Unsubscribe URI.
+func (o *OneClickUnsubscriber) Unsubscribe(ctx context.Context, msg *message.Message) error {
+	target, err := OneClickTarget(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target.String(), strings.NewReader(oneClickBody))
+	if err != nil {
+		return fmt.Errorf("error creating one-click request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("one-click unsubscribe to %s failed: %w", target.Host, err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("one-click unsubscribe to %s failed: HTTP %d", target.Host, res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package unsubscriber_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/unsubscriber"
+)
+
+func oneClickMessage(listUnsubscribe string) *message.Message {
+	return message.NewMessage(
+		[]message.Header{
+			{Name: "List-Unsubscribe", Value: listUnsubscribe},
+			{Name: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"},
+		},
+		"Click nowhere to unsubscribe.",
+	)
+}
+
+func TestOneClickUnsubscriber_Unsubscribe(t *testing.T) {
+	type request struct {
+		method, path, query, contentType, body, cookie string
+	}
+	requests := make(chan request, 2)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/unsubscribe?id=42", http.StatusTemporaryRedirect)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"), string(body), r.Header.Get("Cookie")}
+		http.SetCookie(w, &http.Cookie{Name: "tracking", Value: "1"})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// a client with a cookie jar must not leak cookies into unsubscribe requests
+	client := srv.Client()
+	client.Jar, _ = cookiejar.New(nil)
+	srvURL, _ := url.Parse(srv.URL)
+	client.Jar.SetCookies(srvURL, []*http.Cookie{{Name: "session", Value: "secret"}})
+
+	unsub := unsubscriber.NewOneClickUnsubscriber(client)
+
+	testCases := []struct {
+		name            string
+		listUnsubscribe string
+	}{
+		{
+			name:            "direct",
+			listUnsubscribe: "<mailto:leave@example.com>, <" + srv.URL + "/unsubscribe?id=42>",
+		},
+		{
+			name:            "folded",
+			listUnsubscribe: "<mailto:leave@example.com>,\r\n <" + srv.URL + "/unsub\r\n scribe?id=42>",
+		},
+		{
+			name:            "same-host redirect",
+			listUnsubscribe: "<" + srv.URL + "/redirect>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := unsub.Unsubscribe(context.Background(), oneClickMessage(tc.listUnsubscribe)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := <-requests
+			expected := request{"POST", "/unsubscribe", "id=42", "application/x-www-form-urlencoded", "List-Unsubscribe=One-Click", ""}
+			if req != expected {
+				t.Errorf("expected request %+v, got: %+v", expected, req)
+			}
+		})
+	}
+}
+
+func TestOneClickUnsubscriber_Refuses(t *testing.T) {
+	foreign := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request should not have reached foreign host: %s %s", r.Method, r.URL)
+	}))
+	defer foreign.Close()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foreign":
+			http.Redirect(w, r, foreign.URL+"/unsubscribe", http.StatusTemporaryRedirect)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Timeout = 100 * time.Millisecond
+	unsub := unsubscriber.NewOneClickUnsubscriber(client)
+
+	testCases := []struct {
+		name string
+		msg  *message.Message
+	}{
+		{"redirect to foreign host", oneClickMessage("<" + srv.URL + "/foreign>")},
+		{"timeout", oneClickMessage("<" + srv.URL + "/slow>")},
+		{"non-2xx status", oneClickMessage("<" + srv.URL + "/gone>")},
+		{"plain http", oneClickMessage("<http://example.com/unsubscribe>")},
+		{
+			name: "missing List-Unsubscribe-Post",
+			msg: message.NewMessage(
+				[]message.Header{{Name: "List-Unsubscribe", Value: "<" + srv.URL + "/unsubscribe>"}},
+				"",
+			),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := unsub.Unsubscribe(context.Background(), tc.msg); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
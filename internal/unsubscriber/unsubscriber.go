@@ -1,10 +1,13 @@
 package unsubscriber
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/url"
 	"regexp"
+	"strings"
 
 	"github.com/usrbinsam/go-away/internal/mailer"
 	"github.com/usrbinsam/go-away/internal/message"
@@ -15,7 +18,7 @@ var reListUnsubsbscribe = regexp.MustCompile(`<([^>]+)>`)
 // Unsubscriber defines an interface that attempts to unsubscribe from a mailing list.
 // Mailing lists may implement different methods of unsubscription, such as RFC 2369 or custom methods.
 type Unsubscriber interface {
-	Unsubscribe(*message.Message) error
+	Unsubscribe(context.Context, *message.Message) error
 }
 
 // RFC2369Unsubscriber implements the Unsubscriber interface for RFC 2369 compliant unsubscription.
@@ -29,30 +32,24 @@ func NewRFC2369Unsubscriber(mailer mailer.Mailer) *RFC2369Unsubscriber {
 
 // Unsubscribe attempts to unsubscribe from a mailing list using the RFC 2369 method.
 // Expected to be called with a message that contains the necessary headers for unsubscription.
-func (r *RFC2369Unsubscriber) Unsubscribe(msg *message.Message) error {
-	listUnsubscribe := msg.GetHeader("List-Unsubscribe")
+func (r *RFC2369Unsubscriber) Unsubscribe(ctx context.Context, msg *message.Message) error {
+	listUnsubscribe := msg.RawHeader("List-Unsubscribe")
 
 	if listUnsubscribe == "" {
 		return errors.New("no List-Unsubscribe header found")
 	}
 
 	unsubscribed := false
-	matches := reListUnsubsbscribe.FindAllStringSubmatch(listUnsubscribe, -1)
-
-	for _, match := range matches {
-		if len(match) != 2 {
-			log.Print("List-Unsubscribe header does not match expected format: " + listUnsubscribe)
-		}
-
-		to, subject, body, err := tryParse(match[1])
+	for _, uri := range listUnsubscribeURIs(listUnsubscribe) {
+		to, subject, body, err := parseMailto(uri)
 		if err != nil {
-			log.Printf("error parsing List-Unsubscribe value '%s': %v", match[1], err)
+			log.Printf("error parsing List-Unsubscribe value '%s': %v", uri, err)
 			continue
 		}
 
-		err = r.mailer.Send(to, subject, body)
+		err = r.mailer.Send(ctx, to, subject, body)
 		if err != nil {
-			log.Panic("error sending unsubscription request")
+			return fmt.Errorf("error sending unsubscription request to %s: %w", to, err)
 		}
 
 		unsubscribed = true
@@ -65,7 +62,42 @@ func (r *RFC2369Unsubscriber) Unsubscribe(msg *message.Message) error {
 	return errors.New("couldn't find a usable List-Unsubscribe. see logs for details")
 }
 
-func tryParse(listUnsubscribeValue string) (to, subject, body string, err error) {
+// ParseMailto returns the recipient, subject and body of the first usable
+// mailto: URI in a List-Unsubscribe header value, filling in a default subject
+// and body when the URI sets none.
+func ParseMailto(listUnsubscribe string) (to, subject, body string, err error) {
+	for _, uri := range listUnsubscribeURIs(listUnsubscribe) {
+		to, subject, body, err = parseMailto(uri)
+		if err == nil {
+			return
+		}
+		log.Printf("error parsing List-Unsubscribe value '%s': %v", uri, err)
+	}
+	err = errors.New("couldn't find a usable List-Unsubscribe. see logs for details")
+	return
+}
+
+// listUnsubscribeURIs returns the URIs in a List-Unsubscribe header value.
+func listUnsubscribeURIs(listUnsubscribe string) []string {
+	var uris []string
+	for _, match := range reListUnsubsbscribe.FindAllStringSubmatch(listUnsubscribe, -1) {
+		uris = append(uris, stripSpace(match[1]))
+	}
+	if len(uris) == 0 && strings.TrimSpace(listUnsubscribe) != "" {
+		// tolerate senders that omit the angle brackets around a single URI
+		uris = append(uris, stripSpace(listUnsubscribe))
+	}
+	return uris
+}
+
+// stripSpace removes all whitespace from a List-Unsubscribe URI. RFC 2369
+// lets senders fold long URIs, and whitespace within the angle brackets is to
+// be ignored.
+func stripSpace(uri string) string {
+	return strings.Join(strings.Fields(uri), "")
+}
+
+func parseMailto(listUnsubscribeValue string) (to, subject, body string, err error) {
 	u, err := url.Parse(listUnsubscribeValue)
 	if err != nil {
 		return
@@ -77,7 +109,10 @@ func tryParse(listUnsubscribeValue string) (to, subject, body string, err error)
 	}
 
 	params := u.Query()
-	to = u.Opaque
+	// the addresses may be percent-encoded as well (RFC 6068 section 2)
+	if to, err = url.PathUnescape(u.Opaque); err != nil {
+		return
+	}
 	body = params.Get("body")
 	subject = params.Get("subject")
 
@@ -86,6 +121,13 @@ func tryParse(listUnsubscribeValue string) (to, subject, body string, err error)
 		return
 	}
 
+	// hfields are percent-decoded, so a sender could smuggle in a CRLF and
+	// with it headers or recipients of its own
+	if strings.ContainsAny(to+subject, "\r\n") {
+		err = errors.New("line break in mailto: address or subject")
+		return
+	}
+
 	if body == "" {
 		body = "Please unsubscribe me from this mailing list."
 	}
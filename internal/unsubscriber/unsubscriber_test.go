@@ -1,6 +1,7 @@
 package unsubscriber_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/usrbinsam/go-away/internal/message"
@@ -15,7 +16,7 @@ type fakeMessage struct {
 	to, subject, body string
 }
 
-func (f *fakeMailer) Send(to, subject, body string) error {
+func (f *fakeMailer) Send(ctx context.Context, to, subject, body string) error {
 	f.callback(fakeMessage{to, subject, body})
 	return nil
 }
@@ -93,10 +94,53 @@ func TestRFC2369Unsubscriber_Unsubscribe(t *testing.T) {
 				},
 			)
 
-			err := unsub.Unsubscribe(tc.testMessage)
+			err := unsub.Unsubscribe(context.Background(), tc.testMessage)
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
 		})
 	}
 }
+
+func TestRFC2369Unsubscriber_RejectsLineBreaks(t *testing.T) {
+	for _, uri := range []string{
+		"<mailto:list@example.com?subject=hi%0D%0ABcc:%20victim@example.com>",
+		"<mailto:list@example.com%0D%0ABcc:victim@example.com?subject=hi>",
+		"<mailto:list@example.com?subject=hi%0ABcc:%20victim@example.com>",
+	} {
+		msg := message.NewMessage([]message.Header{{Name: "List-Unsubscribe", Value: uri}}, "")
+		unsub := unsubscriber.NewRFC2369Unsubscriber(&fakeMailer{func(sent fakeMessage) {
+			t.Errorf("%s: expected nothing to be sent, got %+v", uri, sent)
+		}})
+		if err := unsub.Unsubscribe(context.Background(), msg); err == nil {
+			t.Errorf("%s: expected an error", uri)
+		}
+	}
+}
+
+func TestParseMailto(t *testing.T) {
+	testCases := []struct {
+		value                                     string
+		expectedTo, expectedSubject, expectedBody string
+	}{
+		{"<https://example.com/u>, <mailto:leave@example.com?subject=bye>", "leave@example.com", "bye", "Please unsubscribe me from this mailing list."},
+		{"mailto:leave@example.com", "leave@example.com", "Unsubscribe Request", "Please unsubscribe me from this mailing list."},
+		{"<mailto:leave@\r\n example.com?body=stop>", "leave@example.com", "Unsubscribe Request", "stop"},
+		{"<https://example.com/u>", "", "", ""},
+		{"<mailto:leave@example.com?subject=hi%0D%0ABcc:%20victim@example.com>", "", "", ""},
+		{"", "", "", ""},
+	}
+
+	for _, tc := range testCases {
+		to, subject, body, err := unsubscriber.ParseMailto(tc.value)
+		if tc.expectedTo == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.value, to)
+			}
+			continue
+		}
+		if err != nil || to != tc.expectedTo || subject != tc.expectedSubject || body != tc.expectedBody {
+			t.Errorf("%q: expected %q %q %q, got %q %q %q (err: %v)", tc.value, tc.expectedTo, tc.expectedSubject, tc.expectedBody, to, subject, body, err)
+		}
+	}
+}
@@ -1,91 +1,369 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/usrbinsam/go-away/internal/command"
 	"github.com/usrbinsam/go-away/internal/gmail"
+	"github.com/usrbinsam/go-away/internal/imap"
+	"github.com/usrbinsam/go-away/internal/jmap"
+	"github.com/usrbinsam/go-away/internal/maildir"
+	"github.com/usrbinsam/go-away/internal/mailer"
+	"github.com/usrbinsam/go-away/internal/mbox"
+	"github.com/usrbinsam/go-away/internal/message"
 	"github.com/usrbinsam/go-away/internal/provider"
+	"github.com/usrbinsam/go-away/internal/rules"
 	"github.com/usrbinsam/go-away/internal/scanner"
 	"github.com/usrbinsam/go-away/internal/store"
 )
 
+// inboxRetries is the number of times an inbox that fails with a transient
+// error before yielding any message is retried.
+const inboxRetries = 3
+
 type Unsubscriber struct {
-	providers   []provider.Provider
-	scanners    []scanner.Scanner
-	safeSenders []string
+	providers   []inboxProvider
+	scanners    map[int]scanner.Scanner // scanner pipeline of each inbox by inbox ID
+	safeSenders rules.Set
+	blocklist   rules.Set
+
+	// seen remembers processed messages, which are skipped unless rescan is
+	// set. Without markSeen messages are only looked up, never recorded;
+	// with holdSeen they are held until markHeld records them.
+	seen     store.Store
+	rescan   bool
+	markSeen bool
+	holdSeen bool
+	held     []heldMessage
 }
 
-func (u *Unsubscriber) isSafeSender(addr string) bool {
-	for _, safeSender := range u.safeSenders {
-		if strings.Contains(addr, safeSender) {
-			return true
-		}
+// heldMessage is a processed message whose recording is held back.
+type heldMessage struct {
+	inbox                 inboxProvider
+	providerID, messageID string
+}
+
+// seenBefore reports whether msg was processed by an earlier run.
+func (u *Unsubscriber) seenBefore(ctx context.Context, inbox inboxProvider, msg *message.Message) bool {
+	providerID, messageID := msg.ID(), msg.GetHeader("Message-ID")
+	if u.seen == nil || u.rescan || providerID == "" && messageID == "" {
+		return false
 	}
-	return false
+
+	seen, err := u.seen.Seen(ctx, inbox.ID, providerID, messageID)
+	if err != nil {
+		log.Printf("inbox %s: %s", inbox.Addr, err)
+	}
+	return seen
 }
 
-func goAway(unsubscriber *Unsubscriber) {
-	results := make([]*scanner.ScanResult, 1)
-	scanned := 0
-	for _, provider := range unsubscriber.providers {
-		for _, msg := range provider.GetMail() {
-			sender := msg.GetHeader("From")
-			if unsubscriber.isSafeSender(sender) {
-				continue
+// rememberAll marks every message of a hit as processed.
+func (u *Unsubscriber) rememberAll(ctx context.Context, h hit) {
+	for _, msg := range h.Messages {
+		u.remember(ctx, h.inbox, msg)
+	}
+}
+
+// remember marks msg as processed when markSeen is set, or holds it back
+// for markHeld when holdSeen is.
+func (u *Unsubscriber) remember(ctx context.Context, inbox inboxProvider, msg *message.Message) {
+	providerID, messageID := msg.ID(), msg.GetHeader("Message-ID")
+	if u.seen == nil || providerID == "" && messageID == "" {
+		return
+	}
+
+	switch {
+	case u.markSeen:
+		u.markSeenID(ctx, inbox, providerID, messageID)
+	case u.holdSeen:
+		u.held = append(u.held, heldMessage{inbox, providerID, messageID})
+	}
+}
+
+// markHeld marks the messages held back so far as processed, and turns on
+// markSeen for the ones remembered from now on.
+func (u *Unsubscriber) markHeld(ctx context.Context) {
+	u.markSeen = true
+	for _, m := range u.held {
+		u.markSeenID(ctx, m.inbox, m.providerID, m.messageID)
+	}
+	u.held = nil
+}
+
+func (u *Unsubscriber) markSeenID(ctx context.Context, inbox inboxProvider, providerID, messageID string) {
+	if err := u.seen.MarkSeen(ctx, inbox.ID, providerID, messageID); err != nil {
+		warnf("inbox %s: %s", inbox.Addr, err)
+	}
+}
+
+// inboxProvider is the provider for a configured inbox.
+type inboxProvider struct {
+	store.Inbox
+	provider.Provider
+}
+
+// hit is a mailing list a scanner found a way to unsubscribe from, or a list
+// that was skipped because its sender matched a safe sender rule. blocked is
+// the blocklist rule the sender matched, if any.
+type hit struct {
+	*scanner.Candidate
+	inbox   inboxProvider
+	safe    *rules.Rule
+	blocked *rules.Rule
+}
+
+// smtpProvider overrides a provider's Send with the SMTP server configured for its inbox.
+type smtpProvider struct {
+	provider.Provider
+	mailer mailer.Mailer
+}
+
+func (p *smtpProvider) Send(ctx context.Context, to, subject, body string) error {
+	return p.mailer.Send(ctx, to, subject, body)
+}
+
+func (p *smtpProvider) Unwrap() provider.Provider {
+	return p.Provider
+}
+
+// goAway scans every inbox and returns the lists that can be unsubscribed
+// from, including blocklisted senders, along with those skipped as safe senders.
+func goAway(ctx context.Context, unsubscriber *Unsubscriber) []hit {
+	hits := make([]hit, 0)
+	scanned, skipped, blocked, lists := 0, 0, 0, 0
+	for _, inbox := range unsubscriber.providers {
+		if ctx.Err() != nil {
+			break
+		}
+		for attempt := 1; ; attempt++ {
+			received, err := scanInbox(ctx, unsubscriber, inbox, func(h hit) {
+				switch {
+				case h.safe != nil:
+					skipped += h.Count
+				case h.blocked != nil:
+					blocked += h.Count
+					lists++
+				default:
+					lists++
+				}
+				hits = append(hits, h)
+			})
+			scanned += received
+			if err == nil {
+				break
 			}
-			scanned++
 
-			headerScanner := scanner.NewHeaderScanner(provider)
-			result, err := headerScanner.Scan(msg)
-			if err != nil {
-				log.Printf("error scanning message: %s", err)
-				continue
+			transient := errors.Is(err, provider.ErrRateLimited) || errors.Is(err, provider.ErrUnavailable)
+			if received == 0 && transient && attempt <= inboxRetries {
+				wait := time.Duration(attempt*attempt) * 10 * time.Second
+				log.Printf("inbox %s: %s, retrying in %s", inbox.Addr, err, wait)
+				select {
+				case <-time.After(wait):
+					continue
+				case <-ctx.Done():
+				}
+				break
 			}
 
-			if !result.Hit {
-				continue
+			switch {
+			case ctx.Err() != nil:
+				warnf("inbox %s: stopped: %s", inbox.Addr, context.Cause(ctx))
+			case errors.Is(err, provider.ErrAuthExpired):
+				warnf("inbox %s: credentials expired, run 'inbox reauth %s': %s", inbox.Addr, inbox.Addr, err)
+			default:
+				warnf("inbox %s: skipping after error: %s", inbox.Addr, err)
 			}
-			results = append(results, result)
+			break
 		}
 	}
 
 	log.Printf("scanned %d messages", scanned)
-	log.Printf("scanners found %d messages to unsubscribe", len(results))
+	log.Printf("skipped %d messages from safe senders", skipped)
+	log.Printf("blocklist rules matched %d messages", blocked)
+	log.Printf("found %d lists to unsubscribe from", lists)
+	return hits
+}
 
-	for _, result := range results {
-		fmt.Printf("%+v\n", result)
+// scanInbox scans every message of inbox not seen before and groups them by
+// mailing list, see scanner.CandidateKey. Once the inbox is done, or fails,
+// found is called with every list a scanner hit and every list skipped as a
+// safe sender. Safe sender rules are checked first, then the blocklist, before
+// any scanner runs. Messages that are not part of a hit are marked seen; hits
+// are left for the caller to mark once they are dealt with. It returns the
+// number of messages received before any error.
+func scanInbox(ctx context.Context, unsubscriber *Unsubscriber, inbox inboxProvider, found func(hit)) (int, error) {
+	received, seen := 0, 0
+	groups := make(map[string]*hit)
+	order := make([]*hit, 0)
+	group := func(msg *message.Message, result *scanner.ScanResult, safe, blocked *rules.Rule) {
+		key := scanner.CandidateKey(msg)
+		if safe != nil {
+			// safe lists are reported apart from any messages of the same list that were not
+			key = "safe:" + key
+		}
+
+		h, ok := groups[key]
+		if !ok {
+			h = &hit{Candidate: &scanner.Candidate{}, inbox: inbox, safe: safe}
+			groups[key] = h
+			order = append(order, h)
+		}
+		if h.blocked == nil {
+			h.blocked = blocked
+		}
+		h.Add(msg, result)
 	}
+
+	defer func() {
+		log.Printf("inbox %s: skipped %d messages seen before", inbox.Addr, seen)
+		for _, h := range order {
+			if h.safe == nil && h.Result == nil {
+				warnf("inbox %s: %s matches blocklist rule %s but has no way to unsubscribe", inbox.Addr, h.Key, h.blocked)
+				unsubscriber.rememberAll(ctx, *h)
+				continue
+			}
+			found(*h)
+		}
+	}()
+
+	for msg, err := range inbox.GetMail(ctx) {
+		if err != nil {
+			return received, err
+		}
+		received++
+
+		if unsubscriber.seenBefore(ctx, inbox, msg) {
+			seen++
+			continue
+		}
+
+		from := msg.GetHeader("From")
+		if rule, ok := unsubscriber.safeSenders.Match(inbox.ID, msg); ok {
+			if blocked, ok := unsubscriber.blocklist.Match(inbox.ID, msg); ok {
+				log.Printf("inbox %s: %s matches blocklist rule %s but safe sender rule %s wins", inbox.Addr, from, blocked, rule)
+			}
+			unsubscriber.remember(ctx, inbox, msg)
+			group(msg, nil, &rule, nil)
+			continue
+		}
+
+		var blocked *rules.Rule
+		if rule, ok := unsubscriber.blocklist.Match(inbox.ID, msg); ok {
+			log.Printf("inbox %s: %s matches blocklist rule %s", inbox.Addr, from, rule)
+			blocked = &rule
+		}
+
+		result, err := unsubscriber.scanners[inbox.ID].Scan(ctx, msg)
+		if err != nil {
+			// a miss, so the message is remembered rather than failing again on every run
+			log.Printf("error scanning message: %s", err)
+			result = &scanner.ScanResult{Reason: err.Error()}
+		}
+
+		if !result.Hit && blocked == nil {
+			unsubscriber.remember(ctx, inbox, msg)
+			continue
+		}
+		group(msg, result, nil, blocked)
+	}
+	return received, nil
 }
 
-func main() {
-	st := &store.SQLStore{}
-	st.Open("go-away.sqlite3?_journal=WAL&_foreign_keys=on")
+// newScanner creates the scanner pipeline of an inbox. Its config enables or
+// disables a scanner by setting "scanner::<name>" to true or false; scanners
+// it does not configure run if they are enabled by default.
+func newScanner(ctx context.Context, inboxConfig *store.InboxConfig, p provider.Provider) (scanner.Scanner, error) {
+	enabled := make(map[string]bool)
+	for _, name := range scanner.Names() {
+		on, err := inboxConfig.GetBool(ctx, "scanner::"+name, scanner.EnabledByDefault(name))
+		if err != nil {
+			return nil, err
+		}
+		enabled[name] = on
+	}
 
-	inboxes := st.ListInboxes()
-	safeSenders := []string{}
+	return scanner.NewPipeline(p, func(name string) bool { return enabled[name] })
+}
 
-	unsubscriber := &Unsubscriber{
-		providers:   make([]provider.Provider, len(inboxes)),
-		safeSenders: safeSenders,
+// newProvider creates the provider for inbox, sending through SMTP when the inbox has a server configured.
+func newProvider(ctx context.Context, st *store.SQLStore, inbox store.Inbox) (provider.Provider, error) {
+	return providerFor(ctx, st, inbox.Provider, store.NewInboxConfig(inbox.ID, st))
+}
+
+func providerFor(ctx context.Context, st *store.SQLStore, providerKey string, inboxConfig *store.InboxConfig) (provider.Provider, error) {
+	var (
+		p   provider.Provider
+		err error
+	)
+	switch providerKey {
+	case gmail.GmailInboxKey:
+		p, err = gmail.New(ctx, st, inboxConfig)
+	case imap.IMAPInboxKey:
+		p, err = imap.New(ctx, st, inboxConfig)
+	case jmap.JMAPInboxKey:
+		p, err = jmap.New(ctx, st, inboxConfig)
+	case maildir.MaildirInboxKey:
+		p, err = maildir.New(ctx, st, inboxConfig)
+	case mbox.MboxInboxKey:
+		p, err = mbox.New(ctx, st, inboxConfig)
+	default:
+		err = fmt.Errorf("unknown inbox type: %s", providerKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	smtpConfigured, err := mailer.SMTPConfigured(ctx, inboxConfig)
+	if err != nil || !smtpConfigured {
+		return p, err
 	}
 
-	if len(inboxes) == 0 {
-		log.Fatalf("no inboxes found")
+	smtpMailer, err := mailer.NewSMTPMailer(ctx, inboxConfig)
+	if err != nil {
+		return nil, err
 	}
+	return &smtpProvider{p, smtpMailer}, nil
+}
 
-	for inboxIdx, inbox := range inboxes {
-		inboxConfig := store.NewInboxConfig(inbox.ID, st)
+// warnf reports a problem the user should see even without --verbose.
+func warnf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
 
-		if inbox.Provider == "gmail" {
-			provider := gmail.New(st, inboxConfig)
-			unsubscriber.providers[inboxIdx] = provider
-			goAway(unsubscriber)
+func main() {
+	// the first SIGINT or SIGTERM stops the run gracefully, a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-		} else {
-			log.Fatalf("unknown inbox type: %s", inbox.Provider)
-		}
+	app := &app{}
+	app.cli = command.New("go-away", app.commands()...)
+	defer app.close()
 
+	err := app.cli.Run(ctx, os.Args[1:])
+	switch {
+	case err == nil:
+	case errors.Is(err, command.ErrUsage), errors.Is(err, flag.ErrHelp):
+		app.close()
+		os.Exit(2)
+	case errors.Is(err, store.ErrBusy):
+		warnf("go-away: %s\nis another go-away using the same database? retry once it has finished", err)
+		app.close()
+		os.Exit(1)
+	default:
+		warnf("go-away: %s", err)
+		app.close()
+		os.Exit(1)
 	}
 }
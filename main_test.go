@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/command"
+	"github.com/usrbinsam/go-away/internal/iter"
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/rules"
+	"github.com/usrbinsam/go-away/internal/scanner"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// fakeProvider serves messages from memory and records the recipients of
+// what it is asked to send.
+type fakeProvider struct {
+	messages []message.Message
+	sent     []string
+}
+
+func (p *fakeProvider) GetMail(ctx context.Context) iter.Seq[message.Message] {
+	return iter.FromSlice(p.messages)
+}
+
+func (p *fakeProvider) Send(ctx context.Context, to, subject, body string) error {
+	p.sent = append(p.sent, to)
+	return nil
+}
+
+type scannerFunc func(context.Context, *message.Message) (*scanner.ScanResult, error)
+
+func (f scannerFunc) Scan(ctx context.Context, msg *message.Message) (*scanner.ScanResult, error) {
+	return f(ctx, msg)
+}
+
+// testMessage returns a message from sender, with a mailto: List-Unsubscribe
+// when unsubscribe is set.
+func testMessage(id, sender, unsubscribe string) message.Message {
+	headers := []message.Header{
+		{Name: "From", Value: sender},
+		{Name: "Message-ID", Value: "<" + id + "@example.com>"},
+	}
+	if unsubscribe != "" {
+		headers = append(headers, message.Header{Name: "List-Unsubscribe", Value: "<mailto:" + unsubscribe + ">"})
+	}
+	msg := message.NewMessage(headers, "")
+	msg.SetID(id)
+	return *msg
+}
+
+// newTestUnsubscriber returns an unsubscriber for a single inbox served by p
+// and scanned by HeaderScanner, recording seen messages in a fresh store at
+// db, or in a temporary directory if db is empty.
+func newTestUnsubscriber(t *testing.T, db string, p *fakeProvider) (*Unsubscriber, *store.SQLStore) {
+	t.Helper()
+
+	if db == "" {
+		db = filepath.Join(t.TempDir(), "go-away.sqlite3")
+	}
+	st := &store.SQLStore{}
+	if err := st.Open(db); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	inbox, err := st.AddInbox(context.Background(), "sam@example.com", "fake", store.NewPendingInboxConfig(nil))
+	if err != nil {
+		t.Fatalf("failed to add inbox: %v", err)
+	}
+
+	unsubscriber := &Unsubscriber{
+		providers: []inboxProvider{{inbox, p}},
+		scanners:  map[int]scanner.Scanner{inbox.ID: scanner.NewHeaderScanner(p)},
+		seen:      st,
+		markSeen:  true,
+	}
+	return unsubscriber, st
+}
+
+func mustParseRules(t *testing.T, patterns ...string) rules.Set {
+	t.Helper()
+
+	var set rules.Set
+	for _, pattern := range patterns {
+		rule, err := rules.Parse(pattern)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		set = append(set, rule)
+	}
+	return set
+}
+
+func seenIDs(t *testing.T, st *store.SQLStore, inbox inboxProvider) []string {
+	t.Helper()
+
+	var ids []string
+	for _, id := range []string{"1", "2", "3", "4"} {
+		seen, err := st.Seen(context.Background(), inbox.ID, id, "<"+id+"@example.com>")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if seen {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestScanInbox_ScannerError(t *testing.T) {
+	p := &fakeProvider{messages: []message.Message{
+		testMessage("1", "news@shop.example", ""),
+		testMessage("2", "friend@example.com", ""),
+	}}
+	unsubscriber, st := newTestUnsubscriber(t, "", p)
+	inbox := unsubscriber.providers[0]
+	unsubscriber.blocklist = mustParseRules(t, "shop.example")
+	unsubscriber.scanners[inbox.ID] = scannerFunc(func(context.Context, *message.Message) (*scanner.ScanResult, error) {
+		return nil, errors.New("fetch failed")
+	})
+
+	received, err := scanInbox(context.Background(), unsubscriber, inbox, func(h hit) {
+		t.Errorf("expected no hits, got %s", h.Key)
+	})
+	if err != nil || received != 2 {
+		t.Fatalf("expected 2 messages, got %d (err: %v)", received, err)
+	}
+
+	// both are remembered, so they are not scanned, and fail, again next run
+	if ids := seenIDs(t, st, inbox); len(ids) != 2 {
+		t.Errorf("expected both messages to be marked seen, got %v", ids)
+	}
+}
+
+// scanKeys runs goAway and returns the keys of the lists found, prefixed with
+// "safe:" for safe senders and "blocked:" for blocklisted ones.
+func scanKeys(unsubscriber *Unsubscriber) []string {
+	var keys []string
+	for _, h := range goAway(context.Background(), unsubscriber) {
+		switch {
+		case h.safe != nil:
+			keys = append(keys, "safe:"+h.Key)
+		case h.blocked != nil:
+			keys = append(keys, "blocked:"+h.Key)
+		default:
+			keys = append(keys, h.Key)
+		}
+	}
+	return keys
+}
+
+func TestGoAway_SafeSenderWinsOverBlocklist(t *testing.T) {
+	p := &fakeProvider{messages: []message.Message{
+		testMessage("1", "news@shop.example", "leave@shop.example"),
+		testMessage("2", "deals@shop.example", "leave@shop.example"),
+	}}
+	unsubscriber, _ := newTestUnsubscriber(t, "", p)
+	unsubscriber.safeSenders = mustParseRules(t, "news@shop.example")
+	unsubscriber.blocklist = mustParseRules(t, "shop.example")
+
+	keys := scanKeys(unsubscriber)
+	if expected := []string{"safe:news@shop.example", "blocked:deals@shop.example"}; !slices.Equal(keys, expected) {
+		t.Errorf("expected %q, got %q", expected, keys)
+	}
+}
+
+func TestGoAway_SkipsSeenMessages(t *testing.T) {
+	p := &fakeProvider{messages: []message.Message{
+		testMessage("1", "news@shop.example", "leave@shop.example"),
+		testMessage("2", "friend@example.com", ""),
+	}}
+	unsubscriber, st := newTestUnsubscriber(t, "", p)
+	inbox := unsubscriber.providers[0]
+
+	if keys := scanKeys(unsubscriber); !slices.Equal(keys, []string{"news@shop.example"}) {
+		t.Fatalf("expected the list to be found, got %q", keys)
+	}
+	// hits are left for the caller to mark seen
+	if ids := seenIDs(t, st, inbox); !slices.Equal(ids, []string{"2"}) {
+		t.Errorf("expected only the message that is not a hit to be marked seen, got %v", ids)
+	}
+
+	unsubscriber.remember(context.Background(), inbox, &p.messages[0])
+	if keys := scanKeys(unsubscriber); len(keys) != 0 {
+		t.Errorf("expected seen messages to be skipped, got %q", keys)
+	}
+
+	unsubscriber.rescan = true
+	if keys := scanKeys(unsubscriber); !slices.Equal(keys, []string{"news@shop.example"}) {
+		t.Errorf("expected -rescan to scan seen messages again, got %q", keys)
+	}
+}
+
+func TestPruneSeen(t *testing.T) {
+	ctx := context.Background()
+	db := filepath.Join(t.TempDir(), "go-away.sqlite3")
+	p := &fakeProvider{messages: []message.Message{testMessage("1", "friend@example.com", "")}}
+	unsubscriber, st := newTestUnsubscriber(t, db, p)
+	inbox := unsubscriber.providers[0]
+	a := &app{st: st}
+
+	unsubscriber.remember(ctx, inbox, &p.messages[0])
+	if err := a.pruneSeen(ctx, inbox.Inbox); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := seenIDs(t, st, inbox); len(ids) != 1 {
+		t.Fatalf("expected a message seen just now to be kept, got %v", ids)
+	}
+
+	if err := store.NewInboxConfig(inbox.ID, st).Set(ctx, "seen::retention", "1h"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ageSeen(t, db, 2*time.Hour)
+	if err := a.pruneSeen(ctx, inbox.Inbox); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := seenIDs(t, st, inbox); len(ids) != 0 {
+		t.Errorf("expected a message seen longer ago than the retention to be forgotten, got %v", ids)
+	}
+}
+
+// ageSeen moves every seen record in the database at db back by age.
+func ageSeen(t *testing.T, db string, age time.Duration) {
+	t.Helper()
+
+	conn, err := sql.Open("sqlite", db)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec("update seen set ts = ?", time.Now().UTC().Add(-age).Format(time.DateTime)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// newUnsubscribeTest returns an app that answers prompts with input and
+// writes to out, running unsubscribe with -apply.
+func newUnsubscribeTest(st *store.SQLStore, input string, out *bytes.Buffer) *app {
+	a := &app{st: st, prompter: newPrompter(strings.NewReader(input), out), apply: true}
+	a.cli = command.New("go-away", a.commands()...)
+	a.cli.Stdout = out
+	return a
+}
+
+func TestUnsubscribe_BlocklistBypassesConfirm(t *testing.T) {
+	p := &fakeProvider{messages: []message.Message{
+		testMessage("1", "news@example.com", "leave@news.example.com"),
+		testMessage("2", "deals@shop.example", "leave@shop.example"),
+	}}
+	unsubscriber, st := newTestUnsubscriber(t, "", p)
+	unsubscriber.blocklist = mustParseRules(t, "shop.example")
+
+	var out bytes.Buffer
+	a := newUnsubscribeTest(st, "n\n", &out)
+	a.confirm = true
+	if err := a.unsubscribeAll(context.Background(), unsubscriber); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out.String())
+	}
+
+	if !slices.Equal(p.sent, []string{"leave@shop.example"}) {
+		t.Errorf("expected only the blocklisted list to be unsubscribed from, sent to %q", p.sent)
+	}
+	if asked := strings.Count(out.String(), "?"); asked != 1 {
+		t.Errorf("expected to be asked once, for the list that is not blocklisted, got:\n%s", out.String())
+	}
+}
+
+func TestUnsubscribe_Apply(t *testing.T) {
+	ctx := context.Background()
+	p := &fakeProvider{messages: []message.Message{
+		testMessage("1", "news@example.com", "leave@news.example.com"),
+		testMessage("2", "deals@shop.example", "leave@shop.example"),
+	}}
+	unsubscriber, st := newTestUnsubscriber(t, "", p)
+	inbox := unsubscriber.providers[0]
+	if err := st.RecordUnsubscribe(ctx, "<0@example.com>", "news@example.com", inbox.Addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := newUnsubscribeTest(st, "", &out).unsubscribeAll(ctx, unsubscriber); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out.String())
+	}
+
+	if !slices.Equal(p.sent, []string{"leave@shop.example"}) {
+		t.Errorf("expected the list already unsubscribed from to be skipped, sent to %q", p.sent)
+	}
+	attempts, err := st.ListUnsubscribes(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := store.Unsubscribe{MessageID: "<2@example.com>", ListID: "deals@shop.example", Recipient: inbox.Addr, Method: scanner.MethodMailto, Target: "mailto:leave@shop.example", Status: store.StatusOK}
+	if len(attempts) != 2 || attempts[0].Time.IsZero() {
+		t.Fatalf("expected the attempt to be recorded, got %+v", attempts)
+	}
+	if attempts[0].Time = (time.Time{}); attempts[0] != expected {
+		t.Errorf("expected attempt %+v, got %+v", expected, attempts[0])
+	}
+	if ids := seenIDs(t, st, inbox); !slices.Equal(ids, []string{"1", "2"}) {
+		t.Errorf("expected both messages to be marked seen, got %v", ids)
+	}
+}
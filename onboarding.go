@@ -0,0 +1,262 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/usrbinsam/go-away/internal/gmail"
+	"github.com/usrbinsam/go-away/internal/imap"
+	"github.com/usrbinsam/go-away/internal/jmap"
+	"github.com/usrbinsam/go-away/internal/maildir"
+	"github.com/usrbinsam/go-away/internal/mailer"
+	"github.com/usrbinsam/go-away/internal/mbox"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+// setupInbox runs the provider's credential setup against a pending inbox
+// config, asking the user for anything it needs. Existing values are offered
+// as defaults so re-authorizing only asks for what has to change. Inboxes whose
+// provider cannot send mail are offered an SMTP server for mailto: unsubscribes.
+func (a *app) setupInbox(ctx context.Context, providerKey, addr string, inboxConfig *store.InboxConfig) error {
+	if err := a.setupProvider(ctx, providerKey, addr, inboxConfig); err != nil {
+		return err
+	}
+
+	switch providerKey {
+	case imap.IMAPInboxKey, jmap.JMAPInboxKey, maildir.MaildirInboxKey, mbox.MboxInboxKey:
+		return a.setupSMTP(ctx, providerKey, addr, inboxConfig)
+	}
+	return nil
+}
+
+// askConfig asks question and saves the answer under key, offering the
+// current value, or fallback when there is none, as the default.
+func (a *app) askConfig(ctx context.Context, inboxConfig *store.InboxConfig, key, question, fallback string) error {
+	current, err := inboxConfig.GetString(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		fallback = current
+	}
+
+	answer, err := a.prompt().ask(question, fallback)
+	if err != nil {
+		return err
+	}
+	return inboxConfig.Set(ctx, key, answer)
+}
+
+func (a *app) setupProvider(ctx context.Context, providerKey, addr string, inboxConfig *store.InboxConfig) error {
+	p := a.prompt()
+	ask := func(key, question, fallback string) error {
+		return a.askConfig(ctx, inboxConfig, key, question, fallback)
+	}
+
+	switch providerKey {
+	case gmail.GmailInboxKey:
+		send, err := inboxConfig.GetString(ctx, "gmail::send")
+		if err != nil {
+			return err
+		}
+		allow, err := p.confirm("Send mailto: unsubscribe requests through Gmail (requires the gmail.send scope)?", send == "true")
+		if err != nil {
+			return err
+		}
+		if err := inboxConfig.Set(ctx, "gmail::send", fmt.Sprint(allow)); err != nil {
+			return err
+		}
+
+		for _, key := range []string{"credentials::accessToken", "credentials::refreshToken", "credentials::scope"} {
+			if err := inboxConfig.Unset(ctx, key); err != nil {
+				return err
+			}
+		}
+		_, err = gmail.Setup(ctx, inboxConfig)
+		return err
+
+	case imap.IMAPInboxKey:
+		_, domain, _ := strings.Cut(addr, "@")
+		if err := ask("imap::host", "IMAP server", "imap."+domain); err != nil {
+			return err
+		}
+
+		security, err := inboxConfig.GetString(ctx, "imap::security")
+		if err != nil {
+			return err
+		}
+		if security == "" {
+			security = "tls"
+		}
+		if security, err = p.choose("Connection security", []string{"tls", "starttls", "none"}, security); err != nil {
+			return err
+		}
+		if err := inboxConfig.Set(ctx, "imap::security", security); err != nil {
+			return err
+		}
+
+		port := "993"
+		if security != "tls" {
+			port = "143"
+		}
+		if err := ask("imap::port", "Port", port); err != nil {
+			return err
+		}
+		if err := ask("credentials::username", "Username", addr); err != nil {
+			return err
+		}
+
+		password, err := p.secret("Password (use an app password if your provider requires one)")
+		if err != nil {
+			return err
+		}
+		if err := inboxConfig.Set(ctx, "credentials::password", password); err != nil {
+			return err
+		}
+
+		return ask("imap::folder", "Folder to scan", "INBOX")
+
+	case jmap.JMAPInboxKey:
+		if err := ask("jmap::sessionURL", "JMAP session URL", "https://api.fastmail.com/jmap/session"); err != nil {
+			return err
+		}
+
+		token, err := p.secret("API token (needs mail access, and submission to send mailto: unsubscribe requests)")
+		if err != nil {
+			return err
+		}
+		if err := inboxConfig.Set(ctx, "credentials::token", token); err != nil {
+			return err
+		}
+
+		return ask("jmap::mailbox", "Mailbox to scan (role or name)", "inbox")
+
+	case maildir.MaildirInboxKey:
+		if err := ask("maildir::path", "Maildir directory (a Maildir or a directory of Maildirs)", "~/Maildir"); err != nil {
+			return err
+		}
+		return expandHome(ctx, inboxConfig, "maildir::path")
+
+	case mbox.MboxInboxKey:
+		if err := ask("mbox::path", "mbox file, or a directory of *.mbox files", ""); err != nil {
+			return err
+		}
+		return expandHome(ctx, inboxConfig, "mbox::path")
+	}
+
+	return fmt.Errorf("unknown inbox type: %s", providerKey)
+}
+
+// setupSMTP asks for the SMTP server that sends the mailto: unsubscribe
+// requests of an inbox whose provider cannot send them itself. Declining
+// prints how to add one later.
+func (a *app) setupSMTP(ctx context.Context, providerKey, addr string, inboxConfig *store.InboxConfig) error {
+	p := a.prompt()
+
+	configured, err := mailer.SMTPConfigured(ctx, inboxConfig)
+	if err != nil {
+		return err
+	}
+	question := "Send mailto: unsubscribe requests through an SMTP server?"
+	if providerKey == jmap.JMAPInboxKey {
+		question = "Send mailto: unsubscribe requests through an SMTP server instead of JMAP (for tokens without submission)?"
+	}
+	useSMTP, err := p.confirm(question, configured)
+	if err != nil {
+		return err
+	}
+	if !useSMTP {
+		fmt.Fprintf(a.stdout(), "mailto: unsubscribe requests will fail without a way to send them, add an SMTP server later with 'config set %s smtp::host <server>'\n", addr)
+		return nil
+	}
+
+	_, domain, _ := strings.Cut(addr, "@")
+	if err := a.askConfig(ctx, inboxConfig, "smtp::host", "SMTP server", "smtp."+domain); err != nil {
+		return err
+	}
+
+	security, err := inboxConfig.GetString(ctx, "smtp::security")
+	if err != nil {
+		return err
+	}
+	if security, err = p.choose("SMTP connection security", []string{"tls", "starttls", "none"}, cmp.Or(security, "tls")); err != nil {
+		return err
+	}
+	if err := inboxConfig.Set(ctx, "smtp::security", security); err != nil {
+		return err
+	}
+
+	port := "465"
+	if security != "tls" {
+		port = "587"
+	}
+	if err := a.askConfig(ctx, inboxConfig, "smtp::port", "SMTP port", port); err != nil {
+		return err
+	}
+
+	// an IMAP inbox's credentials are used unless the SMTP server has its own
+	if providerKey == imap.IMAPInboxKey {
+		same, err := p.confirm("Log in to the SMTP server with the IMAP username and password?", true)
+		if err != nil || same {
+			return err
+		}
+	}
+	if err := a.askConfig(ctx, inboxConfig, "smtp::username", "SMTP username", addr); err != nil {
+		return err
+	}
+	password, err := p.secret("SMTP password")
+	if err != nil {
+		return err
+	}
+	return inboxConfig.Set(ctx, "smtp::password", password)
+}
+
+// expandHome replaces a leading ~ in the path saved under key with the user's
+// home directory, as a shell would have.
+func expandHome(ctx context.Context, inboxConfig *store.InboxConfig, key string) error {
+	path, err := inboxConfig.GetString(ctx, key)
+	if err != nil {
+		return err
+	}
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	return inboxConfig.Set(ctx, key, filepath.Join(home, path[1:]))
+}
+
+// checkInbox validates a pending inbox config by fetching a single message.
+// The fetch runs against a copy of the config so that sync state such as
+// gmail::historyId is never saved by the check.
+func (a *app) checkInbox(ctx context.Context, providerKey string, inboxConfig *store.InboxConfig) error {
+	values, err := inboxConfig.Values(ctx)
+	if err != nil {
+		return err
+	}
+	probe := store.NewPendingInboxConfig(values)
+	if providerKey == gmail.GmailInboxKey {
+		probe.Set(ctx, "gmail::maxMessages", "1")
+	}
+
+	p, err := providerFor(ctx, a.st, providerKey, probe)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(a.stdout(), "checking access with a test fetch ...")
+	for _, err := range p.GetMail(ctx) {
+		if err != nil {
+			return fmt.Errorf("test fetch failed: %w", err)
+		}
+		break
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/command"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+func TestSetupInbox_SMTP(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected map[string]string
+	}{
+		{
+			name:  "declined",
+			input: "\n\n",
+			expected: map[string]string{
+				"smtp::host": "",
+			},
+		},
+		{
+			name:  "starttls",
+			input: "\ny\n\nstarttls\n\nsam\nhunter2\n",
+			expected: map[string]string{
+				"smtp::host":     "smtp.example.com",
+				"smtp::security": "starttls",
+				"smtp::port":     "587",
+				"smtp::username": "sam",
+				"smtp::password": "hunter2",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			root := t.TempDir()
+
+			var out bytes.Buffer
+			a := &app{prompter: newPrompter(strings.NewReader(root+tc.input), &out)}
+			a.cli = command.New("go-away", a.commands()...)
+			a.cli.Stdout = &out
+
+			inboxConfig := store.NewPendingInboxConfig(nil)
+			if err := a.setupInbox(ctx, "maildir", "sam@example.com", inboxConfig); err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, out.String())
+			}
+			for key, expected := range tc.expected {
+				if value, err := inboxConfig.GetString(ctx, key); err != nil || value != expected {
+					t.Errorf("%s: expected %q, got %q (err: %v)", key, expected, value, err)
+				}
+			}
+
+			hint := "config set sam@example.com smtp::host <server>"
+			if strings.Contains(out.String(), hint) != (tc.expected["smtp::host"] == "") {
+				t.Errorf("unexpected output for %s:\n%s", tc.name, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/message"
+	"github.com/usrbinsam/go-away/internal/scanner"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+func testRecords() []scanRecord {
+	msg := message.NewMessage([]message.Header{{Name: "Message-ID", Value: "<42@news.example.com>"}}, "")
+
+	unsubscribe := hit{
+		Candidate: &scanner.Candidate{
+			ListID:   "news.example.com",
+			Sender:   "news@example.com",
+			Count:    3,
+			First:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Last:     time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC),
+			Subjects: []string{"Deals, \"deals\"\nand more deals"},
+			Methods:  []string{scanner.MethodOneClick, scanner.MethodMailto},
+			Message:  msg,
+			Result:   &scanner.ScanResult{Scanner: scanner.HeaderScannerName, Confidence: 0.95},
+		},
+		inbox: inboxProvider{Inbox: store.Inbox{ID: 1, Addr: "sam@example.com"}},
+	}
+	safe := hit{
+		Candidate: &scanner.Candidate{Sender: "alerts@bank.example", Count: 1},
+		inbox:     inboxProvider{Inbox: store.Inbox{ID: 1, Addr: "sam@example.com"}},
+	}
+
+	return []scanRecord{
+		newScanRecord(unsubscribe, "unsubscribe", "found List-Unsubscribe-Post"),
+		newScanRecord(safe, "skip", "safe sender"),
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: "json",
+			expected: `[
+  {
+    "inbox": "sam@example.com",
+    "message_id": "<42@news.example.com>",
+    "sender": "news@example.com",
+    "list_id": "news.example.com",
+    "subject": "Deals, \"deals\"\nand more deals",
+    "methods": [
+      "one-click",
+      "mailto"
+    ],
+    "scanner": "header",
+    "confidence": 0.95,
+    "action": "unsubscribe",
+    "reason": "found List-Unsubscribe-Post",
+    "messages": 3,
+    "first": "2024-01-02T03:04:05Z",
+    "last": "2024-06-07T08:09:10Z"
+  },
+  {
+    "inbox": "sam@example.com",
+    "message_id": "",
+    "sender": "alerts@bank.example",
+    "list_id": "",
+    "subject": "",
+    "methods": [],
+    "scanner": "",
+    "confidence": 0,
+    "action": "skip",
+    "reason": "safe sender",
+    "messages": 1
+  }
+]
+`,
+		},
+		{
+			format: "ndjson",
+			expected: `{"inbox":"sam@example.com","message_id":"<42@news.example.com>","sender":"news@example.com","list_id":"news.example.com","subject":"Deals, \"deals\"\nand more deals","methods":["one-click","mailto"],"scanner":"header","confidence":0.95,"action":"unsubscribe","reason":"found List-Unsubscribe-Post","messages":3,"first":"2024-01-02T03:04:05Z","last":"2024-06-07T08:09:10Z"}
+{"inbox":"sam@example.com","message_id":"","sender":"alerts@bank.example","list_id":"","subject":"","methods":[],"scanner":"","confidence":0,"action":"skip","reason":"safe sender","messages":1}
+`,
+		},
+		{
+			format: "csv",
+			expected: "inbox,message_id,sender,list_id,subject,methods,scanner,confidence,action,reason,messages,first,last\n" +
+				"sam@example.com,<42@news.example.com>,news@example.com,news.example.com,\"Deals, \"\"deals\"\"\nand more deals\",one-click mailto,header,0.95,unsubscribe,found List-Unsubscribe-Post,3,2024-01-02T03:04:05Z,2024-06-07T08:09:10Z\n" +
+				"sam@example.com,,alerts@bank.example,,,,,0,skip,safe sender,1,,\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeRecords(&buf, tc.format, testRecords()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if buf.String() != tc.expected {
+				t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), tc.expected)
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		for format, expected := range map[string]string{
+			"json":   "[]\n",
+			"ndjson": "",
+			"csv":    "inbox,message_id,sender,list_id,subject,methods,scanner,confidence,action,reason,messages,first,last\n",
+		} {
+			var buf bytes.Buffer
+			if err := writeRecords(&buf, format, []scanRecord{}); err != nil || buf.String() != expected {
+				t.Errorf("%s: expected %q, got %q (err: %v)", format, expected, buf.String(), err)
+			}
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if err := writeRecords(&bytes.Buffer{}, "xml", testRecords()); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("disk full")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+func TestWriteRecords_WriteError(t *testing.T) {
+	// enough rows to fill the CSV writer's buffer before the final flush
+	records := testRecords()
+	records[0].Reason = strings.Repeat("x", 8192)
+
+	for _, format := range []string{"json", "ndjson", "csv"} {
+		if err := writeRecords(failingWriter{}, format, records); !errors.Is(err, errWrite) {
+			t.Errorf("%s: expected %v, got: %v", format, errWrite, err)
+		}
+	}
+}
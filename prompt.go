@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// prompter asks the user questions on the terminal, or reads the answers line
+// by line when input is not a terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	tty *os.File // set when input is a terminal whose echo can be turned off
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	if f, ok := in.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			p.tty = f
+		}
+	}
+	return p
+}
+
+func (p *prompter) readLine() (string, error) {
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return "", errors.New("unexpected end of input")
+		}
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// ask returns the user's answer, or fallback when the answer is empty. An
+// empty fallback makes the question mandatory.
+func (p *prompter) ask(question, fallback string) (string, error) {
+	for {
+		if fallback != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, fallback)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+
+		answer, err := p.readLine()
+		if err != nil {
+			return "", err
+		}
+		if answer == "" {
+			answer = fallback
+		}
+		if answer != "" {
+			return answer, nil
+		}
+	}
+}
+
+// choose asks until the answer is one of options.
+func (p *prompter) choose(question string, options []string, fallback string) (string, error) {
+	for {
+		answer, err := p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(options, ", ")), fallback)
+		if err != nil {
+			return "", err
+		}
+		answer = strings.ToLower(answer)
+		if slices.Contains(options, answer) {
+			return answer, nil
+		}
+		fmt.Fprintf(p.out, "please answer one of %s\n", strings.Join(options, ", "))
+	}
+}
+
+func (p *prompter) confirm(question string, fallback bool) (bool, error) {
+	options, answer := "y/N", "n"
+	if fallback {
+		options, answer = "Y/n", "y"
+	}
+
+	for {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, options)
+		line, err := p.readLine()
+		if err != nil {
+			return false, err
+		}
+		if line == "" {
+			line = answer
+		}
+		switch strings.ToLower(line) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// secret asks for a mandatory answer without echoing it, as far as the terminal allows.
+func (p *prompter) secret(question string) (string, error) {
+	if p.tty != nil {
+		if err := p.stty("-echo"); err == nil {
+			defer func() {
+				p.stty("echo")
+				fmt.Fprintln(p.out)
+			}()
+		}
+	}
+
+	for {
+		fmt.Fprintf(p.out, "%s: ", question)
+		answer, err := p.readLine()
+		if err != nil || answer != "" {
+			return answer, err
+		}
+	}
+}
+
+func (p *prompter) stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = p.tty
+	return cmd.Run()
+}
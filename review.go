@@ -0,0 +1,261 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/usrbinsam/go-away/internal/command"
+	"github.com/usrbinsam/go-away/internal/rules"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+const reviewHelp = `commands:
+  keep <n>...         keep receiving the lists, e.g. "keep 1 3-5"
+  unsubscribe <n>...  unsubscribe from the lists
+  safe <n>...         add a safe sender rule for the lists
+  clear <n>...        undecide the lists
+  list                show the lists again
+  apply               save the decisions and carry them out
+  quit                leave without changing anything
+<n> is a number from the list, a range such as 2-4, or "all". Commands can be
+shortened to their first letter.`
+
+// review lists the lists found by a scan and lets the user decide, list by
+// list, to keep, unsubscribe or add a safe sender rule. Decisions saved by
+// earlier reviews are preselected, and nothing changes until they are applied.
+func (a *app) review(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return command.ErrUsage
+	}
+
+	ctx, cancel := a.runContext(ctx)
+	defer cancel()
+
+	unsubscriber, err := a.unsubscriber(ctx)
+	if err != nil {
+		return err
+	}
+	// nothing is marked seen before the decisions are applied, and the
+	// messages of lists left undecided not even then: they come up again in
+	// the next review
+	unsubscriber.holdSeen = !a.cli.Global.DryRun
+
+	hits := make([]hit, 0)
+	decisions := make([]string, 0)
+	for _, hit := range goAway(ctx, unsubscriber) {
+		if hit.safe != nil {
+			continue
+		}
+		decision, err := a.decision(ctx, hit)
+		if err != nil {
+			return err
+		}
+		hits = append(hits, hit)
+		decisions = append(decisions, decision)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(hits) == 0 {
+		fmt.Fprintln(a.stdout(), "nothing to review")
+		return nil
+	}
+	return a.reviewHits(ctx, unsubscriber, hits, decisions)
+}
+
+// reviewHits asks for decisions about hits, starting from decisions, until
+// they are applied or the user quits.
+func (a *app) reviewHits(ctx context.Context, unsubscriber *Unsubscriber, hits []hit, decisions []string) error {
+	p := a.prompt()
+	a.printReview(hits, decisions)
+	for {
+		line, err := p.ask("review [keep|unsubscribe|safe|clear <n>..., list, apply, quit, help]", "")
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(line)
+		verb, selection := strings.ToLower(fields[0]), fields[1:]
+
+		decision := ""
+		switch verb {
+		case "k", "keep":
+			decision = store.DecisionKeep
+		case "u", "unsubscribe":
+			decision = store.DecisionUnsubscribe
+		case "s", "safe":
+			decision = store.DecisionSafe
+		case "c", "clear":
+		case "l", "list":
+			a.printReview(hits, decisions)
+			continue
+		case "a", "apply":
+			return a.applyReview(ctx, unsubscriber, hits, decisions)
+		case "q", "quit":
+			fmt.Fprintln(a.stdout(), "nothing was changed")
+			return nil
+		case "h", "help", "?":
+			fmt.Fprintln(a.stdout(), reviewHelp)
+			continue
+		default:
+			fmt.Fprintf(a.stdout(), "unknown command %q, try help\n", verb)
+			continue
+		}
+
+		indexes, err := parseSelection(selection, len(hits))
+		if err != nil {
+			fmt.Fprintln(a.stdout(), err)
+			continue
+		}
+		for _, i := range indexes {
+			if decision == store.DecisionUnsubscribe && hits[i].Result == nil {
+				fmt.Fprintf(a.stdout(), "%d: no way to unsubscribe from %s\n", i+1, hits[i].Key)
+				continue
+			}
+			decisions[i] = decision
+		}
+		a.printReview(hits, decisions)
+	}
+}
+
+func (a *app) printReview(hits []hit, decisions []string) {
+	w := tabwriter.NewWriter(a.stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tDECISION\tINBOX\tSENDER\tLIST-ID\tMESSAGES\tLAST\tMETHOD")
+	for i, hit := range hits {
+		decision, last, method := cmp.Or(decisions[i], "-"), "-", "-"
+		if !hit.Last.IsZero() {
+			last = hit.Last.Local().Format(time.DateOnly)
+		}
+		if hit.Result != nil {
+			method = hit.Result.Method
+		}
+		if hit.blocked != nil {
+			decision += " (blocklist)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", i+1, decision, hit.inbox.Addr, cmp.Or(hit.Sender, "-"), cmp.Or(hit.ListID, "-"), hit.Count, last, method)
+	}
+	w.Flush()
+}
+
+// applyReview saves and carries out every decision made.
+func (a *app) applyReview(ctx context.Context, unsubscriber *Unsubscriber, hits []hit, decisions []string) error {
+	if !a.cli.Global.DryRun {
+		unsubscriber.markHeld(ctx)
+	}
+
+	failed := 0
+	for i, hit := range hits {
+		decision := decisions[i]
+		if decision == "" {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		if a.cli.Global.DryRun {
+			fmt.Fprintf(a.stdout(), "would %s %s for %s\n", decision, hit.Key, hit.inbox.Addr)
+			continue
+		}
+		if err := a.st.SetDecision(ctx, hit.inbox.ID, hit.Key, decision); err != nil {
+			return err
+		}
+
+		switch decision {
+		case store.DecisionKeep:
+			unsubscriber.rememberAll(ctx, hit)
+			fmt.Fprintf(a.stdout(), "keeping %s for %s\n", hit.Key, hit.inbox.Addr)
+		case store.DecisionSafe:
+			if err := a.addSafeSender(ctx, hit); err != nil {
+				return err
+			}
+			unsubscriber.rememberAll(ctx, hit)
+		case store.DecisionUnsubscribe:
+			done, err := a.st.Unsubscribed(ctx, hit.Key, hit.inbox.Addr)
+			if err != nil {
+				return err
+			}
+			if done {
+				unsubscriber.rememberAll(ctx, hit)
+				fmt.Fprintf(a.stdout(), "%s is already unsubscribed from %s\n", hit.inbox.Addr, hit.Key)
+				continue
+			}
+
+			ok, err := a.unsubscribeList(ctx, unsubscriber, hit)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d unsubscribes failed", failed)
+	}
+	return ctx.Err()
+}
+
+// addSafeSender adds a safe sender rule for the list of hit to its inbox,
+// matching the List-Id when there is one and the sender address otherwise.
+func (a *app) addSafeSender(ctx context.Context, hit hit) error {
+	pattern := hit.Sender
+	if hit.ListID != "" {
+		pattern = "list:" + hit.ListID
+	}
+	if pattern == "" {
+		warnf("inbox %s: no sender address for %s, add a safe sender rule with 'safe-senders add'", hit.inbox.Addr, hit.Key)
+		return nil
+	}
+
+	rule, err := rules.Parse(pattern)
+	if err != nil {
+		return err
+	}
+	rule.InboxID = hit.inbox.ID
+
+	if _, err := a.st.AddSafeSender(ctx, rule); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout(), "added %s rule %s for %s\n", rule.Kind, rule, hit.inbox.Addr)
+	return nil
+}
+
+// parseSelection turns list numbers, ranges such as 2-4 and "all" into
+// indexes of a list of n items.
+func parseSelection(args []string, n int) ([]int, error) {
+	if len(args) == 0 {
+		return nil, errors.New("select lists by number, e.g. 1 3-5, or all")
+	}
+
+	indexes := make([]int, 0, len(args))
+	for _, arg := range strings.FieldsFunc(strings.Join(args, " "), func(r rune) bool { return r == ' ' || r == ',' }) {
+		if arg == "all" {
+			for i := range n {
+				indexes = append(indexes, i)
+			}
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(arg, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 1 || last > n || first > last {
+			return nil, fmt.Errorf("invalid selection %q, expected numbers from 1 to %d", arg, n)
+		}
+		for i := first; i <= last; i++ {
+			indexes = append(indexes, i-1)
+		}
+	}
+	return indexes, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/usrbinsam/go-away/internal/command"
+	"github.com/usrbinsam/go-away/internal/rules"
+	"github.com/usrbinsam/go-away/internal/scanner"
+	"github.com/usrbinsam/go-away/internal/store"
+)
+
+func TestParseSelection(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected []int
+	}{
+		{[]string{"1"}, []int{0}},
+		{[]string{"1", "3-4"}, []int{0, 2, 3}},
+		{[]string{"1,2"}, []int{0, 1}},
+		{[]string{"4,", "2-2"}, []int{3, 1}},
+		{[]string{"all"}, []int{0, 1, 2, 3}},
+		{[]string{}, nil},
+		{[]string{"0"}, nil},
+		{[]string{"5"}, nil},
+		{[]string{"3-5"}, nil},
+		{[]string{"4-2"}, nil},
+		{[]string{"one"}, nil},
+		{[]string{"1-"}, nil},
+	}
+
+	for _, tc := range testCases {
+		indexes, err := parseSelection(tc.args, 4)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.args, indexes)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(indexes, tc.expected) {
+			t.Errorf("%q: expected %v, got %v (err: %v)", tc.args, tc.expected, indexes, err)
+		}
+	}
+}
+
+// newReviewTest creates a database with a Maildir inbox holding, in this
+// order, two mailing lists that can be unsubscribed from by mail and a
+// message that is not from a list, and returns the database path and the
+// inbox.
+func newReviewTest(t *testing.T) (string, store.Inbox) {
+	t.Helper()
+	ctx := context.Background()
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Maildir messages are listed in file name order
+	for _, m := range []struct{ name, content string }{
+		{"1700000001.M1P1.host", "From: news@example.com\r\nMessage-ID: <1@news.example.com>\r\nList-Id: <news.example.com>\r\nList-Unsubscribe: <mailto:leave@news.example.com>\r\n\r\nIssue 1\r\n"},
+		{"1700000002.M2P2.host", "From: deals@shop.example\r\nMessage-ID: <2@shop.example>\r\nList-Unsubscribe: <mailto:leave@shop.example>\r\n\r\nBuy now\r\n"},
+		{"1700000003.M3P3.host", "From: friend@example.com\r\nMessage-ID: <3@example.com>\r\n\r\nLunch?\r\n"},
+	} {
+		if err := os.WriteFile(filepath.Join(root, "new", m.name), []byte(m.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := filepath.Join(t.TempDir(), "go-away.sqlite3")
+	st := &store.SQLStore{}
+	if err := st.Open(db); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	inbox, err := st.AddInbox(ctx, "sam@example.com", "maildir", store.NewPendingInboxConfig(map[string]string{"maildir::path": root}))
+	if err != nil {
+		t.Fatalf("failed to add inbox: %v", err)
+	}
+	return db, inbox
+}
+
+// runReview runs the review command with input as the user's answers and
+// returns what it printed.
+func runReview(t *testing.T, db, input string, args ...string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	a := &app{prompter: newPrompter(strings.NewReader(input), &out)}
+	a.cli = command.New("go-away", a.commands()...)
+	a.cli.Stdout, a.cli.Stderr = &out, io.Discard
+	defer a.close()
+
+	if err := a.cli.Run(context.Background(), append([]string{"-db", db}, append(args, "review")...)); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, out.String())
+	}
+	return out.String()
+}
+
+// reviewRow returns the last printed row of the review table for key.
+func reviewRow(t *testing.T, out, key string) string {
+	t.Helper()
+
+	row := ""
+	for line := range strings.Lines(out) {
+		if strings.Contains(line, key) && !strings.HasPrefix(line, "would") {
+			row = strings.Join(strings.Fields(line), " ")
+		}
+	}
+	if row == "" {
+		t.Fatalf("no review row for %s in:\n%s", key, out)
+	}
+	return row
+}
+
+func savedDecisions(t *testing.T, db string, inbox store.Inbox) map[string]string {
+	t.Helper()
+
+	st := &store.SQLStore{}
+	if err := st.Open(db); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	decisions, err := st.Decisions(context.Background(), inbox.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return decisions
+}
+
+func TestReview_UnsubscribeWithoutResult(t *testing.T) {
+	var out bytes.Buffer
+	a := &app{prompter: newPrompter(strings.NewReader("unsubscribe all\nquit\n"), &out)}
+	a.cli = command.New("go-away", a.commands()...)
+	a.cli.Stdout = &out
+
+	inbox := inboxProvider{Inbox: store.Inbox{ID: 1, Addr: "sam@example.com"}}
+	blocked, _ := rules.Parse("deals@shop.example")
+	hits := []hit{
+		{Candidate: &scanner.Candidate{Key: "news.example.com", Result: &scanner.ScanResult{Hit: true, Method: scanner.MethodMailto}}, inbox: inbox},
+		{Candidate: &scanner.Candidate{Key: "deals@shop.example"}, inbox: inbox, blocked: &blocked},
+	}
+	decisions := []string{"", ""}
+
+	if err := a.reviewHits(context.Background(), nil, hits, decisions); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "2: no way to unsubscribe from deals@shop.example") {
+		t.Errorf("expected unsubscribe to be rejected for the hit without a result, got:\n%s", out.String())
+	}
+	if !slices.Equal(decisions, []string{store.DecisionUnsubscribe, ""}) {
+		t.Errorf("expected only the first list to be selected, got %q", decisions)
+	}
+	if !strings.HasSuffix(out.String(), "nothing was changed\n") {
+		t.Errorf("expected quit to change nothing, got:\n%s", out.String())
+	}
+}
+
+func TestReview_PreselectsSavedDecisions(t *testing.T) {
+	db, inbox := newReviewTest(t)
+
+	st := &store.SQLStore{}
+	if err := st.Open(db); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if err := st.SetDecision(context.Background(), inbox.ID, "news.example.com", store.DecisionKeep); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	st.Close()
+
+	out := runReview(t, db, "quit\n")
+
+	if row, expected := reviewRow(t, out, "news.example.com"), "1 keep sam@example.com news@example.com news.example.com 1 - mailto"; row != expected {
+		t.Errorf("expected the saved decision to be preselected in %q, got %q", expected, row)
+	}
+	if row, expected := reviewRow(t, out, "deals@shop.example"), "2 - sam@example.com deals@shop.example - 1 - mailto"; row != expected {
+		t.Errorf("expected the other list to be undecided in %q, got %q", expected, row)
+	}
+}
+
+// seenCount returns the number of messages of inbox marked seen.
+func seenCount(t *testing.T, db string, inbox store.Inbox) int {
+	t.Helper()
+
+	conn, err := sql.Open("sqlite", db)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer conn.Close()
+
+	var count int
+	if err := conn.QueryRow("select count(*) from seen where inbox_id = ?", inbox.ID).Scan(&count); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return count
+}
+
+func TestReview_MarksSeenOnApply(t *testing.T) {
+	db, inbox := newReviewTest(t)
+
+	out := runReview(t, db, "keep 1\nquit\n")
+	if !strings.HasSuffix(out, "nothing was changed\n") {
+		t.Errorf("expected quit to change nothing, got:\n%s", out)
+	}
+	if count := seenCount(t, db, inbox); count != 0 {
+		t.Errorf("expected quit to mark no messages seen, got %d", count)
+	}
+
+	// the message that is not from a list and the kept list, not the undecided one
+	runReview(t, db, "keep 1\napply\n")
+	if count := seenCount(t, db, inbox); count != 2 {
+		t.Errorf("expected apply to mark 2 messages seen, got %d", count)
+	}
+	if out := runReview(t, db, "quit\n"); reviewRow(t, out, "deals@shop.example") != "1 - sam@example.com deals@shop.example - 1 - mailto" {
+		t.Errorf("expected only the undecided list to come up again, got:\n%s", out)
+	}
+}
+
+func TestReview_DryRun(t *testing.T) {
+	db, inbox := newReviewTest(t)
+
+	out := runReview(t, db, "keep all\napply\n", "-dry-run")
+
+	for _, expected := range []string{
+		"would keep news.example.com for sam@example.com",
+		"would keep deals@shop.example for sam@example.com",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in:\n%s", expected, out)
+		}
+	}
+	if decisions := savedDecisions(t, db, inbox); len(decisions) != 0 {
+		t.Errorf("expected a dry run to save nothing, got %v", decisions)
+	}
+
+	// nothing was marked seen either, so both lists come up again
+	out = runReview(t, db, "keep all\napply\n")
+	if !strings.Contains(out, "keeping news.example.com for sam@example.com") || !strings.Contains(out, "keeping deals@shop.example for sam@example.com") {
+		t.Errorf("expected both lists to be reviewed again, got:\n%s", out)
+	}
+	expected := map[string]string{"news.example.com": store.DecisionKeep, "deals@shop.example": store.DecisionKeep}
+	if decisions := savedDecisions(t, db, inbox); !maps.Equal(decisions, expected) {
+		t.Errorf("expected decisions %v, got %v", expected, decisions)
+	}
+}